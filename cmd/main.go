@@ -2,27 +2,78 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/hashicorp/memberlist"
+	"github.com/noahdw/Gonolith/api"
+	"github.com/noahdw/Gonolith/internal/auth"
+	"github.com/noahdw/Gonolith/internal/cluster"
+	"github.com/noahdw/Gonolith/internal/controlplane"
+	"github.com/noahdw/Gonolith/internal/deploy"
+	"github.com/noahdw/Gonolith/internal/discovery"
+	"github.com/noahdw/Gonolith/internal/events"
+	"github.com/noahdw/Gonolith/internal/httpapi"
+	"github.com/noahdw/Gonolith/internal/kv"
+	"github.com/noahdw/Gonolith/internal/manifest"
 	"github.com/noahdw/Gonolith/internal/microservice"
+	"github.com/noahdw/Gonolith/internal/router"
+	"github.com/noahdw/Gonolith/internal/singleton"
+	"github.com/noahdw/Gonolith/internal/system"
+	"github.com/noahdw/Gonolith/internal/wasm"
+	"google.golang.org/grpc"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "plan", "apply":
+			if err := runDeploy(os.Args[1], os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				os.Exit(1)
+			}
+			return
+		case "cordon", "uncordon", "drain":
+			if err := runNodeOperation(os.Args[1], os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				os.Exit(1)
+			}
+			return
+		case "keygen":
+			key, err := cluster.GenerateKey()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				os.Exit(1)
+			}
+			fmt.Println(key)
+			return
+		}
+	}
+
+	runNode()
+}
 
+func runNode() {
 	// Get configuration from environment
 	httpPort := os.Getenv("HTTP_PORT")
 	if httpPort == "" {
 		httpPort = "8080"
 	}
 
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort == "" {
+		grpcPort = "50051"
+	}
+
 	nodeName := os.Getenv("NODE_NAME")
 	if nodeName == "" {
 		nodeName = "gonolith1"
@@ -37,34 +88,184 @@ func main() {
 		panic(err)
 	}
 
-	// Configure memberlist
-	config := memberlist.DefaultLocalConfig()
-	config.Name = nodeName
-	config.BindPort = memberPort
-	config.AdvertisePort = memberPort
+	services := microservice.NewMicroservices()
+	kvStore := kv.NewStore(nodeName)
 
-	list, err := memberlist.Create(config)
+	// Configure memberlist
+	list, err := cluster.NewCluster(cluster.Config{
+		NodeName: nodeName,
+		BindPort: memberPort,
+		HTTPPort: httpPort,
+		GRPCPort: grpcPort,
+		PushPull: 5 * time.Second,
+		LocalState: func() []microservice.MicroserviceStatusAPI {
+			return services.GetAllStatuses().Services
+		},
+		KeyringFile: os.Getenv("GOSSIP_KEYRING_FILE"),
+		KV:          kvStore,
+	})
 	if err != nil {
 		panic("Failed to create memberlist: " + err.Error())
 	}
 
-	// Join cluster if CLUSTER_MEMBERS is set
+	// Start standalone and keep trying to join the seeds in the background
+	var seeds []string
 	if members := os.Getenv("CLUSTER_MEMBERS"); members != "" {
-		memberList := strings.Split(members, ",")
-		err := joinClusterWithRetry(list, memberList, 5, time.Second*3)
+		seeds = strings.Split(members, ",")
+	}
+	joiner := cluster.NewJoiner(list, cluster.JoinConfig{
+		Seeds:       seeds,
+		SeedFile:    os.Getenv("SEED_FILE"),
+		SeedDNS:     os.Getenv("SEED_DNS"),
+		DefaultPort: memberPort,
+	})
+
+	// Optional raft control plane among the nodes listed in RAFT_SERVERS
+	var store *controlplane.Store
+	var raftServers []string
+	if raw := os.Getenv("RAFT_SERVERS"); raw != "" {
+		store, raftServers, err = newControlPlane(nodeName, raw)
 		if err != nil {
-			panic("Failed to join cluster: " + err.Error())
+			panic("Failed to start control plane: " + err.Error())
 		}
 	}
 
-	services := microservice.NewMicroservices()
+	// API tokens from AUTH_TOKENS_FILE, nodes call each other with NODE_TOKEN
+	authenticator, nodeToken, err := newAuthenticator()
+	if err != nil {
+		panic("Failed to set up authentication: " + err.Error())
+	}
+
+	nodeClient := deploy.NewClient()
+	nodeClient.SetToken(nodeToken)
+	// Locks for services and singletons, passed on to the control plane leader
+	locksServer := controlplane.NewGRPCServer(store, raftServers, list.GRPCAddr)
+	locksServer.SetNodeToken(nodeToken)
+	if len(raftServers) == 0 {
+		slog.Warn("No control plane, set RAFT_SERVERS to elect singletons")
+	}
+	elector := singleton.NewElector(services, locksServer)
+	drainer := deploy.NewDrainer(list, services, nodeClient)
+	drainer.SetElector(elector)
+
+	// Unix sockets for services on this node, so local calls skip TCP
+	socketDir, err := newSocketDir(nodeName)
+	if err != nil {
+		panic("Failed to create socket directory: " + err.Error())
+	}
+	nodeSocket := filepath.Join(socketDir, "node.sock")
+
+	// Ports services declare are allocated from PORT_RANGE
+	portRange := os.Getenv("PORT_RANGE")
+	if portRange == "" {
+		portRange = "20000-20999"
+	}
+	firstPort, lastPort, err := microservice.ParsePortRange(portRange)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	services.SetOnChange(list.BroadcastState)
+	kvStore.SetOnWrite(list.BroadcastKV)
+	services.SetSocketDir(socketDir)
+	services.SetPortRange(firstPort, lastPort)
+	services.SetCatalog(func() []microservice.MicroserviceStatusAPI {
+		var all []microservice.MicroserviceStatusAPI
+		for _, node := range list.State().Nodes {
+			all = append(all, node.Services...)
+		}
+		return all
+	})
+	services.SetEnv([]string{
+		"GONOLITH_NODE=" + nodeName,
+		"GONOLITH_NODE_ADDR=localhost:" + grpcPort,
+		"GONOLITH_NODE_SOCKET=" + nodeSocket,
+	})
+
+	// Calls to any service other than the node's own are routed to an instance
+	// on this node or another one, WebAssembly services run inside the node and
+	// call out through the router
+	grpcRouter := router.NewRouter(list, services)
+	grpcRouter.SetNodeToken(nodeToken)
+	wasmRuntime, err := wasm.NewRuntime(context.Background(), grpcRouter)
+	if err != nil {
+		panic(err.Error())
+	}
+	services.SetRuntime(microservice.RuntimeWasm, microservice.NewWasmRuntime(wasmRuntime))
+
 	handler := microservice.NewInstallerHandler(services)
 	monitorHandler := microservice.NewMonitorHandler(services)
+	clusterHandler := cluster.NewClusterHandler(list, joiner)
+	clusterHandler.SetNodeToken(nodeToken)
+	controlPlaneHandler := controlplane.NewControlPlaneHandler(store, raftServers, list.HTTPAddr)
+	nodeHandler := deploy.NewNodeHandler(list, drainer)
+	resolver := discovery.NewResolver(list)
+	resolver.SetNodeSocket(nodeSocket)
+	discoveryHandler := discovery.NewDiscoveryHandler(resolver)
+	systemHandler := system.NewSystemHandler(list)
+	bus := events.NewBus(nodeName)
+	forwarder := events.NewForwarder(list)
+	forwarder.SetNodeToken(nodeToken)
+	bus.SetForwarder(forwarder)
+	eventsHandler := events.NewEventsHandler(bus)
+	kvHandler := kv.NewKVHandler(kvStore)
 	r := chi.NewMux()
-	r.Post("/install-service", handler.HandleInstallMicroservice)
-	r.Post("/stop-service", handler.HandleStopMicroservice)
-	r.Post("/start-service", handler.HandleStartMicroservice)
-	r.Get("/get-status", monitorHandler.HandleGetStatus)
+	r.NotFound(httpapi.HandleNotFound)
+	r.MethodNotAllowed(httpapi.HandleMethodNotAllowed)
+	r.Route(httpapi.Version, func(r chi.Router) {
+		r.Use(authenticator.Authenticate)
+
+		r.Group(func(r chi.Router) {
+			r.Use(authenticator.Require(auth.RoleViewer, auth.RoleNode))
+			r.Get("/services", monitorHandler.HandleGetStatus)
+			r.Get("/services/{id}", monitorHandler.HandleGetService)
+			r.Get("/discovery/{name}", discoveryHandler.HandleResolve)
+			r.Get("/services/{id}/capabilities", discoveryHandler.HandleGetCapabilities)
+			r.Get("/system/health", systemHandler.HandleGetHealth)
+			r.Get("/events/subscriptions", eventsHandler.HandleGetSubscriptions)
+			r.Get("/kv", kvHandler.HandleList)
+			r.Get("/kv/*", kvHandler.HandleGet)
+			r.Get("/cluster/state", clusterHandler.HandleGetState)
+			r.Get("/controlplane/status", controlPlaneHandler.HandleGetStatus)
+			r.Get("/controlplane/state", controlPlaneHandler.HandleGetState)
+			r.Get("/locks", controlPlaneHandler.HandleListLocks)
+			r.Get("/locks/{name}", controlPlaneHandler.HandleGetLock)
+		})
+
+		r.Group(func(r chi.Router) {
+			// Nodes install and remove services when they drain
+			r.Use(authenticator.Require(auth.RoleDeployer, auth.RoleNode))
+			r.Post("/services", handler.HandleInstallMicroservice)
+			r.Delete("/services/{id}", handler.HandleRemoveMicroservice)
+			r.Post("/services/{id}:start", handler.HandleStartMicroservice)
+			r.Post("/services/{id}:stop", handler.HandleStopMicroservice)
+			r.Put("/kv/*", kvHandler.HandlePut)
+			r.Delete("/kv/*", kvHandler.HandleDelete)
+			r.Put("/controlplane/desired", controlPlaneHandler.HandleSetDesired)
+			r.Post("/controlplane/schedule", controlPlaneHandler.HandleSchedule)
+			r.Post("/locks/{name}/acquire", controlPlaneHandler.HandleAcquireLock)
+			r.Post("/locks/{name}/renew", controlPlaneHandler.HandleRenewLock)
+			r.Post("/locks/{name}/release", controlPlaneHandler.HandleReleaseLock)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(authenticator.Require(auth.RoleAdmin))
+			r.Post("/cluster/join", clusterHandler.HandleJoin)
+			r.Post("/cluster/nodes/{node}/cordon", nodeHandler.HandleCordon)
+			r.Post("/cluster/nodes/{node}/uncordon", nodeHandler.HandleUncordon)
+			r.Post("/cluster/nodes/{node}/drain", nodeHandler.HandleDrain)
+		})
+
+		r.Group(func(r chi.Router) {
+			// Nodes repeat key changes on the others
+			r.Use(authenticator.Require(auth.RoleAdmin, auth.RoleNode))
+			// Keys are secrets even to read
+			r.Get("/cluster/keys", clusterHandler.HandleListKeys)
+			r.Post("/cluster/keys/install", clusterHandler.HandleInstallKey)
+			r.Post("/cluster/keys/use", clusterHandler.HandleUseKey)
+			r.Post("/cluster/keys/remove", clusterHandler.HandleRemoveKey)
+		})
+	})
 
 	// Create and start health checker
 	checker := microservice.NewHealthChecker(services)
@@ -72,20 +273,221 @@ func main() {
 	defer cancel()
 
 	go checker.Start(ctx)
+	go elector.Start(ctx)
+	go watchDependencies(list, services)
+	go joiner.Start(ctx)
+	go list.PurgeTombstones(ctx)
+	go bus.Run(ctx.Done())
+	go forwarder.Run(ctx.Done())
+
+	// Node gRPC API on GRPC_PORT, where callers authenticate like on the HTTP
+	// API. Services on this node use the Unix socket, which only the node's
+	// user can reach.
+	newGRPCServer := func(opts ...grpc.ServerOption) *grpc.Server {
+		server := grpc.NewServer(append(grpcRouter.ServerOptions(), opts...)...)
+		api.RegisterDiscoveryServer(server, discovery.NewGRPCServer(resolver))
+		api.RegisterDependenciesServer(server, microservice.NewDependencyServer(services))
+		api.RegisterEventsServer(server, events.NewGRPCServer(bus))
+		api.RegisterKVServer(server, kv.NewGRPCServer(kvStore))
+		api.RegisterLocksServer(server, locksServer)
+		return server
+	}
+	go serveGRPC(newGRPCServer(
+		grpc.UnaryInterceptor(authenticator.UnaryInterceptor()),
+		grpc.StreamInterceptor(authenticator.StreamInterceptor()),
+	), "tcp", "0.0.0.0:"+grpcPort)
+	go serveGRPC(newGRPCServer(), "unix", nodeSocket)
+
+	// Optional DNS interface to discovery, e.g. greeting.service.gonolith
+	if dnsAddr := os.Getenv("DNS_ADDR"); dnsAddr != "" {
+		dnsDomain := os.Getenv("DNS_DOMAIN")
+		if dnsDomain == "" {
+			dnsDomain = "gonolith"
+		}
+		discovery.NewDNSServer(resolver, dnsAddr, dnsDomain).Start()
+	}
 
 	http.ListenAndServe("0.0.0.0:"+httpPort, r)
 }
 
-func joinClusterWithRetry(list *memberlist.Memberlist, members []string, retries int, delay time.Duration) error {
-	var lastErr error
-	for i := 0; i < retries; i++ {
-		_, err := list.Join(members)
-		if err == nil {
-			return nil
+func serveGRPC(server *grpc.Server, network, addr string) {
+	if network == "unix" {
+		// Left behind if the node did not shut down cleanly
+		os.Remove(addr)
+	}
+	lis, err := net.Listen(network, addr)
+	if err != nil {
+		panic("Failed to listen for gRPC on " + addr + ": " + err.Error())
+	}
+	if err := server.Serve(lis); err != nil {
+		slog.Error("gRPC server stopped", "addr", addr, "error", err)
+	}
+}
+
+// Start services waiting for dependencies and tell services about changes
+// of their dependencies as soon as the cluster changes
+func watchDependencies(list *cluster.Cluster, services *microservice.Microservices) {
+	changes, stop := list.Watch()
+	defer stop()
+	for range changes {
+		services.StartWaiting()
+		services.NotifyDependents()
+	}
+}
+
+// SOCKET_DIR, or a directory per node under the system temp directory. Paths
+// are absolute since services run in their own directories.
+func newSocketDir(nodeName string) (string, error) {
+	dir := os.Getenv("SOCKET_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "gonolith-"+nodeName)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// Authenticator with the tokens of AUTH_TOKENS_FILE and NODE_TOKEN, and the
+// token this node uses to call others
+func newAuthenticator() (*auth.Authenticator, string, error) {
+	authenticator := auth.NewAuthenticator()
+	if path := os.Getenv("AUTH_TOKENS_FILE"); path != "" {
+		if err := authenticator.LoadTokens(path); err != nil {
+			return nil, "", err
+		}
+	}
+	nodeToken := os.Getenv("NODE_TOKEN")
+	if nodeToken != "" {
+		if err := authenticator.AddToken("node", auth.RoleNode, nodeToken); err != nil {
+			return nil, "", err
 		}
-		lastErr = err
-		slog.Warn("Failed to join cluster, retrying...", "attempt", i+1, "error", err)
-		time.Sleep(delay)
 	}
-	return fmt.Errorf("failed to join cluster after %d attempts: %v", retries, lastErr)
+
+	// Audit entries are JSON lines in AUDIT_LOG, or part of the node's log
+	if path := os.Getenv("AUDIT_LOG"); path != "" {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, "", err
+		}
+		authenticator.SetAuditLog(slog.New(slog.NewJSONHandler(file, nil)))
+	}
+
+	switch {
+	case !authenticator.Enabled():
+		slog.Warn("API authentication is disabled, anyone reaching HTTP_PORT can run services. Set AUTH_TOKENS_FILE.")
+	case nodeToken == "":
+		slog.Warn("NODE_TOKEN is not set, nodes cannot call each other's API for drains, key rotation, events, locks and routed calls")
+	}
+	return authenticator, nodeToken, nil
+}
+
+func newControlPlane(nodeName string, raftServers string) (*controlplane.Store, []string, error) {
+	servers, err := controlplane.ParseServers(raftServers)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Nodes that are not servers still use gossip and forward to the servers
+	if _, isServer := servers[nodeName]; !isServer {
+		slog.Info("Not a control plane server", "node", nodeName)
+		return nil, names, nil
+	}
+
+	bindAddr := os.Getenv("RAFT_ADDR")
+	if bindAddr == "" {
+		bindAddr = ":7000"
+	}
+
+	dataDir := os.Getenv("RAFT_DIR")
+	if dataDir == "" {
+		dataDir = filepath.Join(os.TempDir(), "gonolith-raft-"+nodeName)
+	}
+
+	store, err := controlplane.NewStore(controlplane.Config{
+		NodeName: nodeName,
+		BindAddr: bindAddr,
+		Servers:  servers,
+		DataDir:  dataDir,
+	})
+	return store, names, err
+}
+
+// gonolith plan|apply -f gonolith.toml -node localhost:8080
+func runDeploy(command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	manifestPath := flags.String("f", "gonolith.toml", "cluster manifest")
+	nodeAddr := flags.String("node", "localhost:8080", "HTTP address of any node in the cluster")
+	token := flags.String("token", os.Getenv("GONOLITH_TOKEN"), "API token, GONOLITH_TOKEN by default")
+	flags.Parse(args)
+
+	m, err := manifest.Load(*manifestPath)
+	if err != nil {
+		return err
+	}
+
+	client := deploy.NewClient()
+	client.SetToken(*token)
+	state, err := client.ClusterState(*nodeAddr)
+	if err != nil {
+		return fmt.Errorf("cannot read cluster state from %s: %w", *nodeAddr, err)
+	}
+	client.TrustNodes(state)
+
+	// Scheduling decisions go through the control plane when the cluster has one
+	var scheduled *controlplane.State
+	status, err := client.ControlPlaneStatus(*nodeAddr)
+	if err != nil {
+		return fmt.Errorf("cannot read control plane status from %s: %w", *nodeAddr, err)
+	}
+	if status.Enabled {
+		cpState, err := client.ControlPlaneState(*nodeAddr)
+		if err != nil {
+			return fmt.Errorf("cannot read control plane state from %s: %w", *nodeAddr, err)
+		}
+		scheduled = &cpState
+	}
+
+	plan, err := deploy.NewPlan(m, state, scheduled)
+	if err != nil {
+		return err
+	}
+
+	if command == "plan" {
+		plan.Print(os.Stdout)
+		return nil
+	}
+	return deploy.Apply(client, plan, *nodeAddr, os.Stdout)
+}
+
+// gonolith cordon|uncordon|drain -node localhost:8080 gonolith2
+func runNodeOperation(operation string, args []string) error {
+	flags := flag.NewFlagSet(operation, flag.ExitOnError)
+	nodeAddr := flags.String("node", "localhost:8080", "HTTP address of any node in the cluster")
+	token := flags.String("token", os.Getenv("GONOLITH_TOKEN"), "API token, GONOLITH_TOKEN by default")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: gonolith %s [-node addr] [-token token] <node name>", operation)
+	}
+
+	client := deploy.NewClient()
+	client.SetToken(*token)
+	// The node the operation is for may be another than the one asked
+	state, err := client.ClusterState(*nodeAddr)
+	if err != nil {
+		return fmt.Errorf("cannot read cluster state from %s: %w", *nodeAddr, err)
+	}
+	client.TrustNodes(state)
+	out, err := client.NodeOperation(*nodeAddr, flags.Arg(0), operation)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(out)
+	return nil
 }
@@ -0,0 +1,222 @@
+// Package auth guards the HTTP and gRPC APIs of a node. Callers present an
+// API token as a bearer token, each token has a role, and every route requires
+// a minimum role. Nodes call each other with a token of their own that no
+// operator token shares and that only works where nodes need it. Denied
+// requests and granted changes go to the audit log.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/noahdw/Gonolith/internal/httpapi"
+	"github.com/pelletier/go-toml/v2"
+)
+
+type Role string
+
+// Every operator role may do what the roles before it may do
+const (
+	// Read the state of services, the cluster and its stores
+	RoleViewer Role = "viewer"
+	// Install, start, stop and remove services and write to the stores
+	RoleDeployer Role = "deployer"
+	// Change the cluster, e.g. drain nodes and rotate gossip keys
+	RoleAdmin Role = "admin"
+	// Other nodes, acting on behalf of an operator. Not ranked with the
+	// others, it is only let through where a route allows it explicitly.
+	RoleNode Role = "node"
+)
+
+var ranks = map[Role]int{
+	RoleViewer:   1,
+	RoleDeployer: 2,
+	RoleAdmin:    3,
+}
+
+// Whether a caller with role may do what required, or one of also, allows
+func allowed(role, required Role, also []Role) bool {
+	if role == required || slices.Contains(also, role) {
+		return true
+	}
+	rank, ranked := ranks[role]
+	need, needRanked := ranks[required]
+	return ranked && needRanked && rank >= need
+}
+
+// Tokens shorter than this are rejected, they are too easy to guess
+const MinTokenLength = 16
+
+// Error codes of requests that are turned away
+const (
+	CodeUnauthenticated = "unauthenticated"
+	CodeForbidden       = "forbidden"
+)
+
+// Who made a request
+type Identity struct {
+	Name string
+	Role Role
+}
+
+type identityKey struct{}
+
+// Identity of the caller of a request that passed Authenticate
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// Entry of a tokens file:
+//
+//	[[token]]
+//	name = "ci"
+//	role = "deployer"
+//	token = "..."
+type tokenConfig struct {
+	Name  string `toml:"name"`
+	Role  Role   `toml:"role"`
+	Token string `toml:"token"`
+}
+
+type tokensFile struct {
+	Tokens []tokenConfig `toml:"token"`
+}
+
+type Authenticator struct {
+	// By the SHA-256 of the token, so lookups do not compare secrets
+	tokens map[[sha256.Size]byte]Identity
+	audit  *slog.Logger
+}
+
+func NewAuthenticator() *Authenticator {
+	return &Authenticator{
+		tokens: make(map[[sha256.Size]byte]Identity),
+		audit:  slog.Default().With("audit", true),
+	}
+}
+
+// Where denied requests and granted changes are logged
+func (a *Authenticator) SetAuditLog(logger *slog.Logger) {
+	a.audit = logger
+}
+
+// Without any token every request is let through, as before auth existed
+func (a *Authenticator) Enabled() bool {
+	return len(a.tokens) > 0
+}
+
+func (a *Authenticator) AddToken(name string, role Role, token string) error {
+	if _, known := ranks[role]; !known && role != RoleNode {
+		return fmt.Errorf("token %s has unknown role %q", name, role)
+	}
+	if len(token) < MinTokenLength {
+		return fmt.Errorf("token %s is shorter than %d characters", name, MinTokenLength)
+	}
+	sum := sha256.Sum256([]byte(token))
+	if _, taken := a.tokens[sum]; taken {
+		return fmt.Errorf("token %s is already used by another name", name)
+	}
+	a.tokens[sum] = Identity{Name: name, Role: role}
+	return nil
+}
+
+// Add the tokens of a TOML file with [[token]] entries
+func (a *Authenticator) LoadTokens(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file tokensFile
+	if err := toml.Unmarshal(raw, &file); err != nil {
+		return fmt.Errorf("invalid tokens file %s: %w", path, err)
+	}
+	for _, token := range file.Tokens {
+		if token.Role == RoleNode {
+			return fmt.Errorf("token %s: node tokens are set with NODE_TOKEN", token.Name)
+		}
+		if err := a.AddToken(token.Name, token.Role, token.Token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Middleware that identifies the caller by its bearer token. Requests
+// without a valid token are rejected with 401.
+func (a *Authenticator) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		identity, reason, ok := a.identify(r.Header.Get("Authorization"))
+		if !ok {
+			a.deny(w, r, http.StatusUnauthorized, CodeUnauthenticated, Identity{}, reason)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
+
+// Caller with the bearer token of an Authorization value, or why there is
+// none
+func (a *Authenticator) identify(authorization string) (Identity, string, bool) {
+	token, found := strings.CutPrefix(authorization, "Bearer ")
+	if !found || token == "" {
+		return Identity{}, "missing bearer token", false
+	}
+	identity, known := a.tokens[sha256.Sum256([]byte(token))]
+	if !known {
+		return Identity{}, "unknown token", false
+	}
+	return identity, "", true
+}
+
+// Middleware that lets only callers with at least role, or one of the roles
+// in also, e.g. RoleNode, through, behind Authenticate
+func (a *Authenticator) Require(role Role, also ...Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !a.Enabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			identity, _ := IdentityFrom(r.Context())
+			if !allowed(identity.Role, role, also) {
+				a.deny(w, r, http.StatusForbidden, CodeForbidden, identity, "requires role "+string(role))
+				return
+			}
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				a.audit.Info("Access granted", requestAttrs(r, identity)...)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (a *Authenticator) deny(w http.ResponseWriter, r *http.Request, status int, code string, identity Identity, reason string) {
+	a.audit.Warn("Access denied", append(requestAttrs(r, identity), "reason", reason)...)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	httpapi.WriteError(w, status, code, reason)
+}
+
+func requestAttrs(r *http.Request, identity Identity) []any {
+	return []any{
+		"method", r.Method,
+		"path", r.URL.Path,
+		"remote", r.RemoteAddr,
+		"identity", identity.Name,
+		"role", identity.Role,
+	}
+}
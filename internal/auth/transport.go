@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Transport adds a bearer token to every request. net/http drops the token
+// when it follows a redirect to another host, Transport only adds it back
+// when the host is one it was told to trust, e.g. another node of the
+// cluster.
+type Transport struct {
+	token string
+	base  http.RoundTripper
+
+	mu      sync.Mutex
+	trusted map[string]bool
+}
+
+// A nil base uses http.DefaultTransport
+func NewTransport(token string, base http.RoundTripper) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{
+		token:   token,
+		base:    base,
+		trusted: make(map[string]bool),
+	}
+}
+
+// Hosts, as host:port, that redirects may take the token to
+func (t *Transport) Trust(hosts ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, host := range hosts {
+		t.trusted[host] = true
+	}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.token == "" || req.Header.Get("Authorization") != "" || !t.mayCarry(req) {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(req)
+}
+
+// Whether the token may go along with req: always on the request the caller
+// made, on a redirect only when it stays on that host or goes to a trusted one
+func (t *Transport) mayCarry(req *http.Request) bool {
+	first := req
+	for first.Response != nil && first.Response.Request != nil {
+		first = first.Response.Request
+	}
+	if req.URL.Host == first.URL.Host {
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.trusted[req.URL.Host]
+}
@@ -0,0 +1,518 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/noahdw/Gonolith/internal/kv"
+	"github.com/noahdw/Gonolith/internal/microservice"
+)
+
+type Config struct {
+	NodeName   string
+	BindPort   int
+	HTTPPort   string
+	GRPCPort   string
+	PushPull   time.Duration
+	LocalState func() []microservice.MicroserviceStatusAPI
+	// Optional, enables gossip encryption with the keys in this file
+	KeyringFile string
+	// Optional, replicated with the other nodes
+	KV *kv.Store
+}
+
+// What every node knows about every other node. Built from memberlist
+// membership, the node metadata and the push/pull state exchange.
+type NodeState struct {
+	Name     string                               `json:"name"`
+	Addr     string                               `json:"addr"`
+	HTTPAddr string                               `json:"http_addr"`
+	GRPCAddr string                               `json:"grpc_addr"`
+	Local    bool                                 `json:"local"`
+	Cordoned bool                                 `json:"cordoned"`
+	Services []microservice.MicroserviceStatusAPI `json:"services"`
+}
+
+type ClusterStateAPI struct {
+	Nodes []NodeState `json:"nodes"`
+}
+
+// Kept small since memberlist limits node metadata to 512 bytes
+type nodeMeta struct {
+	HTTPPort string `json:"http"`
+	GRPCPort string `json:"grpc"`
+	Cordoned bool   `json:"cordoned,omitempty"`
+}
+
+type Cluster struct {
+	list     *memberlist.Memberlist
+	delegate *delegate
+
+	keyring     *memberlist.Keyring
+	keyringFile string
+	keyringMu   sync.Mutex
+	rejections  *rejectionLog
+}
+
+func NewCluster(cfg Config) (*Cluster, error) {
+	d := &delegate{
+		name:       cfg.NodeName,
+		meta:       nodeMeta{HTTPPort: cfg.HTTPPort, GRPCPort: cfg.GRPCPort},
+		localState: cfg.LocalState,
+		kv:         cfg.KV,
+		remote:     make(map[string][]microservice.MicroserviceStatusAPI),
+		watchers:   make(map[chan struct{}]struct{}),
+	}
+
+	config := memberlist.DefaultLocalConfig()
+	config.Name = cfg.NodeName
+	config.BindPort = cfg.BindPort
+	config.AdvertisePort = cfg.BindPort
+	config.Delegate = d
+	config.Events = d
+	if cfg.PushPull > 0 {
+		config.PushPullInterval = cfg.PushPull
+	}
+
+	rejections := newRejectionLog(os.Stderr)
+	config.LogOutput = rejections
+
+	if cfg.KeyringFile != "" {
+		// Rotated keys are saved back here, whatever the working directory
+		// is by then
+		keyringFile, err := filepath.Abs(cfg.KeyringFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.KeyringFile = keyringFile
+
+		keyring, err := LoadKeyring(cfg.KeyringFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Keyring = keyring
+		slog.Info("Gossip encryption enabled", "keys", len(keyring.GetKeys()))
+	} else {
+		slog.Warn("Gossip encryption disabled, set GOSSIP_KEYRING_FILE to enable it")
+	}
+
+	list, err := memberlist.Create(config)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cluster{
+		list:        list,
+		delegate:    d,
+		keyring:     config.Keyring,
+		keyringFile: cfg.KeyringFile,
+		rejections:  rejections,
+	}
+	d.send = c.sendTo
+	return c, nil
+}
+
+func (c *Cluster) Join(members []string) (int, error) {
+	return c.list.Join(members)
+}
+
+func (c *Cluster) LocalName() string {
+	return c.list.LocalNode().Name
+}
+
+// Gossip address other nodes join this one at
+func (c *Cluster) Addr() string {
+	node := c.list.LocalNode()
+	return net.JoinHostPort(node.Addr.String(), strconv.Itoa(int(node.Port)))
+}
+
+// Leave the cluster and stop gossiping
+func (c *Cluster) Shutdown() error {
+	if err := c.list.Leave(5 * time.Second); err != nil {
+		slog.Warn("Cannot announce leaving the cluster", "error", err)
+	}
+	return c.list.Shutdown()
+}
+
+// Current view of the cluster, sorted by node name. Our own services are read
+// directly so the local entry is never stale.
+func (c *Cluster) State() ClusterStateAPI {
+	local := c.list.LocalNode().Name
+	members := c.list.Members()
+	nodes := make([]NodeState, 0, len(members))
+
+	for _, member := range members {
+		var meta nodeMeta
+		if err := json.Unmarshal(member.Meta, &meta); err != nil {
+			slog.Warn("Ignoring node with bad metadata", "node", member.Name, "error", err)
+			continue
+		}
+
+		node := NodeState{
+			Name:     member.Name,
+			Addr:     member.Addr.String(),
+			HTTPAddr: addrFor(member.Addr, meta.HTTPPort),
+			GRPCAddr: addrFor(member.Addr, meta.GRPCPort),
+			Local:    member.Name == local,
+			Cordoned: meta.Cordoned,
+		}
+		if node.Local {
+			node.Services = c.delegate.localState()
+		} else {
+			node.Services = c.delegate.remoteServices(member.Name)
+		}
+		if node.Services == nil {
+			node.Services = []microservice.MicroserviceStatusAPI{}
+		}
+		nodes = append(nodes, node)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+	return ClusterStateAPI{Nodes: nodes}
+}
+
+// Cordoned nodes keep running what they have but are not given new services.
+// The flag travels with the node metadata so every node sees it.
+func (c *Cluster) SetCordoned(cordoned bool) error {
+	c.delegate.mu.Lock()
+	c.delegate.meta.Cordoned = cordoned
+	c.delegate.mu.Unlock()
+
+	slog.Info("Cordon state changed", "node", c.LocalName(), "cordoned", cordoned)
+	return c.list.UpdateNode(5 * time.Second)
+}
+
+func (c *Cluster) Cordoned() bool {
+	c.delegate.mu.RLock()
+	defer c.delegate.mu.RUnlock()
+	return c.delegate.meta.Cordoned
+}
+
+// Push our service list to every member now rather than at the next push/pull
+// sync, so changes such as a failed health check spread quickly
+func (c *Cluster) BroadcastState() {
+	c.delegate.notify()
+
+	// The key/value store has its own messages
+	state := c.delegate.encodeState(false)
+	if state == nil {
+		return
+	}
+	c.sendAll(append([]byte{msgState}, state...))
+}
+
+// Push a key/value write to every member now, the push/pull sync repairs
+// whatever gets lost
+func (c *Cluster) BroadcastKV(entry kv.Entry) {
+	raw, err := json.Marshal([]kv.Entry{entry})
+	if err != nil {
+		slog.Error("Cannot encode key/value entry", "error", err)
+		return
+	}
+	c.sendAll(append([]byte{msgKV}, raw...))
+}
+
+func (c *Cluster) sendTo(node string, msg []byte) error {
+	for _, member := range c.list.Members() {
+		if member.Name == node {
+			return c.list.SendReliable(member, msg)
+		}
+	}
+	return fmt.Errorf("node %s is not a member", node)
+}
+
+// How often key/value deletes every member has synced with are dropped
+const tombstonePurgeInterval = time.Minute
+
+// Drop key/value tombstones every other member has seen, until ctx is done
+func (c *Cluster) PurgeTombstones(ctx context.Context) {
+	if c.delegate.kv == nil {
+		return
+	}
+	ticker := time.NewTicker(tombstonePurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		local := c.list.LocalNode().Name
+		var peers []string
+		for _, member := range c.list.Members() {
+			if member.Name != local {
+				peers = append(peers, member.Name)
+			}
+		}
+		if purged := c.delegate.kv.PurgeTombstones(peers); purged > 0 {
+			slog.Info("Purged deleted keys", "count", purged)
+		}
+	}
+}
+
+func (c *Cluster) sendAll(msg []byte) {
+	local := c.list.LocalNode().Name
+	for _, member := range c.list.Members() {
+		if member.Name == local {
+			continue
+		}
+		if err := c.list.SendReliable(member, msg); err != nil {
+			slog.Warn("Cannot send state", "node", member.Name, "error", err)
+		}
+	}
+}
+
+// Watch signals on the returned channel whenever the cluster state may have
+// changed. Call the returned func to stop watching.
+func (c *Cluster) Watch() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	c.delegate.mu.Lock()
+	c.delegate.watchers[ch] = struct{}{}
+	c.delegate.mu.Unlock()
+
+	return ch, func() {
+		c.delegate.mu.Lock()
+		delete(c.delegate.watchers, ch)
+		c.delegate.mu.Unlock()
+	}
+}
+
+func (c *Cluster) HTTPAddr(node string) (string, bool) {
+	for _, member := range c.list.Members() {
+		if member.Name != node {
+			continue
+		}
+		var meta nodeMeta
+		if err := json.Unmarshal(member.Meta, &meta); err != nil || meta.HTTPPort == "" {
+			return "", false
+		}
+		return addrFor(member.Addr, meta.HTTPPort), true
+	}
+	return "", false
+}
+
+func (c *Cluster) GRPCAddr(node string) (string, bool) {
+	for _, member := range c.list.Members() {
+		if member.Name != node {
+			continue
+		}
+		var meta nodeMeta
+		if err := json.Unmarshal(member.Meta, &meta); err != nil || meta.GRPCPort == "" {
+			return "", false
+		}
+		return addrFor(member.Addr, meta.GRPCPort), true
+	}
+	return "", false
+}
+
+func addrFor(ip net.IP, port string) string {
+	if port == "" {
+		return ""
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
+
+type pushPullState struct {
+	Node     string                               `json:"node"`
+	Services []microservice.MicroserviceStatusAPI `json:"services"`
+	// What the node holds of the key/value store, the other side sends back
+	// the entries it is missing
+	KV kv.Digest `json:"kv,omitempty"`
+}
+
+const (
+	// Largest push/pull state a node sends, well below memberlist's limit of
+	// 20MB for everything it exchanges in a push/pull sync
+	maxStateBytes = 8 * 1024 * 1024
+	// Key/value entries a node is missing are sent in messages of about
+	// this size
+	kvBatchBytes = 256 * 1024
+)
+
+// delegate hooks into memberlist so each node ships its service list during
+// the periodic push/pull sync.
+type delegate struct {
+	name       string
+	localState func() []microservice.MicroserviceStatusAPI
+	kv         *kv.Store
+	// Reliable message to another node
+	send func(node string, msg []byte) error
+
+	mu       sync.RWMutex
+	meta     nodeMeta
+	remote   map[string][]microservice.MicroserviceStatusAPI
+	watchers map[chan struct{}]struct{}
+}
+
+func (d *delegate) NodeMeta(limit int) []byte {
+	d.mu.RLock()
+	meta, err := json.Marshal(d.meta)
+	d.mu.RUnlock()
+	if err != nil {
+		panic(err)
+	}
+	if len(meta) > limit {
+		panic(fmt.Sprintf("node metadata is %d bytes, limit is %d", len(meta), limit))
+	}
+	return meta
+}
+
+// User message types, the first byte of every message
+const (
+	msgState byte = iota + 1
+	msgKV
+)
+
+func (d *delegate) NotifyMsg(msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+	switch msg[0] {
+	case msgState:
+		d.mergeState(msg[1:], false)
+	case msgKV:
+		var entries []kv.Entry
+		if err := json.Unmarshal(msg[1:], &entries); err != nil {
+			slog.Error("Cannot decode key/value entries", "error", err)
+			return
+		}
+		if d.kv != nil {
+			d.kv.Merge(entries)
+		}
+	default:
+		slog.Warn("Ignoring unknown gossip message", "type", msg[0])
+	}
+}
+
+func (d *delegate) GetBroadcasts(overhead, limit int) [][]byte {
+	return nil
+}
+
+func (d *delegate) LocalState(join bool) []byte {
+	return d.encodeState(true)
+}
+
+func (d *delegate) encodeState(withKV bool) []byte {
+	state := pushPullState{
+		Node:     d.name,
+		Services: d.localState(),
+	}
+	if withKV && d.kv != nil {
+		state.KV = d.kv.Digest()
+	}
+	raw, err := json.Marshal(state)
+	if err != nil {
+		slog.Error("Cannot encode local state", "error", err)
+		return nil
+	}
+	if len(raw) > maxStateBytes && state.KV != nil {
+		// Services still get through, keys only through their own messages
+		slog.Error("Key/value store is too large to sync, too many keys",
+			"bytes", len(raw), "limit", maxStateBytes, "keys", len(state.KV))
+		return d.encodeState(false)
+	}
+	if len(raw) > maxStateBytes {
+		slog.Error("Local state is too large to sync", "bytes", len(raw), "limit", maxStateBytes)
+		return nil
+	}
+	return raw
+}
+
+func (d *delegate) MergeRemoteState(buf []byte, join bool) {
+	d.mergeState(buf, true)
+}
+
+// Push/pull states carry a digest of the node's key/value store, the ones
+// sent on service changes none of it
+func (d *delegate) mergeState(buf []byte, withKV bool) {
+	var state pushPullState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		slog.Error("Cannot decode remote state", "error", err)
+		return
+	}
+	if state.Node == "" || state.Node == d.name {
+		return
+	}
+
+	d.mu.Lock()
+	d.remote[state.Node] = state.Services
+	d.mu.Unlock()
+	if d.kv != nil && withKV && state.KV != nil {
+		d.kv.Seen(state.Node, state.KV)
+		if missing := d.kv.Missing(state.KV); len(missing) > 0 {
+			// Not from memberlist's push/pull handler, which is waiting
+			go d.sendKV(state.Node, missing)
+		}
+	}
+	d.notify()
+}
+
+// Send key/value entries to node in batches
+func (d *delegate) sendKV(node string, entries []kv.Entry) {
+	for len(entries) > 0 {
+		size, n := 0, 0
+		for n < len(entries) && (n == 0 || size < kvBatchBytes) {
+			size += len(entries[n].Key) + len(entries[n].Value)
+			n++
+		}
+		raw, err := json.Marshal(entries[:n])
+		if err != nil {
+			slog.Error("Cannot encode key/value entries", "error", err)
+			return
+		}
+		if err := d.send(node, append([]byte{msgKV}, raw...)); err != nil {
+			slog.Warn("Cannot send key/value entries", "node", node, "error", err)
+			return
+		}
+		entries = entries[n:]
+	}
+}
+
+// Wake up every watcher without blocking, a watcher that is still busy with
+// the previous change will see this one too
+func (d *delegate) notify() {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for ch := range d.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (d *delegate) remoteServices(node string) []microservice.MicroserviceStatusAPI {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.remote[node]
+}
+
+func (d *delegate) NotifyJoin(node *memberlist.Node) {
+	slog.Info("Node joined", "node", node.Name, "addr", node.Address())
+	d.notify()
+}
+
+func (d *delegate) NotifyLeave(node *memberlist.Node) {
+	slog.Info("Node left", "node", node.Name)
+	d.mu.Lock()
+	delete(d.remote, node.Name)
+	d.mu.Unlock()
+	d.notify()
+}
+
+func (d *delegate) NotifyUpdate(node *memberlist.Node) {
+	d.notify()
+}
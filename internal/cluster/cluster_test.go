@@ -0,0 +1,61 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/noahdw/Gonolith/internal/kv"
+	"github.com/noahdw/Gonolith/internal/microservice"
+)
+
+func newTestCluster(t *testing.T, name string, store *kv.Store) *Cluster {
+	t.Helper()
+	c, err := NewCluster(Config{
+		NodeName:   name,
+		PushPull:   200 * time.Millisecond,
+		LocalState: func() []microservice.MicroserviceStatusAPI { return nil },
+		KV:         store,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Shutdown() })
+	return c
+}
+
+// Keys written before the nodes knew each other reach the other node through
+// the digests of the push/pull sync
+func TestKVSyncsByDigest(t *testing.T) {
+	storeA, storeB := kv.NewStore("a"), kv.NewStore("b")
+	if _, err := storeA.Put("from-a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storeB.Put("from-b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storeB.Put("deleted", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeB.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestCluster(t, "a", storeA)
+	b := newTestCluster(t, "b", storeB)
+	if _, err := a.Join([]string{b.Addr()}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(storeA.Entries()) != 3 || len(storeB.Entries()) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("a holds %v, b holds %v", storeA.Entries(), storeB.Entries())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, store := range []*kv.Store{storeA, storeB} {
+		if got := len(store.List("")); got != 2 {
+			t.Fatalf("%d live keys, want 2", got)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/noahdw/Gonolith/internal/auth"
+	"github.com/noahdw/Gonolith/internal/httpapi"
+)
+
+// Error code for node names that are not in the cluster
+const CodeNodeNotFound = "node_not_found"
+
+type ClusterHandler struct {
+	cluster *Cluster
+	joiner  *Joiner
+	client  *http.Client
+}
+
+func NewClusterHandler(cluster *Cluster, joiner *Joiner) *ClusterHandler {
+	return &ClusterHandler{
+		cluster: cluster,
+		joiner:  joiner,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Token the handler authenticates with when it repeats key operations on
+// the other nodes
+func (h *ClusterHandler) SetNodeToken(token string) {
+	h.client.Transport = auth.NewTransport(token, nil)
+}
+
+type joinRequest struct {
+	Seeds []string `json:"seeds"`
+}
+
+type JoinResultAPI struct {
+	Contacted int    `json:"contacted"`
+	Members   int    `json:"members"`
+	Error     string `json:"error,omitempty"`
+}
+
+type keyRequest struct {
+	Key string `json:"key"`
+}
+
+type NodeKeysResultAPI struct {
+	Node  string   `json:"node"`
+	Keys  *KeysAPI `json:"keys,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+type KeysResultAPI struct {
+	Nodes []NodeKeysResultAPI `json:"nodes"`
+	// Peers whose gossip this node could not decrypt, usually a wrong key
+	Rejected []RejectedNodeAPI `json:"rejected"`
+}
+
+func (h *ClusterHandler) HandleGetState(w http.ResponseWriter, r *http.Request) {
+	httpapi.WriteJSON(w, http.StatusOK, h.cluster.State())
+}
+
+// Seeds added here are remembered and used by the background join loop too
+func (h *ClusterHandler) HandleJoin(w http.ResponseWriter, r *http.Request) {
+	var req joinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Seeds) == 0 {
+		httpapi.WriteError(w, http.StatusBadRequest, httpapi.CodeInvalidRequest, "expected a JSON body with seeds")
+		return
+	}
+
+	contacted, err := h.joiner.AddSeeds(req.Seeds)
+	result := JoinResultAPI{
+		Contacted: contacted,
+		Members:   h.cluster.list.NumMembers(),
+	}
+	status := http.StatusOK
+	if err != nil {
+		slog.Warn("Join from API failed", "seeds", req.Seeds, "error", err)
+		result.Error = err.Error()
+		status = http.StatusBadGateway
+	}
+
+	httpapi.WriteJSON(w, status, result)
+}
+
+func (h *ClusterHandler) HandleListKeys(w http.ResponseWriter, r *http.Request) {
+	h.keyOperation(w, r, nil, func() error { return nil })
+}
+
+func (h *ClusterHandler) HandleInstallKey(w http.ResponseWriter, r *http.Request) {
+	h.changeKey(w, r, h.cluster.InstallKey)
+}
+
+func (h *ClusterHandler) HandleUseKey(w http.ResponseWriter, r *http.Request) {
+	h.changeKey(w, r, h.cluster.UseKey)
+}
+
+func (h *ClusterHandler) HandleRemoveKey(w http.ResponseWriter, r *http.Request) {
+	h.changeKey(w, r, h.cluster.RemoveKey)
+}
+
+func (h *ClusterHandler) changeKey(w http.ResponseWriter, r *http.Request, change func(string) error) {
+	var req keyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Key == "" {
+		httpapi.WriteError(w, http.StatusBadRequest, httpapi.CodeInvalidRequest, "expected a JSON body with a key")
+		return
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		httpapi.WriteError(w, http.StatusInternalServerError, httpapi.CodeInternal, err.Error())
+		return
+	}
+
+	h.keyOperation(w, r, body, func() error { return change(req.Key) })
+}
+
+// Key operations apply to the whole cluster. The node that receives the
+// request applies it locally and repeats it on every other member with
+// scope=local, then reports the outcome per node.
+func (h *ClusterHandler) keyOperation(w http.ResponseWriter, r *http.Request, body []byte, local func() error) {
+	localOnly := r.URL.Query().Get("scope") == "local"
+
+	var results []NodeKeysResultAPI
+	for _, node := range h.cluster.State().Nodes {
+		if !node.Local && localOnly {
+			continue
+		}
+
+		var result NodeKeysResultAPI
+		if node.Local {
+			result = h.localKeyResult(local)
+		} else {
+			result = h.remoteKeyResult(node, r.Method, r.URL.Path, body)
+		}
+		if result.Error != "" {
+			slog.Error("Keyring operation failed", "node", node.Name, "path", r.URL.Path, "error", result.Error)
+		}
+		results = append(results, result)
+	}
+
+	status := http.StatusOK
+	for _, result := range results {
+		if result.Error != "" {
+			status = http.StatusInternalServerError
+		}
+	}
+
+	httpapi.WriteJSON(w, status, KeysResultAPI{
+		Nodes:    results,
+		Rejected: h.cluster.RejectedNodes(),
+	})
+}
+
+func (h *ClusterHandler) localKeyResult(local func() error) NodeKeysResultAPI {
+	result := NodeKeysResultAPI{Node: h.cluster.LocalName()}
+	if err := local(); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	keys, err := h.cluster.Keys()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Keys = &keys
+	return result
+}
+
+func (h *ClusterHandler) remoteKeyResult(node NodeState, method, path string, body []byte) NodeKeysResultAPI {
+	result := NodeKeysResultAPI{Node: node.Name}
+
+	req, err := http.NewRequest(method, "http://"+node.HTTPAddr+path+"?scope=local", bytes.NewReader(body))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	var remote KeysResultAPI
+	if err := json.NewDecoder(resp.Body).Decode(&remote); err != nil || len(remote.Nodes) != 1 {
+		result.Error = fmt.Sprintf("unexpected response from %s: %s", node.Name, resp.Status)
+		return result
+	}
+	return remote.Nodes[0]
+}
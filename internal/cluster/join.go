@@ -0,0 +1,225 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JoinConfig struct {
+	// Static seeds, host:port
+	Seeds []string
+	// File with one seed per line, re-read on every attempt
+	SeedFile string
+	// DNS name to discover seeds from. Names starting with an underscore are
+	// looked up as SRV records, anything else as A/AAAA records on DefaultPort.
+	SeedDNS     string
+	DefaultPort int
+	// Delay between attempts while the node is alone, doubled up to MaxInterval
+	Interval    time.Duration
+	MaxInterval time.Duration
+}
+
+// Joiner keeps the node trying to join the cluster in the background. The node
+// runs standalone until one of the seeds answers, and tries again whenever it
+// finds itself alone.
+type Joiner struct {
+	cluster *Cluster
+	cfg     JoinConfig
+
+	mu sync.Mutex
+	// Seeds added at runtime, by normalized address
+	runtime map[string]struct{}
+}
+
+func NewJoiner(c *Cluster, cfg JoinConfig) *Joiner {
+	if cfg.Interval == 0 {
+		cfg.Interval = 3 * time.Second
+	}
+	if cfg.MaxInterval == 0 {
+		cfg.MaxInterval = time.Minute
+	}
+	return &Joiner{
+		cluster: c,
+		cfg:     cfg,
+		runtime: make(map[string]struct{}),
+	}
+}
+
+func (j *Joiner) Start(ctx context.Context) {
+	delay := j.cfg.Interval
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if j.cluster.list.NumMembers() > 1 {
+			delay = j.cfg.Interval
+		} else if _, err := j.attempt(ctx); err != nil {
+			slog.Warn("Failed to join cluster, retrying in background", "retry", delay, "error", err)
+			delay = min(delay*2, j.cfg.MaxInterval)
+		} else {
+			delay = j.cfg.Interval
+		}
+		timer.Reset(delay)
+	}
+}
+
+// Add seeds at runtime and try to join them right away. A seed that is already
+// known, however it is written, is not added again.
+func (j *Joiner) AddSeeds(seeds []string) (int, error) {
+	j.mu.Lock()
+	for _, seed := range seeds {
+		if seed = normalizeSeed(seed, j.cfg.DefaultPort); seed != "" {
+			j.runtime[seed] = struct{}{}
+		}
+	}
+	j.mu.Unlock()
+
+	return j.cluster.Join(seeds)
+}
+
+func (j *Joiner) attempt(ctx context.Context) (int, error) {
+	seeds := j.Seeds(ctx)
+	if len(seeds) == 0 {
+		return 0, fmt.Errorf("no seeds configured")
+	}
+
+	joined, err := j.cluster.Join(seeds)
+	if err != nil {
+		return joined, err
+	}
+	slog.Info("Joined cluster", "contacted", joined)
+	return joined, nil
+}
+
+// Every seed we currently know about, from all sources, without ourselves
+func (j *Joiner) Seeds(ctx context.Context) []string {
+	var seeds []string
+	seeds = append(seeds, j.cfg.Seeds...)
+
+	j.mu.Lock()
+	runtime := make([]string, 0, len(j.runtime))
+	for seed := range j.runtime {
+		runtime = append(runtime, seed)
+	}
+	j.mu.Unlock()
+	sort.Strings(runtime)
+	seeds = append(seeds, runtime...)
+
+	if j.cfg.SeedFile != "" {
+		fromFile, err := readSeedFile(j.cfg.SeedFile)
+		if err != nil {
+			slog.Warn("Cannot read seed file", "file", j.cfg.SeedFile, "error", err)
+		}
+		seeds = append(seeds, fromFile...)
+	}
+
+	if j.cfg.SeedDNS != "" {
+		fromDNS, err := lookupSeeds(ctx, j.cfg.SeedDNS, j.cfg.DefaultPort)
+		if err != nil {
+			slog.Warn("Cannot discover seeds", "name", j.cfg.SeedDNS, "error", err)
+		}
+		seeds = append(seeds, fromDNS...)
+	}
+
+	self := normalizeSeed(j.cluster.list.LocalNode().Address(), j.cfg.DefaultPort)
+	seen := make(map[string]bool)
+	unique := seeds[:0]
+	for _, seed := range seeds {
+		seed = normalizeSeed(seed, j.cfg.DefaultPort)
+		if seed == "" || seed == self || seen[seed] {
+			continue
+		}
+		seen[seed] = true
+		unique = append(unique, seed)
+	}
+	return unique
+}
+
+// Write a seed the same way however it was given: host in lower case, IPs in
+// their canonical form and the default port when there is none, so
+// "Node-1", "node-1:7946" and " node-1 " are one seed
+func normalizeSeed(seed string, defaultPort int) string {
+	seed = strings.TrimSpace(seed)
+	if seed == "" {
+		return ""
+	}
+
+	host, port, err := net.SplitHostPort(seed)
+	if err != nil {
+		// No port, IPv6 addresses may still be bracketed
+		host, port = strings.Trim(seed, "[]"), ""
+		if defaultPort > 0 {
+			port = strconv.Itoa(defaultPort)
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else {
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+	}
+	if port == "" {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func readSeedFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var seeds []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		seeds = append(seeds, line)
+	}
+	return seeds, scanner.Err()
+}
+
+func lookupSeeds(ctx context.Context, name string, defaultPort int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var seeds []string
+	if strings.HasPrefix(name, "_") {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			seeds = append(seeds, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+		}
+		return seeds, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		seeds = append(seeds, net.JoinHostPort(addr, strconv.Itoa(defaultPort)))
+	}
+	return seeds, nil
+}
@@ -0,0 +1,46 @@
+package cluster
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/noahdw/Gonolith/internal/kv"
+)
+
+func TestNormalizeSeed(t *testing.T) {
+	tests := []struct {
+		seed string
+		want string
+	}{
+		{seed: "node-1:7946", want: "node-1:7946"},
+		{seed: " Node-1 ", want: "node-1:7946"},
+		{seed: "node-1.example.com.:8000", want: "node-1.example.com:8000"},
+		{seed: "10.0.0.1", want: "10.0.0.1:7946"},
+		{seed: "[::1]:8000", want: "[::1]:8000"},
+		{seed: "::1", want: "[::1]:7946"},
+		{seed: "[0:0::1]", want: "[::1]:7946"},
+		{seed: "  ", want: ""},
+	}
+
+	for _, test := range tests {
+		if got := normalizeSeed(test.seed, 7946); got != test.want {
+			t.Errorf("normalizeSeed(%q) = %q, want %q", test.seed, got, test.want)
+		}
+	}
+}
+
+// Seeds added again, however they are written, are only kept once
+func TestAddSeedsDedupes(t *testing.T) {
+	c := newTestCluster(t, "a", kv.NewStore("a"))
+	joiner := NewJoiner(c, JoinConfig{Seeds: []string{"127.0.0.1:1"}, DefaultPort: 1})
+
+	// Nothing listens on port 1, the joins fail but the seeds are kept
+	joiner.AddSeeds([]string{"127.0.0.1:1", " 127.0.0.1 ", "127.0.0.2:1"})
+	joiner.AddSeeds([]string{"127.0.0.2", c.Addr()})
+
+	want := []string{"127.0.0.1:1", "127.0.0.2:1"}
+	if got := joiner.Seeds(context.Background()); !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
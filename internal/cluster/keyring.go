@@ -0,0 +1,274 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// The keyring file is a JSON list of base64 keys, the first one is used to
+// encrypt outgoing gossip:
+//
+//	["pUqJrVyVRj5jsiYEkM/tFQYfWyJIv4s3XkvDwy7Cu5s=", "..."]
+func LoadKeyring(path string) (*memberlist.Keyring, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var encoded []string
+	if err := json.Unmarshal(raw, &encoded); err != nil {
+		return nil, fmt.Errorf("invalid keyring file %s: %w", path, err)
+	}
+	if len(encoded) == 0 {
+		return nil, fmt.Errorf("keyring file %s has no keys", path)
+	}
+
+	keys := make([][]byte, 0, len(encoded))
+	for _, key := range encoded {
+		decoded, err := decodeKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keyring file %s: %w", path, err)
+		}
+		keys = append(keys, decoded)
+	}
+
+	return memberlist.NewKeyring(keys, keys[0])
+}
+
+func GenerateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func decodeKey(key string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, fmt.Errorf("key is not base64: %w", err)
+	}
+	switch len(decoded) {
+	case 16, 24, 32:
+		return decoded, nil
+	default:
+		return nil, fmt.Errorf("key must be 16, 24 or 32 bytes, got %d", len(decoded))
+	}
+}
+
+// Keys are listed by fingerprint, key material never leaves the node
+type KeysAPI struct {
+	Node    string   `json:"node"`
+	Primary string   `json:"primary"`
+	Keys    []string `json:"keys"`
+}
+
+type RejectedNodeAPI struct {
+	Addr     string    `json:"addr"`
+	Reason   string    `json:"reason"`
+	LastSeen time.Time `json:"last_seen"`
+	Count    int       `json:"count"`
+}
+
+func (c *Cluster) encryptionEnabled() bool {
+	return c.keyring != nil
+}
+
+func (c *Cluster) Keys() (KeysAPI, error) {
+	if !c.encryptionEnabled() {
+		return KeysAPI{}, fmt.Errorf("gossip encryption is not enabled on %s", c.LocalName())
+	}
+
+	keys := KeysAPI{
+		Node:    c.LocalName(),
+		Primary: Fingerprint(c.keyring.GetPrimaryKey()),
+	}
+	for _, key := range c.keyring.GetKeys() {
+		keys.Keys = append(keys.Keys, Fingerprint(key))
+	}
+	return keys, nil
+}
+
+// Identifies a key without revealing it: the first 8 bytes of its SHA-256,
+// in hex
+func Fingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Add a key that can decrypt gossip, it is not used for encryption until UseKey
+func (c *Cluster) InstallKey(key string) error {
+	return c.changeKeyring(key, c.keyring.AddKey)
+}
+
+// Start encrypting with a key that was installed before
+func (c *Cluster) UseKey(key string) error {
+	return c.changeKeyring(key, c.keyring.UseKey)
+}
+
+// Drop a key, the primary key cannot be removed
+func (c *Cluster) RemoveKey(key string) error {
+	return c.changeKeyring(key, c.keyring.RemoveKey)
+}
+
+func (c *Cluster) changeKeyring(key string, change func([]byte) error) error {
+	if !c.encryptionEnabled() {
+		return fmt.Errorf("gossip encryption is not enabled on %s", c.LocalName())
+	}
+
+	decoded, err := decodeKey(key)
+	if err != nil {
+		return err
+	}
+
+	c.keyringMu.Lock()
+	defer c.keyringMu.Unlock()
+	if err := change(decoded); err != nil {
+		return err
+	}
+	return c.saveKeyring()
+}
+
+// Persist the keyring so a restart does not bring back rotated keys
+func (c *Cluster) saveKeyring() error {
+	if c.keyringFile == "" {
+		return nil
+	}
+
+	primary := c.keyring.GetPrimaryKey()
+	encoded := []string{base64.StdEncoding.EncodeToString(primary)}
+	for _, key := range c.keyring.GetKeys() {
+		if !bytes.Equal(key, primary) {
+			encoded = append(encoded, base64.StdEncoding.EncodeToString(key))
+		}
+	}
+
+	raw, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+	tmp := c.keyringFile + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.keyringFile)
+}
+
+func (c *Cluster) RejectedNodes() []RejectedNodeAPI {
+	return c.rejections.list()
+}
+
+// What memberlist (v0.5.3, net.go) logs when a peer's gossip cannot be
+// decrypted. Packets fail in ingestPacket, streams such as push/pull in
+// handleConn through readStream. Every line ends with the peer's address.
+var rejectionMessages = []struct {
+	message string
+	reason  string
+}{
+	{"[ERR] memberlist: Decrypt packet failed: ", reasonWrongKey},
+	{"[ERR] memberlist: failed to receive: No installed keys could decrypt the message ", reasonWrongKey},
+	{"[ERR] memberlist: failed to receive: Encryption is configured but remote state is not encrypted ", reasonNotEncrypted},
+}
+
+const (
+	reasonWrongKey     = "gossip could not be decrypted with any installed key"
+	reasonNotEncrypted = "peer is not using gossip encryption"
+)
+
+var fromAddr = regexp.MustCompile(`from=(\S+)$`)
+
+// rejectionLog sits between memberlist and stderr and picks out the messages
+// memberlist writes when a peer's gossip cannot be decrypted, which is how a
+// node with the wrong key shows up. memberlist has no other hook for this, the
+// messages are matched exactly so a reworded one fails the tests rather than
+// going unnoticed.
+type rejectionLog struct {
+	out io.Writer
+
+	mu       sync.Mutex
+	rejected map[string]*RejectedNodeAPI
+}
+
+func newRejectionLog(out io.Writer) *rejectionLog {
+	return &rejectionLog{
+		out:      out,
+		rejected: make(map[string]*RejectedNodeAPI),
+	}
+}
+
+func (l *rejectionLog) Write(p []byte) (int, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(p))
+	for scanner.Scan() {
+		l.inspect(scanner.Text())
+	}
+	return l.out.Write(p)
+}
+
+func (l *rejectionLog) inspect(line string) {
+	var reason string
+	for _, rejection := range rejectionMessages {
+		if strings.Contains(line, rejection.message) {
+			reason = rejection.reason
+			break
+		}
+	}
+	if reason == "" {
+		return
+	}
+
+	// Lines from an unknown address end in "from=<unknown address>"
+	match := fromAddr.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+	addr := match[1]
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, has := l.rejected[addr]
+	if !has {
+		entry = &RejectedNodeAPI{Addr: addr}
+		l.rejected[addr] = entry
+		slog.Warn("Rejected gossip from node with the wrong key", "addr", addr, "reason", reason)
+	}
+	entry.Reason = reason
+	entry.LastSeen = time.Now()
+	entry.Count++
+}
+
+// Rejections older than this are assumed to be resolved
+const rejectionTTL = 5 * time.Minute
+
+func (l *rejectionLog) list() []RejectedNodeAPI {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rejected := make([]RejectedNodeAPI, 0, len(l.rejected))
+	for addr, entry := range l.rejected {
+		if time.Since(entry.LastSeen) > rejectionTTL {
+			delete(l.rejected, addr)
+			continue
+		}
+		rejected = append(rejected, *entry)
+	}
+	sort.Slice(rejected, func(i, j int) bool {
+		return rejected[i].Addr < rejected[j].Addr
+	})
+	return rejected
+}
@@ -0,0 +1,138 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/noahdw/Gonolith/internal/microservice"
+)
+
+// The lines are printed the way memberlist prints them, through a log.Logger
+// with the same format strings and address formatting
+func TestRejectionLog(t *testing.T) {
+	peer := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 7946}
+	tests := []struct {
+		name   string
+		format string
+		args   []any
+		// Rejection recorded for the line, empty when it is not one
+		want string
+	}{
+		{
+			name:   "packet with the wrong key",
+			format: "[ERR] memberlist: Decrypt packet failed: %v %s",
+			args:   []any{errors.New("No installed keys could decrypt the message"), memberlist.LogAddress(peer)},
+			want:   reasonWrongKey,
+		},
+		{
+			name:   "stream with the wrong key",
+			format: "[ERR] memberlist: failed to receive: %s %s",
+			args:   []any{errors.New("No installed keys could decrypt the message"), memberlist.LogAddress(peer)},
+			want:   reasonWrongKey,
+		},
+		{
+			name:   "stream without encryption",
+			format: "[ERR] memberlist: failed to receive: %s %s",
+			args:   []any{errors.New("Encryption is configured but remote state is not encrypted"), memberlist.LogAddress(peer)},
+			want:   reasonNotEncrypted,
+		},
+		{
+			name:   "unknown address",
+			format: "[ERR] memberlist: Decrypt packet failed: %v %s",
+			args:   []any{errors.New("No installed keys could decrypt the message"), memberlist.LogAddress(nil)},
+		},
+		{
+			name:   "other receive error",
+			format: "[ERR] memberlist: failed to receive: %s %s",
+			args:   []any{errors.New("Unknown stream type"), memberlist.LogAddress(peer)},
+		},
+		{
+			name:   "unrelated",
+			format: "[DEBUG] memberlist: Stream connection %s",
+			args:   []any{memberlist.LogAddress(peer)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rejections := newRejectionLog(io.Discard)
+			logger := log.New(rejections, "", log.LstdFlags)
+			logger.Printf(test.format, test.args...)
+			logger.Printf(test.format, test.args...)
+
+			got := rejections.list()
+			if test.want == "" {
+				if len(got) != 0 {
+					t.Fatalf("got %+v, want no rejections", got)
+				}
+				return
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %+v, want one rejection", got)
+			}
+			if got[0].Addr != peer.String() || got[0].Reason != test.want || got[0].Count != 2 {
+				t.Fatalf("got %+v, want %s rejected twice for %q", got[0], peer, test.want)
+			}
+		})
+	}
+}
+
+func writeKeyring(t *testing.T) string {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal([]string{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// A node joining with a different key is listed by the node it tried to join
+func TestRejectsWrongKey(t *testing.T) {
+	newNode := func(name string) *Cluster {
+		c, err := NewCluster(Config{
+			NodeName:    name,
+			KeyringFile: writeKeyring(t),
+			LocalState:  func() []microservice.MicroserviceStatusAPI { return nil },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Shutdown() })
+		return c
+	}
+	a, b := newNode("a"), newNode("b")
+
+	if _, err := a.Join([]string{b.Addr()}); err == nil {
+		t.Fatal("joined a node with another key")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(b.RejectedNodes()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("b did not list a as rejected")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// Streams come from an ephemeral port, only the host is a's
+	rejected := b.RejectedNodes()[0]
+	wantHost, _, _ := net.SplitHostPort(a.Addr())
+	if host, _, _ := net.SplitHostPort(rejected.Addr); host != wantHost || rejected.Reason != reasonWrongKey {
+		t.Fatalf("got %+v, want a rejection from %s", rejected, wantHost)
+	}
+}
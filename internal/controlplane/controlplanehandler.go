@@ -0,0 +1,149 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/noahdw/Gonolith/internal/httpapi"
+)
+
+// Error codes of the control plane endpoints
+const (
+	CodeDisabled         = "control_plane_disabled"
+	CodeScheduleConflict = "schedule_conflict"
+)
+
+type StatusAPI struct {
+	Enabled  bool     `json:"enabled"`
+	Leader   string   `json:"leader"`
+	IsLeader bool     `json:"is_leader"`
+	Servers  []string `json:"servers"`
+}
+
+type ControlPlaneHandler struct {
+	// Nil when this node does not take part in the control plane
+	store *Store
+	// Configured server nodes, requests are forwarded to them when this
+	// node is not one of them
+	servers []string
+	// Resolve a node name to its HTTP address using gossip
+	httpAddr func(node string) (string, bool)
+}
+
+func NewControlPlaneHandler(store *Store, servers []string, httpAddr func(node string) (string, bool)) *ControlPlaneHandler {
+	return &ControlPlaneHandler{
+		store:    store,
+		servers:  servers,
+		httpAddr: httpAddr,
+	}
+}
+
+func (h *ControlPlaneHandler) HandleGetStatus(w http.ResponseWriter, r *http.Request) {
+	if h.store == nil && len(h.servers) > 0 {
+		h.forwardToServer(w, r)
+		return
+	}
+
+	status := StatusAPI{}
+	if h.store != nil {
+		servers, err := h.store.Servers()
+		if err != nil {
+			slog.Error("Cannot read raft configuration", "error", err)
+		}
+		status = StatusAPI{
+			Enabled:  true,
+			Leader:   h.store.Leader(),
+			IsLeader: h.store.IsLeader(),
+			Servers:  servers,
+		}
+	}
+
+	httpapi.WriteJSON(w, http.StatusOK, status)
+}
+
+func (h *ControlPlaneHandler) HandleGetState(w http.ResponseWriter, r *http.Request) {
+	if !h.enabled(w, r) {
+		return
+	}
+
+	httpapi.WriteJSON(w, http.StatusOK, h.store.State())
+}
+
+func (h *ControlPlaneHandler) HandleSetDesired(w http.ResponseWriter, r *http.Request) {
+	if !h.enabled(w, r) {
+		return
+	}
+
+	raw, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		httpapi.WriteError(w, http.StatusBadRequest, httpapi.CodeInvalidRequest, "cannot read desired state: "+err.Error())
+		return
+	}
+
+	h.writeResult(w, r, h.store.SetDesired(raw))
+}
+
+func (h *ControlPlaneHandler) HandleSchedule(w http.ResponseWriter, r *http.Request) {
+	if !h.enabled(w, r) {
+		return
+	}
+
+	var req ScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.WriteError(w, http.StatusBadRequest, httpapi.CodeInvalidRequest, "invalid schedule request: "+err.Error())
+		return
+	}
+
+	h.writeResult(w, r, h.store.Schedule(req))
+}
+
+func (h *ControlPlaneHandler) enabled(w http.ResponseWriter, r *http.Request) bool {
+	switch {
+	case h.store != nil:
+		return true
+	case len(h.servers) > 0:
+		h.forwardToServer(w, r)
+	default:
+		httpapi.WriteError(w, http.StatusNotFound, CodeDisabled, "control plane is not enabled on this node")
+	}
+	return false
+}
+
+func (h *ControlPlaneHandler) forwardToServer(w http.ResponseWriter, r *http.Request) {
+	for _, server := range h.servers {
+		if addr, has := h.httpAddr(server); has {
+			http.Redirect(w, r, "http://"+addr+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+	}
+	httpapi.WriteError(w, http.StatusServiceUnavailable, httpapi.CodeUnavailable, "no control plane server available")
+}
+
+// Writes and lock reads only work on the leader, followers redirect the
+// caller there. Errors the caller cannot fix, e.g. raft failing to commit in
+// time, are a 503.
+func (h *ControlPlaneHandler) writeResult(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case err == nil:
+		httpapi.WriteNoContent(w)
+	case errors.Is(err, ErrNotLeader):
+		addr, has := h.httpAddr(h.store.Leader())
+		if !has {
+			httpapi.WriteError(w, http.StatusServiceUnavailable, httpapi.CodeUnavailable, "no control plane leader available")
+			return
+		}
+		http.Redirect(w, r, "http://"+addr+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	case errors.Is(err, ErrConflict):
+		httpapi.WriteError(w, http.StatusConflict, CodeScheduleConflict, err.Error())
+	case lockCode(err) != "":
+		httpapi.WriteError(w, lockStatus(err), lockCode(err), err.Error())
+	case errors.Is(err, ErrInvalid):
+		httpapi.WriteError(w, http.StatusBadRequest, httpapi.CodeInvalidRequest, err.Error())
+	default:
+		httpapi.WriteError(w, http.StatusServiceUnavailable, httpapi.CodeUnavailable, err.Error())
+	}
+}
@@ -0,0 +1,211 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/noahdw/Gonolith/internal/manifest"
+)
+
+// A scheduling decision: replica slot N of a service belongs on this node
+type Assignment struct {
+	Node    string `json:"node"`
+	Version string `json:"version"`
+	// Raft index the decision was committed at
+	Index uint64 `json:"index"`
+}
+
+// State is everything the control plane agrees on. Observed state (what is
+// actually running) stays in gossip.
+type State struct {
+	Desired      string                  `json:"desired"`
+	DesiredIndex uint64                  `json:"desired_index"`
+	Assignments  map[string][]Assignment `json:"assignments"`
+	// Held locks by name, expired ones are dropped by the next lock command
+	Locks map[string]Lock `json:"locks"`
+}
+
+type ScheduleRequest struct {
+	Service string `json:"service"`
+	Slot    int    `json:"slot"`
+	Node    string `json:"node"`
+	Version string `json:"version"`
+	// Node the caller believes currently owns the slot, empty if unassigned.
+	// The decision is rejected if someone else got there first.
+	Expected string `json:"expected"`
+}
+
+type command struct {
+	Op       string           `json:"op"`
+	Desired  string           `json:"desired,omitempty"`
+	Schedule *ScheduleRequest `json:"schedule,omitempty"`
+	Lock     *LockRequest     `json:"lock,omitempty"`
+	// Leader's clock when it proposed the command. Lock expiry is judged by
+	// it so every server reaches the same decision.
+	Now time.Time `json:"now,omitempty"`
+}
+
+const (
+	opSetDesired = "set_desired"
+	opSchedule   = "schedule"
+	opAcquire    = "acquire_lock"
+	opRenew      = "renew_lock"
+	opRelease    = "release_lock"
+)
+
+type fsm struct {
+	mu    sync.RWMutex
+	state State
+}
+
+func newFSM() *fsm {
+	return &fsm{
+		state: State{
+			Assignments: make(map[string][]Assignment),
+			Locks:       make(map[string]Lock),
+		},
+	}
+}
+
+// Apply returns an error value rather than panicking so callers can surface
+// rejected decisions, e.g. a lost compare-and-set.
+func (f *fsm) Apply(log *raft.Log) interface{} {
+	var cmd command
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		return fmt.Errorf("bad control plane command: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch cmd.Op {
+	case opSetDesired:
+		return f.setDesired(cmd.Desired, log.Index)
+	case opSchedule:
+		return f.schedule(cmd.Schedule, log.Index)
+	case opAcquire:
+		return f.acquire(cmd.Lock, cmd.Now, log.Index)
+	case opRenew:
+		return f.renew(cmd.Lock, cmd.Now)
+	case opRelease:
+		return f.release(cmd.Lock, cmd.Now)
+	default:
+		return fmt.Errorf("unknown control plane command %q", cmd.Op)
+	}
+}
+
+func (f *fsm) setDesired(raw string, index uint64) error {
+	m, err := manifest.Parse([]byte(raw))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+
+	// Forget decisions that the new desired state no longer has room for
+	replicas := make(map[string]int)
+	for _, service := range m.Services {
+		replicas[service.Name] = service.Replicas
+	}
+	for name, slots := range f.state.Assignments {
+		want, declared := replicas[name]
+		switch {
+		case !declared:
+			delete(f.state.Assignments, name)
+		case len(slots) > want:
+			f.state.Assignments[name] = slots[:want]
+		}
+	}
+
+	f.state.Desired = raw
+	f.state.DesiredIndex = index
+	return nil
+}
+
+func (f *fsm) schedule(req *ScheduleRequest, index uint64) error {
+	if req == nil || req.Service == "" || req.Node == "" {
+		return fmt.Errorf("%w: incomplete schedule request", ErrInvalid)
+	}
+
+	slots := f.state.Assignments[req.Service]
+	if req.Slot < 0 || req.Slot > len(slots) {
+		return fmt.Errorf("%w: slot %d of %s is out of range", ErrInvalid, req.Slot, req.Service)
+	}
+
+	current := ""
+	if req.Slot < len(slots) {
+		current = slots[req.Slot].Node
+	}
+	if current != req.Expected {
+		return fmt.Errorf("%w: slot %d of %s is owned by %q, expected %q",
+			ErrConflict, req.Slot, req.Service, current, req.Expected)
+	}
+
+	assignment := Assignment{Node: req.Node, Version: req.Version, Index: index}
+	if req.Slot == len(slots) {
+		slots = append(slots, assignment)
+	} else {
+		slots[req.Slot] = assignment
+	}
+	f.state.Assignments[req.Service] = slots
+	return nil
+}
+
+func (f *fsm) snapshotState() State {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	state := State{
+		Desired:      f.state.Desired,
+		DesiredIndex: f.state.DesiredIndex,
+		Assignments:  make(map[string][]Assignment, len(f.state.Assignments)),
+		Locks:        make(map[string]Lock, len(f.state.Locks)),
+	}
+	for name, slots := range f.state.Assignments {
+		state.Assignments[name] = append([]Assignment(nil), slots...)
+	}
+	for name, lock := range f.state.Locks {
+		state.Locks[name] = lock
+	}
+	return state
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return &fsmSnapshot{state: f.snapshotState()}, nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var state State
+	if err := json.NewDecoder(rc).Decode(&state); err != nil {
+		return err
+	}
+	if state.Assignments == nil {
+		state.Assignments = make(map[string][]Assignment)
+	}
+	if state.Locks == nil {
+		state.Locks = make(map[string]Lock)
+	}
+
+	f.mu.Lock()
+	f.state = state
+	f.mu.Unlock()
+	return nil
+}
+
+type fsmSnapshot struct {
+	state State
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.state); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
@@ -0,0 +1,201 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/noahdw/Gonolith/api"
+	"github.com/noahdw/Gonolith/internal/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Set on calls a server passes on to its leader, which answers them itself
+const leaderForwardHeader = "x-gonolith-to-leader"
+
+// Serves locks to the services of every node. Nodes that are not the leader
+// pass calls on: other nodes to a control plane server, servers to their
+// leader.
+type GRPCServer struct {
+	api.UnimplementedLocksServer
+	// Nil when this node does not take part in the control plane
+	store   *Store
+	servers []string
+	// Resolve a node name to its gRPC address using gossip
+	grpcAddr func(node string) (string, bool)
+	// Calls passed on to other nodes authenticate with it
+	nodeToken string
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func NewGRPCServer(store *Store, servers []string, grpcAddr func(node string) (string, bool)) *GRPCServer {
+	return &GRPCServer{
+		store:    store,
+		servers:  servers,
+		grpcAddr: grpcAddr,
+		conns:    make(map[string]*grpc.ClientConn),
+	}
+}
+
+func (s *GRPCServer) SetNodeToken(token string) {
+	s.nodeToken = token
+}
+
+func (s *GRPCServer) Acquire(ctx context.Context, req *api.AcquireLockRequest) (*api.Lock, error) {
+	client, ctx, err := s.forward(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if client != nil {
+		return client.Acquire(ctx, req)
+	}
+	return lockResult(s.store.AcquireLock(LockRequest{Name: req.Name, Holder: req.Holder, TTLSeconds: req.TtlSeconds}))
+}
+
+func (s *GRPCServer) Renew(ctx context.Context, req *api.RenewLockRequest) (*api.Lock, error) {
+	client, ctx, err := s.forward(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if client != nil {
+		return client.Renew(ctx, req)
+	}
+	return lockResult(s.store.RenewLock(LockRequest{Name: req.Name, Token: req.Token, TTLSeconds: req.TtlSeconds}))
+}
+
+func (s *GRPCServer) Release(ctx context.Context, req *api.ReleaseLockRequest) (*api.ReleaseLockResponse, error) {
+	client, ctx, err := s.forward(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if client != nil {
+		return client.Release(ctx, req)
+	}
+	if _, err := s.store.ReleaseLock(LockRequest{Name: req.Name, Token: req.Token}); err != nil {
+		return nil, toStatus(err)
+	}
+	return &api.ReleaseLockResponse{}, nil
+}
+
+func (s *GRPCServer) Get(ctx context.Context, req *api.GetLockRequest) (*api.Lock, error) {
+	client, ctx, err := s.forward(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if client != nil {
+		return client.Get(ctx, req)
+	}
+	return lockResult(s.store.Lock(req.Name))
+}
+
+func (s *GRPCServer) List(ctx context.Context, req *api.ListLocksRequest) (*api.ListLocksResponse, error) {
+	client, ctx, err := s.forward(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if client != nil {
+		return client.List(ctx, req)
+	}
+	locks, err := s.store.Locks(req.Prefix)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &api.ListLocksResponse{}
+	for _, lock := range locks {
+		resp.Locks = append(resp.Locks, toProto(lock))
+	}
+	return resp, nil
+}
+
+// Where to pass a call on to, nil when the leader is this node. Reads go to
+// the leader as well so they agree with the fencing tokens it hands out.
+func (s *GRPCServer) forward(ctx context.Context) (api.LocksClient, context.Context, error) {
+	var target string
+	switch {
+	case s.store != nil && s.store.IsLeader():
+		return nil, ctx, nil
+	case s.store != nil:
+		md, _ := metadata.FromIncomingContext(ctx)
+		if len(md.Get(leaderForwardHeader)) > 0 {
+			return nil, ctx, status.Error(codes.Unavailable, ErrNotLeader.Error())
+		}
+		target = s.store.Leader()
+		if target == "" {
+			return nil, ctx, status.Error(codes.Unavailable, "no control plane leader available")
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, leaderForwardHeader, "true")
+	case len(s.servers) > 0:
+		for _, server := range s.servers {
+			if _, has := s.grpcAddr(server); has {
+				target = server
+				break
+			}
+		}
+		if target == "" {
+			return nil, ctx, status.Error(codes.Unavailable, "no control plane server available")
+		}
+	default:
+		return nil, ctx, status.Error(codes.Unavailable, "control plane is not enabled on this node")
+	}
+
+	addr, has := s.grpcAddr(target)
+	if !has {
+		return nil, ctx, status.Errorf(codes.Unavailable, "no address for control plane node %s", target)
+	}
+	conn, err := s.conn(addr)
+	if err != nil {
+		return nil, ctx, status.Errorf(codes.Unavailable, "cannot connect to %s: %v", addr, err)
+	}
+	return api.NewLocksClient(conn), ctx, nil
+}
+
+func (s *GRPCServer) conn(addr string) (*grpc.ClientConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn, has := s.conns[addr]; has {
+		return conn, nil
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()), auth.WithToken(s.nodeToken))
+	if err != nil {
+		return nil, err
+	}
+	s.conns[addr] = conn
+	return conn, nil
+}
+
+func lockResult(lock Lock, err error) (*api.Lock, error) {
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProto(lock), nil
+}
+
+func toProto(lock Lock) *api.Lock {
+	return &api.Lock{
+		Name:             lock.Name,
+		Holder:           lock.Holder,
+		Token:            lock.Token,
+		AcquiredUnixNano: lock.AcquiredAt.UnixNano(),
+		ExpiresUnixNano:  lock.ExpiresAt.UnixNano(),
+	}
+}
+
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, ErrBadLock):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrLocked):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrLockLost), errors.Is(err, ErrUnlocked):
+		return status.Error(codes.NotFound, err.Error())
+	default:
+		// Not the leader anymore or raft could not commit in time
+		return status.Error(codes.Unavailable, err.Error())
+	}
+}
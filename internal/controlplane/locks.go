@@ -0,0 +1,195 @@
+package controlplane
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrLocked   = errors.New("lock is held by another holder")
+	ErrLockLost = errors.New("lock is not held with this token")
+	ErrUnlocked = errors.New("lock is not held")
+	ErrBadLock  = errors.New("invalid lock request")
+)
+
+const (
+	DefaultLockTTL = 30 * time.Second
+	MaxLockTTL     = time.Hour
+	MaxLockName    = 256
+)
+
+// A held lock. Locks are leases: one that is not renewed within its TTL is
+// free for anyone to take.
+type Lock struct {
+	Name   string `json:"name"`
+	Holder string `json:"holder"`
+	// Fencing token, the raft index of the acquisition. Every acquisition of
+	// any lock gets a higher token than the ones before it.
+	Token      uint64    `json:"token"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type LockRequest struct {
+	Name   string `json:"name"`
+	Holder string `json:"holder,omitempty"`
+	// Needed to renew or release
+	Token      uint64 `json:"token,omitempty"`
+	TTLSeconds uint32 `json:"ttl_seconds,omitempty"`
+}
+
+func (req LockRequest) ttl() time.Duration {
+	if req.TTLSeconds == 0 {
+		return DefaultLockTTL
+	}
+	return time.Duration(req.TTLSeconds) * time.Second
+}
+
+func (req LockRequest) validate() error {
+	switch {
+	case req.Name == "":
+		return fmt.Errorf("%w: name is required", ErrBadLock)
+	case len(req.Name) > MaxLockName:
+		return fmt.Errorf("%w: name is longer than %d bytes", ErrBadLock, MaxLockName)
+	case strings.Contains(req.Name, "/"):
+		return fmt.Errorf("%w: name cannot contain /", ErrBadLock)
+	case req.ttl() > MaxLockTTL:
+		return fmt.Errorf("%w: ttl is longer than %s", ErrBadLock, MaxLockTTL)
+	}
+	return nil
+}
+
+// Take a free lock for holder. A held lock is not handed out again, not
+// even to its own holder, who renews it with its token instead.
+func (s *Store) AcquireLock(req LockRequest) (Lock, error) {
+	if err := req.validate(); err != nil {
+		return Lock{}, err
+	}
+	if req.Holder == "" {
+		return Lock{}, fmt.Errorf("%w: holder is required", ErrBadLock)
+	}
+	return s.applyLock(opAcquire, req)
+}
+
+func (s *Store) RenewLock(req LockRequest) (Lock, error) {
+	if err := req.validate(); err != nil {
+		return Lock{}, err
+	}
+	return s.applyLock(opRenew, req)
+}
+
+// The lock as it was when it was released
+func (s *Store) ReleaseLock(req LockRequest) (Lock, error) {
+	if err := req.validate(); err != nil {
+		return Lock{}, err
+	}
+	return s.applyLock(opRelease, req)
+}
+
+func (s *Store) applyLock(op string, req LockRequest) (Lock, error) {
+	result, err := s.apply(command{Op: op, Lock: &req, Now: time.Now().UTC()})
+	if err != nil {
+		return Lock{}, err
+	}
+	lock, _ := result.(Lock)
+	return lock, nil
+}
+
+// A held lock. Only the leader answers, followers may lag the fencing tokens
+// it hands out.
+func (s *Store) Lock(name string) (Lock, error) {
+	if !s.IsLeader() {
+		return Lock{}, ErrNotLeader
+	}
+	lock, has := s.State().Locks[name]
+	if !has || !time.Now().Before(lock.ExpiresAt) {
+		return Lock{}, ErrUnlocked
+	}
+	return lock, nil
+}
+
+// Held locks whose names start with prefix, sorted by name. Only the leader
+// answers.
+func (s *Store) Locks(prefix string) ([]Lock, error) {
+	if !s.IsLeader() {
+		return nil, ErrNotLeader
+	}
+	locks := []Lock{}
+	now := time.Now()
+	for name, lock := range s.State().Locks {
+		if strings.HasPrefix(name, prefix) && now.Before(lock.ExpiresAt) {
+			locks = append(locks, lock)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Name < locks[j].Name
+	})
+	return locks, nil
+}
+
+// The state machine's side of the lock commands, with mu held
+
+func (f *fsm) acquire(req *LockRequest, now time.Time, index uint64) interface{} {
+	if req == nil {
+		return fmt.Errorf("%w: missing lock", ErrBadLock)
+	}
+	f.expireLocks(now)
+
+	if lock, held := f.state.Locks[req.Name]; held {
+		return fmt.Errorf("%w: %s is held by %q until %s",
+			ErrLocked, req.Name, lock.Holder, lock.ExpiresAt.Format(time.RFC3339))
+	}
+	lock := Lock{
+		Name:       req.Name,
+		Holder:     req.Holder,
+		Token:      index,
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(req.ttl()),
+	}
+	f.state.Locks[req.Name] = lock
+	return lock
+}
+
+func (f *fsm) renew(req *LockRequest, now time.Time) interface{} {
+	lock, err := f.held(req, now)
+	if err != nil {
+		return err
+	}
+	lock.ExpiresAt = now.Add(req.ttl())
+	f.state.Locks[req.Name] = lock
+	return lock
+}
+
+func (f *fsm) release(req *LockRequest, now time.Time) interface{} {
+	lock, err := f.held(req, now)
+	if err != nil {
+		return err
+	}
+	delete(f.state.Locks, req.Name)
+	return lock
+}
+
+// The lock a request refers to by its token
+func (f *fsm) held(req *LockRequest, now time.Time) (Lock, error) {
+	if req == nil {
+		return Lock{}, fmt.Errorf("%w: missing lock", ErrBadLock)
+	}
+	f.expireLocks(now)
+
+	lock, held := f.state.Locks[req.Name]
+	if !held || lock.Token != req.Token {
+		return Lock{}, fmt.Errorf("%w: %s with token %d", ErrLockLost, req.Name, req.Token)
+	}
+	return lock, nil
+}
+
+func (f *fsm) expireLocks(now time.Time) {
+	for name, lock := range f.state.Locks {
+		if !now.Before(lock.ExpiresAt) {
+			delete(f.state.Locks, name)
+		}
+	}
+}
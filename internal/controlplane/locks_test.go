@@ -0,0 +1,175 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+var epoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// One lock command committed at a raft index, at seconds after epoch by the
+// leader's clock
+type lockStep struct {
+	op      string
+	req     LockRequest
+	at      int
+	wantErr error
+	// Of the lock the command returns, zero to not check it
+	wantToken  uint64
+	wantHolder string
+}
+
+func applyLock(t *testing.T, f *fsm, index uint64, step lockStep) (Lock, error) {
+	t.Helper()
+	req := step.req
+	data, err := json.Marshal(command{Op: step.op, Lock: &req, Now: epoch.Add(time.Duration(step.at) * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch result := f.Apply(&raft.Log{Index: index, Data: data}).(type) {
+	case Lock:
+		return result, nil
+	case error:
+		return Lock{}, result
+	default:
+		t.Fatalf("unexpected result %#v", result)
+		return Lock{}, nil
+	}
+}
+
+func TestLockCommands(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []lockStep
+	}{
+		{
+			name: "contention",
+			steps: []lockStep{
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "a", TTLSeconds: 10}, wantToken: 1, wantHolder: "a"},
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "b", TTLSeconds: 10}, at: 5, wantErr: ErrLocked},
+				{op: opAcquire, req: LockRequest{Name: "other", Holder: "b", TTLSeconds: 10}, at: 5, wantToken: 3, wantHolder: "b"},
+			},
+		},
+		{
+			name: "holder acquires again",
+			steps: []lockStep{
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "a", TTLSeconds: 10}, wantToken: 1},
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "a", TTLSeconds: 10}, at: 1, wantErr: ErrLocked},
+			},
+		},
+		{
+			name: "renewal by the holder",
+			steps: []lockStep{
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "a", TTLSeconds: 10}, wantToken: 1},
+				{op: opRenew, req: LockRequest{Name: "l", Token: 1, TTLSeconds: 10}, at: 8, wantToken: 1, wantHolder: "a"},
+				// Past the first TTL, not past the renewed one
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "b", TTLSeconds: 10}, at: 15, wantErr: ErrLocked},
+			},
+		},
+		{
+			name: "renewal by a non-holder",
+			steps: []lockStep{
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "a", TTLSeconds: 10}, wantToken: 1},
+				{op: opRenew, req: LockRequest{Name: "l", Token: 7, TTLSeconds: 10}, at: 1, wantErr: ErrLockLost},
+				{op: opRenew, req: LockRequest{Name: "free", Token: 1, TTLSeconds: 10}, at: 1, wantErr: ErrLockLost},
+			},
+		},
+		{
+			name: "expiry at exactly the TTL",
+			steps: []lockStep{
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "a", TTLSeconds: 10}, wantToken: 1},
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "b", TTLSeconds: 10}, at: 9, wantErr: ErrLocked},
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "b", TTLSeconds: 10}, at: 10, wantToken: 3, wantHolder: "b"},
+			},
+		},
+		{
+			name: "renewal at exactly the TTL",
+			steps: []lockStep{
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "a", TTLSeconds: 10}, wantToken: 1},
+				{op: opRenew, req: LockRequest{Name: "l", Token: 1, TTLSeconds: 10}, at: 10, wantErr: ErrLockLost},
+			},
+		},
+		{
+			name: "release",
+			steps: []lockStep{
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "a", TTLSeconds: 10}, wantToken: 1},
+				{op: opRelease, req: LockRequest{Name: "l", Token: 2}, at: 1, wantErr: ErrLockLost},
+				{op: opRelease, req: LockRequest{Name: "l", Token: 1}, at: 1, wantToken: 1, wantHolder: "a"},
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "b", TTLSeconds: 10}, at: 1, wantToken: 4, wantHolder: "b"},
+			},
+		},
+		{
+			name: "release of an expired lock",
+			steps: []lockStep{
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "a", TTLSeconds: 10}, wantToken: 1},
+				{op: opRelease, req: LockRequest{Name: "l", Token: 1}, at: 11, wantErr: ErrLockLost},
+			},
+		},
+		{
+			name: "default ttl",
+			steps: []lockStep{
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "a"}, wantToken: 1},
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "b"}, at: 29, wantErr: ErrLocked},
+				{op: opAcquire, req: LockRequest{Name: "l", Holder: "b"}, at: 30, wantToken: 3},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFSM()
+			for i, step := range test.steps {
+				lock, err := applyLock(t, f, uint64(i+1), step)
+				if !errors.Is(err, step.wantErr) {
+					t.Fatalf("step %d: got error %v, want %v", i+1, err, step.wantErr)
+				}
+				if step.wantToken != 0 && lock.Token != step.wantToken {
+					t.Fatalf("step %d: token is %d, want %d", i+1, lock.Token, step.wantToken)
+				}
+				if step.wantHolder != "" && lock.Holder != step.wantHolder {
+					t.Fatalf("step %d: holder is %q, want %q", i+1, lock.Holder, step.wantHolder)
+				}
+			}
+		})
+	}
+}
+
+// Every holder a lock passes to gets a higher token than the ones before it,
+// whatever happened to other locks meanwhile
+func TestFencingTokensRise(t *testing.T) {
+	f := newFSM()
+	index := uint64(0)
+	apply := func(step lockStep) (Lock, error) {
+		index++
+		return applyLock(t, f, index, step)
+	}
+
+	var last uint64
+	at := 0
+	for i, holder := range []string{"a", "b", "c", "a", "b"} {
+		lock, err := apply(lockStep{op: opAcquire, req: LockRequest{Name: "l", Holder: holder, TTLSeconds: 10}, at: at})
+		if err != nil {
+			t.Fatalf("holder %d: %v", i, err)
+		}
+		if lock.Token <= last {
+			t.Fatalf("holder %d got token %d after %d", i, lock.Token, last)
+		}
+		last = lock.Token
+
+		// Activity on other locks, then the lock changes hands by release
+		// or expiry
+		apply(lockStep{op: opAcquire, req: LockRequest{Name: "other", Holder: holder, TTLSeconds: 1}, at: at})
+		if i%2 == 0 {
+			if _, err := apply(lockStep{op: opRelease, req: LockRequest{Name: "l", Token: lock.Token}, at: at}); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			at += 10
+		}
+		at++
+	}
+}
@@ -0,0 +1,119 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/noahdw/Gonolith/internal/httpapi"
+)
+
+// Error codes of the lock endpoints
+const (
+	CodeLockHeld    = "lock_held"
+	CodeLockLost    = "lock_lost"
+	CodeLockNotHeld = "lock_not_held"
+)
+
+// GET /v1/locks?prefix=tenant- lists held locks
+func (h *ControlPlaneHandler) HandleListLocks(w http.ResponseWriter, r *http.Request) {
+	if !h.enabled(w, r) {
+		return
+	}
+
+	locks, err := h.store.Locks(r.URL.Query().Get("prefix"))
+	if err != nil {
+		h.writeResult(w, r, err)
+		return
+	}
+	httpapi.WriteJSON(w, http.StatusOK, locks)
+}
+
+// GET /v1/locks/{name}, 404 when the lock is free
+func (h *ControlPlaneHandler) HandleGetLock(w http.ResponseWriter, r *http.Request) {
+	if !h.enabled(w, r) {
+		return
+	}
+
+	lock, err := h.store.Lock(chi.URLParam(r, "name"))
+	h.writeLock(w, r, lock, err)
+}
+
+// POST /v1/locks/{name}/acquire with {"holder": ..., "ttl_seconds": ...}
+func (h *ControlPlaneHandler) HandleAcquireLock(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.lockRequest(w, r)
+	if !ok {
+		return
+	}
+	lock, err := h.store.AcquireLock(req)
+	h.writeLock(w, r, lock, err)
+}
+
+// POST /v1/locks/{name}/renew with {"token": ..., "ttl_seconds": ...}
+func (h *ControlPlaneHandler) HandleRenewLock(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.lockRequest(w, r)
+	if !ok {
+		return
+	}
+	lock, err := h.store.RenewLock(req)
+	h.writeLock(w, r, lock, err)
+}
+
+// POST /v1/locks/{name}/release with {"token": ...}, answers with the lock
+// as it was
+func (h *ControlPlaneHandler) HandleReleaseLock(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.lockRequest(w, r)
+	if !ok {
+		return
+	}
+	lock, err := h.store.ReleaseLock(req)
+	h.writeLock(w, r, lock, err)
+}
+
+func (h *ControlPlaneHandler) lockRequest(w http.ResponseWriter, r *http.Request) (LockRequest, bool) {
+	if !h.enabled(w, r) {
+		return LockRequest{}, false
+	}
+
+	var req LockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpapi.WriteError(w, http.StatusBadRequest, httpapi.CodeInvalidRequest, "invalid lock request: "+err.Error())
+		return LockRequest{}, false
+	}
+	req.Name = chi.URLParam(r, "name")
+	return req, true
+}
+
+func (h *ControlPlaneHandler) writeLock(w http.ResponseWriter, r *http.Request, lock Lock, err error) {
+	if err != nil {
+		h.writeResult(w, r, err)
+		return
+	}
+	httpapi.WriteJSON(w, http.StatusOK, lock)
+}
+
+// Code of the lock errors, empty for other errors
+func lockCode(err error) string {
+	switch {
+	case errors.Is(err, ErrLocked):
+		return CodeLockHeld
+	case errors.Is(err, ErrLockLost):
+		return CodeLockLost
+	case errors.Is(err, ErrUnlocked):
+		return CodeLockNotHeld
+	case errors.Is(err, ErrBadLock):
+		return httpapi.CodeInvalidRequest
+	}
+	return ""
+}
+
+func lockStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnlocked):
+		return http.StatusNotFound
+	case errors.Is(err, ErrBadLock):
+		return http.StatusBadRequest
+	}
+	return http.StatusConflict
+}
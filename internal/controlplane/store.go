@@ -0,0 +1,188 @@
+package controlplane
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+var (
+	ErrNotLeader = errors.New("not the control plane leader")
+	ErrConflict  = errors.New("scheduling conflict")
+	// The request itself is wrong, trying again does not help
+	ErrInvalid = errors.New("invalid control plane request")
+)
+
+const applyTimeout = 5 * time.Second
+
+type Config struct {
+	NodeName string
+	// Address raft listens on, e.g. ":7000"
+	BindAddr string
+	// The fixed set of server nodes, node name -> raft address
+	Servers map[string]string
+	DataDir string
+}
+
+// Parse "gonolith1=host1:7000,gonolith2=host2:7000"
+func ParseServers(raw string) (map[string]string, error) {
+	servers := make(map[string]string)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, addr, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || addr == "" {
+			return nil, fmt.Errorf("invalid raft server %q, expected name=host:port", entry)
+		}
+		servers[name] = addr
+	}
+	return servers, nil
+}
+
+// Store is the optional strongly consistent control plane. Desired state and
+// scheduling decisions go through raft among the configured server nodes.
+type Store struct {
+	raft *raft.Raft
+	fsm  *fsm
+	name string
+}
+
+func NewStore(cfg Config) (*Store, error) {
+	advertise, has := cfg.Servers[cfg.NodeName]
+	if !has {
+		return nil, fmt.Errorf("node %s is not one of the raft servers", cfg.NodeName)
+	}
+
+	if err := os.MkdirAll(cfg.DataDir, 0700); err != nil {
+		return nil, err
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(cfg.NodeName)
+
+	advertiseAddr, err := net.ResolveTCPAddr("tcp", advertise)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(cfg.BindAddr, advertiseAddr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(cfg.DataDir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	boltStore, err := raftboltdb.NewBoltStore(filepath.Join(cfg.DataDir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	f := newFSM()
+	r, err := raft.NewRaft(config, f, boltStore, boltStore, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every server bootstraps with the same configuration, raft tolerates that
+	hasState, err := raft.HasExistingState(boltStore, boltStore, snapshots)
+	if err != nil {
+		return nil, err
+	}
+	if !hasState {
+		var servers []raft.Server
+		for name, addr := range cfg.Servers {
+			servers = append(servers, raft.Server{
+				ID:      raft.ServerID(name),
+				Address: raft.ServerAddress(addr),
+			})
+		}
+		sort.Slice(servers, func(i, j int) bool {
+			return servers[i].ID < servers[j].ID
+		})
+		err := r.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+		if err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+			return nil, err
+		}
+	}
+
+	slog.Info("Control plane started", "node", cfg.NodeName, "servers", len(cfg.Servers))
+	return &Store{
+		raft: r,
+		fsm:  f,
+		name: cfg.NodeName,
+	}, nil
+}
+
+func (s *Store) IsLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+// Node name of the current leader, empty while an election is in progress
+func (s *Store) Leader() string {
+	_, id := s.raft.LeaderWithID()
+	return string(id)
+}
+
+func (s *Store) Servers() ([]string, error) {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, server := range future.Configuration().Servers {
+		names = append(names, string(server.ID))
+	}
+	return names, nil
+}
+
+func (s *Store) State() State {
+	return s.fsm.snapshotState()
+}
+
+func (s *Store) SetDesired(raw []byte) error {
+	_, err := s.apply(command{Op: opSetDesired, Desired: string(raw)})
+	return err
+}
+
+func (s *Store) Schedule(req ScheduleRequest) error {
+	_, err := s.apply(command{Op: opSchedule, Schedule: &req})
+	return err
+}
+
+// Commit a command and return what the state machine answered
+func (s *Store) apply(cmd command) (interface{}, error) {
+	if !s.IsLeader() {
+		return nil, ErrNotLeader
+	}
+
+	raw, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	future := s.raft.Apply(raw, applyTimeout)
+	if err := future.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			return nil, ErrNotLeader
+		}
+		return nil, err
+	}
+	if err, ok := future.Response().(error); ok {
+		return nil, err
+	}
+	return future.Response(), nil
+}
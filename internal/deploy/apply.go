@@ -0,0 +1,146 @@
+package deploy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/noahdw/Gonolith/internal/controlplane"
+	"github.com/noahdw/Gonolith/internal/microservice"
+)
+
+// Execute the plan one action at a time and stop at the first failure. Running
+// plan/apply again afterwards picks up where this left off. nodeAddr is the
+// node used to reach the control plane.
+func Apply(client *Client, plan *Plan, nodeAddr string, out io.Writer) error {
+	packages, err := readPackages(plan)
+	if err != nil {
+		return err
+	}
+
+	if plan.consistent {
+		if err := client.SetDesired(nodeAddr, plan.desired); err != nil {
+			return fmt.Errorf("cannot record desired state: %w", err)
+		}
+	}
+
+	for _, action := range plan.Actions {
+		fmt.Fprintln(out, action)
+
+		switch action.Kind {
+		case ActionInstall:
+			rawzip := packages[action.Package]
+			if plan.consistent {
+				if err := checkSlotFree(client, nodeAddr, action); err != nil {
+					return err
+				}
+				err = client.Schedule(nodeAddr, controlplane.ScheduleRequest{
+					Service:  action.Service,
+					Slot:     action.Slot,
+					Node:     action.Node,
+					Version:  action.Version,
+					Expected: action.Expected,
+				})
+				if err != nil {
+					return fmt.Errorf("%s was not scheduled, re-run plan: %w", action, err)
+				}
+			}
+			var id string
+			id, err = client.Install(action.NodeAddr, rawzip)
+			if err == nil {
+				fmt.Fprintf(out, "  installed as %s\n", id)
+			}
+		case ActionStart:
+			err = client.Start(action.NodeAddr, action.ServiceID)
+		case ActionRemove:
+			err = client.Remove(action.NodeAddr, action.ServiceID)
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s failed: %w", action, err)
+		}
+	}
+
+	for _, warning := range plan.Warnings {
+		fmt.Fprintln(out, "! "+warning)
+	}
+	fmt.Fprintln(out, "Apply complete.")
+	return nil
+}
+
+// The plan may be old by now. Refuse to take over a slot whose owner runs a
+// replica again, which would leave the service with one too many.
+func checkSlotFree(client *Client, nodeAddr string, action Action) error {
+	if action.Expected == "" {
+		return nil
+	}
+	state, err := client.ClusterState(nodeAddr)
+	if err != nil {
+		return fmt.Errorf("%s was not scheduled, cannot read cluster state: %w", action, err)
+	}
+	for _, node := range state.Nodes {
+		if node.Name != action.Expected {
+			continue
+		}
+		for _, status := range node.Services {
+			if status.Name == action.Service && status.Version == action.Version {
+				return fmt.Errorf("%s was not scheduled, slot %d still has a replica on %s (%s), re-run plan",
+					action, action.Slot, node.Name, status.Id)
+			}
+		}
+	}
+	return nil
+}
+
+// Read the packages of every install, before anything changes, and make sure
+// they are what the manifest says they are
+func readPackages(plan *Plan) (map[string][]byte, error) {
+	packages := make(map[string][]byte)
+	for _, action := range plan.Actions {
+		if action.Kind != ActionInstall {
+			continue
+		}
+		rawzip, has := packages[action.Package]
+		if !has {
+			var err error
+			rawzip, err = os.ReadFile(action.Package)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read package for %s: %w", action.Service, err)
+			}
+			packages[action.Package] = rawzip
+		}
+
+		config, err := microservice.ReadPackageConfig(rawzip)
+		if err != nil {
+			return nil, fmt.Errorf("package %s for %s: %w", action.Package, action.Service, err)
+		}
+		if config.Name != action.Service || config.Version != action.Version {
+			return nil, fmt.Errorf("package %s is %s@%s, the manifest expects %s@%s",
+				action.Package, config.Name, config.Version, action.Service, action.Version)
+		}
+		// Nodes start the service by what its package requires, the manifest
+		// orders the installs by what it says
+		if !sameRequirements(config.Requires, action.Requires) {
+			return nil, fmt.Errorf("package %s requires %v, the manifest says %s requires %v",
+				action.Package, config.Requires, action.Service, action.Requires)
+		}
+	}
+	return packages, nil
+}
+
+// Whether two requires lists name the same requirements, in any order and
+// however they are spaced
+func sameRequirements(a, b []string) bool {
+	normalize := func(raw []string) []string {
+		reqs := make([]string, 0, len(raw))
+		for _, r := range raw {
+			reqs = append(reqs, strings.Join(strings.Fields(r), ""))
+		}
+		sort.Strings(reqs)
+		return slices.Compact(reqs)
+	}
+	return slices.Equal(normalize(a), normalize(b))
+}
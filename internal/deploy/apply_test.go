@@ -0,0 +1,72 @@
+package deploy
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writePackage(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "service.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	archive := zip.NewWriter(file)
+	w, err := archive.Create("config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadPackages(t *testing.T) {
+	const config = `name = "api"
+version = "1.0.0"
+requires = ["auth>=1.2", "billing"]
+`
+	tests := []struct {
+		name     string
+		version  string
+		requires []string
+		// Part of the error, empty when the package matches
+		wantErr string
+	}{
+		{name: "matches", version: "1.0.0", requires: []string{"auth>=1.2", "billing"}},
+		{name: "other order and spacing", version: "1.0.0", requires: []string{"billing", "auth >= 1.2"}},
+		{name: "other version", version: "2.0.0", requires: []string{"auth>=1.2", "billing"}, wantErr: "manifest expects api@2.0.0"},
+		{name: "missing requirement", version: "1.0.0", requires: []string{"auth>=1.2"}, wantErr: "the manifest says api requires"},
+		{name: "other constraint", version: "1.0.0", requires: []string{"auth>=2", "billing"}, wantErr: "the manifest says api requires"},
+		{name: "no requirements", version: "1.0.0", wantErr: "the manifest says api requires"},
+	}
+
+	path := writePackage(t, config)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := &Plan{Actions: []Action{{
+				Kind:     ActionInstall,
+				Service:  "api",
+				Version:  test.version,
+				Package:  path,
+				Requires: test.requires,
+			}}}
+			_, err := readPackages(plan)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("got %v, want no error", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Fatalf("got %v, want an error with %q", err, test.wantErr)
+			}
+		})
+	}
+}
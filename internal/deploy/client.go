@@ -0,0 +1,178 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/noahdw/Gonolith/internal/auth"
+	"github.com/noahdw/Gonolith/internal/cluster"
+	"github.com/noahdw/Gonolith/internal/controlplane"
+	"github.com/noahdw/Gonolith/internal/httpapi"
+	"github.com/noahdw/Gonolith/internal/microservice"
+)
+
+// Client talks to the HTTP API of Gonolith nodes
+type Client struct {
+	http *http.Client
+	// Set once the client has a token
+	transport *auth.Transport
+}
+
+func NewClient() *Client {
+	return &Client{
+		http: &http.Client{Timeout: 10 * time.Minute},
+	}
+}
+
+// Authenticate every request with an API token, or the node token when the
+// client is used by a node
+func (c *Client) SetToken(token string) {
+	c.transport = auth.NewTransport(token, nil)
+	c.http.Transport = c.transport
+}
+
+// Keep the token when a node redirects to one of the nodes in state, e.g. a
+// follower to the control plane leader
+func (c *Client) TrustNodes(state cluster.ClusterStateAPI) {
+	if c.transport == nil {
+		return
+	}
+	for _, node := range state.Nodes {
+		c.transport.Trust(node.HTTPAddr)
+	}
+}
+
+func (c *Client) ClusterState(nodeAddr string) (cluster.ClusterStateAPI, error) {
+	var state cluster.ClusterStateAPI
+	err := c.getJSON(nodeAddr, "/cluster/state", &state)
+	return state, err
+}
+
+func (c *Client) ControlPlaneStatus(nodeAddr string) (controlplane.StatusAPI, error) {
+	var status controlplane.StatusAPI
+	err := c.getJSON(nodeAddr, "/controlplane/status", &status)
+	return status, err
+}
+
+func (c *Client) ControlPlaneState(nodeAddr string) (controlplane.State, error) {
+	var state controlplane.State
+	err := c.getJSON(nodeAddr, "/controlplane/state", &state)
+	return state, err
+}
+
+// Followers redirect writes to the leader, the http client follows them
+func (c *Client) SetDesired(nodeAddr string, raw []byte) error {
+	req, err := http.NewRequest(http.MethodPut, baseURL(nodeAddr)+"/controlplane/desired", bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+func (c *Client) Schedule(nodeAddr string, schedule controlplane.ScheduleRequest) error {
+	raw, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Post(baseURL(nodeAddr)+"/controlplane/schedule", "application/json", bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+func (c *Client) Install(nodeAddr string, rawzip []byte) (string, error) {
+	resp, err := c.http.Post(baseURL(nodeAddr)+"/services", "application/zip", bytes.NewReader(rawzip))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return "", err
+	}
+	var status microservice.MicroserviceStatusAPI
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status.Id, err
+}
+
+func (c *Client) Start(nodeAddr, id string) error {
+	resp, err := c.http.Post(baseURL(nodeAddr)+"/services/"+url.PathEscape(id)+":start", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+func (c *Client) Remove(nodeAddr, id string) error {
+	req, err := http.NewRequest(http.MethodDelete, baseURL(nodeAddr)+"/services/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// Drain can take a while, every running service is moved and waited for
+func (c *Client) NodeOperation(nodeAddr, node, operation string) ([]byte, error) {
+	resp, err := c.http.Post(baseURL(nodeAddr)+"/cluster/nodes/"+url.PathEscape(node)+"/"+operation, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (c *Client) getJSON(nodeAddr, path string, out any) error {
+	resp, err := c.http.Get(baseURL(nodeAddr) + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(resp.Body)
+	var apiErr httpapi.ErrorResponseAPI
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Error.Code != "" {
+		return fmt.Errorf("%s: %s (%s)", resp.Status, apiErr.Error.Message, apiErr.Error.Code)
+	}
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// Accept both "host:port" and full URLs, without the API version
+func baseURL(nodeAddr string) string {
+	if strings.HasPrefix(nodeAddr, "http://") || strings.HasPrefix(nodeAddr, "https://") {
+		return strings.TrimSuffix(nodeAddr, "/") + httpapi.Version
+	}
+	return "http://" + nodeAddr + httpapi.Version
+}
@@ -0,0 +1,263 @@
+package deploy
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/noahdw/Gonolith/internal/cluster"
+	"github.com/noahdw/Gonolith/internal/controlplane"
+	"github.com/noahdw/Gonolith/internal/microservice"
+	"github.com/noahdw/Gonolith/internal/singleton"
+)
+
+type DrainResultAPI struct {
+	Node  string            `json:"node"`
+	Moved []MovedServiceAPI `json:"moved"`
+	// Services that were stopped and stay where they are
+	Skipped []string `json:"skipped"`
+	Error   string   `json:"error,omitempty"`
+}
+
+type MovedServiceAPI struct {
+	Name  string `json:"name"`
+	OldId string `json:"old_id"`
+	NewId string `json:"new_id"`
+	Node  string `json:"node"`
+}
+
+// Drainer moves every service that runs or is about to off the local node
+type Drainer struct {
+	cluster  *cluster.Cluster
+	services *microservice.Microservices
+	client   *Client
+	// Hands running singletons over, nil when the node runs no elections
+	elector *singleton.Elector
+	// How long to wait for a moved service to be ready on its new node
+	readyTimeout time.Duration
+
+	// Only one drain at a time
+	mu sync.Mutex
+}
+
+func NewDrainer(c *cluster.Cluster, services *microservice.Microservices, client *Client) *Drainer {
+	return &Drainer{
+		cluster:      c,
+		services:     services,
+		client:       client,
+		readyTimeout: 30 * time.Second,
+	}
+}
+
+func (d *Drainer) SetElector(elector *singleton.Elector) {
+	d.elector = elector
+}
+
+// Cordon the node, then for each service that is not stopped install it
+// elsewhere, wait until the new copy got as far as the local one and only
+// then remove the local copy. Stops at the first service that cannot be moved
+// so nothing is lost.
+func (d *Drainer) Drain() (DrainResultAPI, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result := DrainResultAPI{
+		Node:    d.cluster.LocalName(),
+		Moved:   []MovedServiceAPI{},
+		Skipped: []string{},
+	}
+	if err := d.cluster.SetCordoned(true); err != nil {
+		return result, fmt.Errorf("cannot cordon node: %w", err)
+	}
+
+	statuses := d.services.GetAllStatuses().Services
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	for _, status := range statuses {
+		switch status.Status {
+		case "running", microservice.StatusWaiting, microservice.StatusStandby:
+		default:
+			result.Skipped = append(result.Skipped, status.Id)
+			continue
+		}
+
+		moved, err := d.move(status)
+		if err != nil {
+			return result, fmt.Errorf("cannot move %s (%s): %w", status.Name, status.Id, err)
+		}
+		result.Moved = append(result.Moved, moved)
+	}
+
+	slog.Info("Node drained", "node", result.Node, "moved", len(result.Moved))
+	return result, nil
+}
+
+func (d *Drainer) move(status microservice.MicroserviceStatusAPI) (MovedServiceAPI, error) {
+	moved := MovedServiceAPI{Name: status.Name, OldId: status.Id}
+
+	rawzip, has := d.services.Package(status.Id)
+	if !has {
+		return moved, fmt.Errorf("service disappeared")
+	}
+
+	target, err := d.pickTarget(status.Name)
+	if err != nil {
+		return moved, err
+	}
+	moved.Node = target.Name
+	if err := d.schedule(status, target); err != nil {
+		return moved, err
+	}
+
+	slog.Info("Moving service", "service", status.Name, "id", status.Id, "to", target.Name)
+	id, err := d.client.Install(target.HTTPAddr, rawzip)
+	if err != nil {
+		return moved, fmt.Errorf("install on %s failed: %w", target.Name, err)
+	}
+	moved.NewId = id
+
+	if status.Singleton && status.Status == "running" {
+		// The new copy stays in standby while this one holds the lease
+		if err := d.waitReady(target, id, microservice.StatusStandby); err != nil {
+			return moved, err
+		}
+		return moved, d.handOver(status, target, id)
+	}
+
+	if err := d.waitReady(target, id, status.Status); err != nil {
+		return moved, err
+	}
+
+	return moved, d.services.RemoveMicroservice(status.Id)
+}
+
+// Move the control plane's slot of the local replica to target before it is
+// installed there, like apply does, so an apply running at the same time
+// cannot place the replica as well. Nothing to do without a control plane or
+// for services the desired state has no slot for here. Should the move fail
+// after this, the next plan sees the slot's node runs no replica and takes
+// the slot over.
+func (d *Drainer) schedule(status microservice.MicroserviceStatusAPI, target cluster.NodeState) error {
+	local := d.cluster.LocalName()
+	addr, has := d.cluster.HTTPAddr(local)
+	if !has {
+		return fmt.Errorf("no address for this node")
+	}
+	// Non-servers redirect to a server, which redirects to its leader
+	d.client.TrustNodes(d.cluster.State())
+
+	controlPlane, err := d.client.ControlPlaneStatus(addr)
+	if err != nil {
+		return fmt.Errorf("cannot reach the control plane: %w", err)
+	}
+	if !controlPlane.Enabled {
+		return nil
+	}
+	scheduled, err := d.client.ControlPlaneState(addr)
+	if err != nil {
+		return fmt.Errorf("cannot read the control plane state: %w", err)
+	}
+
+	for slot, assignment := range scheduled.Assignments[status.Name] {
+		if assignment.Node != local || assignment.Version != status.Version {
+			continue
+		}
+		err := d.client.Schedule(addr, controlplane.ScheduleRequest{
+			Service:  status.Name,
+			Slot:     slot,
+			Node:     target.Name,
+			Version:  status.Version,
+			Expected: local,
+		})
+		if err != nil {
+			return fmt.Errorf("slot %d was not moved to %s: %w", slot, target.Name, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// Stop the local instance of a running singleton and give up its lease so
+// the copy on target is elected. The local one goes back into the election
+// when the copy does not come up.
+func (d *Drainer) handOver(status microservice.MicroserviceStatusAPI, target cluster.NodeState, id string) error {
+	if err := d.services.StopMicroservice(status.Id); err != nil {
+		return err
+	}
+	if d.elector != nil {
+		d.elector.Release(status.Name, status.Id)
+	}
+
+	if err := d.waitReady(target, id, "running"); err != nil {
+		if err := d.services.StartMicroservice(status.Id); err != nil {
+			slog.Error("Cannot put singleton back into the election", "id", status.Id, "error", err)
+		}
+		return err
+	}
+	return d.services.RemoveMicroservice(status.Id)
+}
+
+// Least loaded uncordoned node, preferring nodes that do not run the service yet
+func (d *Drainer) pickTarget(service string) (cluster.NodeState, error) {
+	var candidates []cluster.NodeState
+	for _, node := range d.cluster.State().Nodes {
+		if !node.Local && !node.Cordoned {
+			candidates = append(candidates, node)
+		}
+	}
+	if len(candidates) == 0 {
+		return cluster.NodeState{}, fmt.Errorf("no uncordoned node to move to")
+	}
+
+	hosts := func(node cluster.NodeState) bool {
+		for _, status := range node.Services {
+			if status.Name == service {
+				return true
+			}
+		}
+		return false
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if hosts(candidates[i]) != hosts(candidates[j]) {
+			return !hosts(candidates[i])
+		}
+		return len(candidates[i].Services) < len(candidates[j].Services)
+	})
+	return candidates[0], nil
+}
+
+// Wait until the copy on target got as far as the local one was: healthy
+// for running services, in the same state for the ones that wait for their
+// dependencies or an election. The target reports its own services directly,
+// so its view of itself is fresh.
+func (d *Drainer) waitReady(target cluster.NodeState, id, local string) error {
+	deadline := time.Now().Add(d.readyTimeout)
+	for time.Now().Before(deadline) {
+		state, err := d.client.ClusterState(target.HTTPAddr)
+		if err == nil {
+			for _, node := range state.Nodes {
+				if !node.Local {
+					continue
+				}
+				for _, status := range node.Services {
+					if status.Id == id && caughtUp(local, status) {
+						return nil
+					}
+				}
+			}
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("%s did not become ready on %s within %s", id, target.Name, d.readyTimeout)
+}
+
+func caughtUp(local string, moved microservice.MicroserviceStatusAPI) bool {
+	if moved.Healthy() {
+		return true
+	}
+	return local != "running" && moved.Status == local
+}
@@ -0,0 +1,76 @@
+package deploy
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/noahdw/Gonolith/internal/cluster"
+	"github.com/noahdw/Gonolith/internal/httpapi"
+)
+
+type NodeHandler struct {
+	cluster *cluster.Cluster
+	drainer *Drainer
+}
+
+func NewNodeHandler(c *cluster.Cluster, drainer *Drainer) *NodeHandler {
+	return &NodeHandler{
+		cluster: c,
+		drainer: drainer,
+	}
+}
+
+func (h *NodeHandler) HandleCordon(w http.ResponseWriter, r *http.Request) {
+	if h.redirectToNode(w, r) {
+		return
+	}
+	if err := h.cluster.SetCordoned(true); err != nil {
+		httpapi.WriteError(w, http.StatusInternalServerError, httpapi.CodeInternal, "cannot cordon node: "+err.Error())
+		return
+	}
+	httpapi.WriteNoContent(w)
+}
+
+func (h *NodeHandler) HandleUncordon(w http.ResponseWriter, r *http.Request) {
+	if h.redirectToNode(w, r) {
+		return
+	}
+	if err := h.cluster.SetCordoned(false); err != nil {
+		httpapi.WriteError(w, http.StatusInternalServerError, httpapi.CodeInternal, "cannot uncordon node: "+err.Error())
+		return
+	}
+	httpapi.WriteNoContent(w)
+}
+
+func (h *NodeHandler) HandleDrain(w http.ResponseWriter, r *http.Request) {
+	if h.redirectToNode(w, r) {
+		return
+	}
+
+	result, err := h.drainer.Drain()
+	status := http.StatusOK
+	if err != nil {
+		slog.Error("Drain failed", "error", err)
+		result.Error = err.Error()
+		status = http.StatusInternalServerError
+	}
+
+	httpapi.WriteJSON(w, status, result)
+}
+
+// Node operations run on the node itself, any other node sends the caller there
+func (h *NodeHandler) redirectToNode(w http.ResponseWriter, r *http.Request) bool {
+	node := chi.URLParam(r, "node")
+	if node == h.cluster.LocalName() {
+		return false
+	}
+
+	addr, has := h.cluster.HTTPAddr(node)
+	if !has {
+		httpapi.WriteError(w, http.StatusNotFound, cluster.CodeNodeNotFound, "unknown node "+node)
+		return true
+	}
+	http.Redirect(w, r, "http://"+addr+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return true
+}
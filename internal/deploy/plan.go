@@ -0,0 +1,261 @@
+package deploy
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/noahdw/Gonolith/internal/cluster"
+	"github.com/noahdw/Gonolith/internal/controlplane"
+	"github.com/noahdw/Gonolith/internal/manifest"
+	"github.com/noahdw/Gonolith/internal/microservice"
+)
+
+type ActionKind string
+
+const (
+	ActionInstall ActionKind = "install"
+	ActionStart   ActionKind = "start"
+	ActionRemove  ActionKind = "remove"
+)
+
+type Action struct {
+	Kind      ActionKind
+	Service   string
+	Version   string
+	Node      string
+	NodeAddr  string
+	ServiceID string
+	// Only set for installs
+	Package string
+	// What the manifest says the service requires, only set for installs
+	Requires []string
+	// Replica slot and its current owner, used to record the decision in the
+	// control plane before installing. Only slots whose owner runs no replica
+	// anymore are taken over.
+	Slot     int
+	Expected string
+}
+
+func (a Action) String() string {
+	switch a.Kind {
+	case ActionInstall:
+		return fmt.Sprintf("+ install %s@%s on %s", a.Service, a.Version, a.Node)
+	case ActionStart:
+		return fmt.Sprintf("~ start %s@%s (%s) on %s", a.Service, a.Version, a.ServiceID, a.Node)
+	default:
+		return fmt.Sprintf("- remove %s@%s (%s) on %s", a.Service, a.Version, a.ServiceID, a.Node)
+	}
+}
+
+type Plan struct {
+	Actions []Action
+	// Things the plan could not satisfy, e.g. more replicas than eligible nodes
+	Warnings []string
+
+	// Set when the cluster runs a control plane, apply then records the
+	// manifest and every placement there so concurrent applies cannot both
+	// schedule the same replica
+	consistent bool
+	desired    []byte
+}
+
+func (p *Plan) Empty() bool {
+	return len(p.Actions) == 0
+}
+
+func (p *Plan) Print(w io.Writer) {
+	counts := make(map[ActionKind]int)
+	for _, action := range p.Actions {
+		fmt.Fprintln(w, action)
+		counts[action.Kind]++
+	}
+	for _, warning := range p.Warnings {
+		fmt.Fprintln(w, "! "+warning)
+	}
+	if p.Empty() && len(p.Warnings) == 0 {
+		fmt.Fprintln(w, "No changes. The cluster matches the manifest.")
+		return
+	}
+	fmt.Fprintf(w, "Plan: %d to install, %d to start, %d to remove.\n",
+		counts[ActionInstall], counts[ActionStart], counts[ActionRemove])
+}
+
+type instance struct {
+	node   cluster.NodeState
+	status microservice.MicroserviceStatusAPI
+}
+
+// Diff the manifest against the observed cluster state. Installs are ordered so
+// that dependencies come first, removals of services no longer in the manifest
+// come last. scheduled is the control plane state, nil when there is none.
+func NewPlan(m *manifest.Manifest, state cluster.ClusterStateAPI, scheduled *controlplane.State) (*Plan, error) {
+	order, err := m.StartOrder()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+	if scheduled != nil {
+		plan.consistent = true
+		plan.desired = m.Raw()
+	}
+	byName := make(map[string][]instance)
+	load := make(map[string]int)
+	for _, node := range state.Nodes {
+		load[node.Name] = len(node.Services)
+		for _, status := range node.Services {
+			byName[status.Name] = append(byName[status.Name], instance{node: node, status: status})
+		}
+	}
+
+	var removals []Action
+	for _, service := range order {
+		eligible := eligibleNodes(m, service, state)
+		var kept []instance
+		var candidates []instance
+		for _, inst := range byName[service.Name] {
+			if inst.status.Version == service.Version && eligible[inst.node.Name] {
+				candidates = append(candidates, inst)
+			} else {
+				removals = append(removals, removeAction(inst))
+			}
+		}
+
+		// Prefer keeping instances that are already running
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].status.Status == "running" && candidates[j].status.Status != "running"
+		})
+		for _, inst := range candidates {
+			if len(kept) >= service.Replicas {
+				removals = append(removals, removeAction(inst))
+				continue
+			}
+			kept = append(kept, inst)
+			// Waiting and standby instances start on their own
+			if inst.status.Status == "stopped" || inst.status.Status == "installed" {
+				plan.Actions = append(plan.Actions, Action{
+					Kind:      ActionStart,
+					Service:   service.Name,
+					Version:   service.Version,
+					Node:      inst.node.Name,
+					NodeAddr:  inst.node.HTTPAddr,
+					ServiceID: inst.status.Id,
+				})
+			}
+		}
+
+		// Spread the missing replicas over the least loaded eligible nodes,
+		// never placing two replicas of one service on the same node. Cordoned
+		// nodes keep what they run but get nothing new.
+		hosting := make(map[string]bool)
+		for _, inst := range kept {
+			hosting[inst.node.Name] = true
+		}
+		var free []cluster.NodeState
+		for _, node := range state.Nodes {
+			if eligible[node.Name] && !hosting[node.Name] && !node.Cordoned {
+				free = append(free, node)
+			}
+		}
+		// Slots whose node runs no kept replica are free to take over, a slot
+		// whose replica is alive is never reassigned. New slots go after the
+		// recorded ones.
+		var assigned []controlplane.Assignment
+		if scheduled != nil {
+			assigned = scheduled.Assignments[service.Name]
+		}
+		var slots []int
+		for i, assignment := range assigned {
+			if !hosting[assignment.Node] {
+				slots = append(slots, i)
+			}
+		}
+		next := len(assigned)
+
+		missing := service.Replicas - len(kept)
+		for ; missing > 0 && len(free) > 0; missing-- {
+			sort.SliceStable(free, func(i, j int) bool {
+				if load[free[i].Name] != load[free[j].Name] {
+					return load[free[i].Name] < load[free[j].Name]
+				}
+				return free[i].Name < free[j].Name
+			})
+			node := free[0]
+			free = free[1:]
+			load[node.Name]++
+			action := Action{
+				Kind:     ActionInstall,
+				Service:  service.Name,
+				Version:  service.Version,
+				Node:     node.Name,
+				NodeAddr: node.HTTPAddr,
+				Package:  m.PackagePath(service),
+				Requires: service.Requires,
+			}
+			if len(slots) > 0 {
+				action.Slot, slots = slots[0], slots[1:]
+				action.Expected = assigned[action.Slot].Node
+			} else {
+				action.Slot = next
+				next++
+			}
+			plan.Actions = append(plan.Actions, action)
+		}
+		if missing > 0 {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("%s wants %d replicas but only %d eligible nodes are available",
+				service.Name, service.Replicas, service.Replicas-missing))
+		}
+	}
+
+	// Anything that is not mentioned in the manifest is pruned
+	declared := make(map[string]bool)
+	for _, service := range m.Services {
+		declared[service.Name] = true
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if declared[name] {
+			continue
+		}
+		for _, inst := range byName[name] {
+			removals = append(removals, removeAction(inst))
+		}
+	}
+
+	plan.Actions = append(plan.Actions, removals...)
+	return plan, nil
+}
+
+// Live nodes a service may be placed on. A node group that names a node which is
+// not in the cluster is not an error, the node may simply be down.
+func eligibleNodes(m *manifest.Manifest, service manifest.Service, state cluster.ClusterStateAPI) map[string]bool {
+	eligible := make(map[string]bool)
+	group, hasGroup := m.Group(service.NodeGroup)
+	members := make(map[string]bool)
+	for _, name := range group.Nodes {
+		members[name] = true
+	}
+
+	for _, node := range state.Nodes {
+		if !hasGroup || members[node.Name] {
+			eligible[node.Name] = true
+		}
+	}
+	return eligible
+}
+
+func removeAction(inst instance) Action {
+	return Action{
+		Kind:      ActionRemove,
+		Service:   inst.status.Name,
+		Version:   inst.status.Version,
+		Node:      inst.node.Name,
+		NodeAddr:  inst.node.HTTPAddr,
+		ServiceID: inst.status.Id,
+	}
+}
@@ -0,0 +1,146 @@
+package discovery
+
+import (
+	"net"
+	"sort"
+
+	"github.com/noahdw/Gonolith/internal/cluster"
+	"github.com/noahdw/Gonolith/internal/microservice"
+	"github.com/noahdw/Gonolith/internal/semver"
+)
+
+type EndpointAPI struct {
+	Id      string `json:"id"`
+	Node    string `json:"node"`
+	Address string `json:"address"`
+	Version string `json:"version"`
+	// Runs on the node that answered
+	Local bool `json:"local"`
+	// Every port the node allocated to the instance, by name
+	Ports map[string]string `json:"ports,omitempty"`
+}
+
+type CapabilitiesAPI struct {
+	Id   string `json:"id"`
+	Node string `json:"node"`
+	Name string `json:"name"`
+	// False until the instance has been ready long enough to be asked
+	Known        bool                         `json:"known"`
+	Capabilities []microservice.CapabilityAPI `json:"capabilities"`
+}
+
+type ResolveAPI struct {
+	Name      string        `json:"name"`
+	Endpoints []EndpointAPI `json:"endpoints"`
+}
+
+// Resolver turns a service name into live endpoints using the gossiped
+// catalog and health state
+type Resolver struct {
+	cluster *cluster.Cluster
+	// The node's own Unix socket, where services on this node reach its router
+	nodeSocket string
+}
+
+func NewResolver(c *cluster.Cluster) *Resolver {
+	return &Resolver{
+		cluster: c,
+	}
+}
+
+// Socket of the node's gRPC API, set before resolving. Services on this node
+// reach WebAssembly instances through it, so the node can authenticate the
+// calls it passes on to other nodes.
+func (r *Resolver) SetNodeSocket(path string) {
+	r.nodeSocket = path
+}
+
+// Healthy instances of a service, local ones first. version is an optional
+// constraint such as ">=1.2, <2". Local instances listening on their Unix
+// socket are returned as unix:// addresses, WebAssembly instances as the
+// node's own socket.
+func (r *Resolver) Resolve(name, version string) (ResolveAPI, error) {
+	return r.resolve(name, version, true)
+}
+
+// Like Resolve, but always with host:port addresses
+func (r *Resolver) ResolveTCP(name, version string) (ResolveAPI, error) {
+	return r.resolve(name, version, false)
+}
+
+// What an instance reported it exposes, looked up in the gossiped catalog
+func (r *Resolver) Capabilities(id string) (CapabilitiesAPI, bool) {
+	for _, node := range r.cluster.State().Nodes {
+		for _, status := range node.Services {
+			if status.Id != id {
+				continue
+			}
+			result := CapabilitiesAPI{
+				Id:           status.Id,
+				Node:         node.Name,
+				Name:         status.Name,
+				Known:        status.Capabilities != nil,
+				Capabilities: status.Capabilities,
+			}
+			if result.Capabilities == nil {
+				result.Capabilities = []microservice.CapabilityAPI{}
+			}
+			return result, true
+		}
+	}
+	return CapabilitiesAPI{}, false
+}
+
+func (r *Resolver) resolve(name, version string, sockets bool) (ResolveAPI, error) {
+	constraint, err := semver.ParseConstraint(version)
+	if err != nil {
+		return ResolveAPI{}, err
+	}
+
+	result := ResolveAPI{
+		Name:      name,
+		Endpoints: []EndpointAPI{},
+	}
+	for _, node := range r.cluster.State().Nodes {
+		for _, status := range node.Services {
+			wasm := status.Runtime == microservice.RuntimeWasm
+			if status.Name != name || !status.Healthy() || (status.Port == "" && !wasm) {
+				continue
+			}
+			if !constraint.Matches(status.Version) {
+				continue
+			}
+			var address string
+			switch {
+			case wasm && sockets && r.nodeSocket != "":
+				// Runs inside a node, reached through this node's router which
+				// passes the call on with the node token when it runs elsewhere
+				address = "unix://" + r.nodeSocket
+			case wasm:
+				// Runs inside the node, reached through its router
+				address = node.GRPCAddr
+			case sockets && node.Local && status.Socket != "":
+				address = "unix://" + status.Socket
+			default:
+				address = net.JoinHostPort(node.Addr, status.Port)
+			}
+			result.Endpoints = append(result.Endpoints, EndpointAPI{
+				Id:      status.Id,
+				Node:    node.Name,
+				Address: address,
+				Version: status.Version,
+				Local:   node.Local,
+				Ports:   status.Ports,
+			})
+		}
+	}
+
+	sort.SliceStable(result.Endpoints, func(i, j int) bool {
+		a, b := result.Endpoints[i], result.Endpoints[j]
+		if a.Local != b.Local {
+			return a.Local
+		}
+		return a.Node < b.Node
+	})
+	return result, nil
+}
@@ -0,0 +1,40 @@
+package discovery
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/noahdw/Gonolith/internal/httpapi"
+)
+
+type DiscoveryHandler struct {
+	resolver *Resolver
+}
+
+func NewDiscoveryHandler(resolver *Resolver) *DiscoveryHandler {
+	return &DiscoveryHandler{
+		resolver: resolver,
+	}
+}
+
+// GET /v1/discovery/{name}?version=>=1.2
+func (h *DiscoveryHandler) HandleResolve(w http.ResponseWriter, r *http.Request) {
+	result, err := h.resolver.Resolve(chi.URLParam(r, "name"), r.URL.Query().Get("version"))
+	if err != nil {
+		httpapi.WriteError(w, http.StatusBadRequest, httpapi.CodeInvalidRequest, err.Error())
+		return
+	}
+
+	httpapi.WriteJSON(w, http.StatusOK, result)
+}
+
+// GET /v1/services/{id}/capabilities, for an instance on any node
+func (h *DiscoveryHandler) HandleGetCapabilities(w http.ResponseWriter, r *http.Request) {
+	result, has := h.resolver.Capabilities(chi.URLParam(r, "id"))
+	if !has {
+		httpapi.WriteError(w, http.StatusNotFound, httpapi.CodeNotFound, "service not found")
+		return
+	}
+
+	httpapi.WriteJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,178 @@
+package discovery
+
+import (
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Answers are not cached, health can change at any moment
+const dnsTTL = 0
+
+// Priorities for SRV records, lower is preferred
+const (
+	localPriority  = 1
+	remotePriority = 10
+)
+
+// DNSServer answers <name>.service.<domain> with A, AAAA and SRV records for
+// healthy instances, and <node>.node.<domain> with the node's address so SRV
+// targets resolve. Instances on this node come first.
+type DNSServer struct {
+	resolver *Resolver
+	domain   string
+	servers  []*dns.Server
+}
+
+func NewDNSServer(resolver *Resolver, addr, domain string) *DNSServer {
+	s := &DNSServer{
+		resolver: resolver,
+		domain:   dns.Fqdn(domain),
+	}
+	mux := dns.NewServeMux()
+	mux.HandleFunc(s.domain, s.handle)
+	for _, network := range []string{"udp", "tcp"} {
+		s.servers = append(s.servers, &dns.Server{Addr: addr, Net: network, Handler: mux})
+	}
+	return s
+}
+
+func (s *DNSServer) Start() {
+	for _, server := range s.servers {
+		go func(server *dns.Server) {
+			slog.Info("DNS server starting", "addr", server.Addr, "net", server.Net, "domain", s.domain)
+			if err := server.ListenAndServe(); err != nil {
+				slog.Error("DNS server stopped", "net", server.Net, "error", err)
+			}
+		}(server)
+	}
+}
+
+func (s *DNSServer) handle(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+
+	found := false
+	for _, question := range req.Question {
+		if s.answer(resp, question) {
+			found = true
+		}
+	}
+	if !found && resp.Rcode == dns.RcodeSuccess {
+		resp.Rcode = dns.RcodeNameError
+	}
+
+	if err := w.WriteMsg(resp); err != nil {
+		slog.Warn("Cannot write DNS response", "error", err)
+	}
+}
+
+// Reports whether the name exists, even if it has no records of the asked type
+func (s *DNSServer) answer(resp *dns.Msg, question dns.Question) bool {
+	name := strings.ToLower(question.Name)
+	labels := strings.TrimSuffix(name, "."+s.domain)
+	if labels == name {
+		return false
+	}
+
+	switch {
+	case strings.HasSuffix(labels, ".service"):
+		return s.answerService(resp, question, strings.TrimSuffix(labels, ".service"))
+	case strings.HasSuffix(labels, ".node"):
+		return s.answerNode(resp, question, strings.TrimSuffix(labels, ".node"))
+	}
+	return false
+}
+
+func (s *DNSServer) answerService(resp *dns.Msg, question dns.Question, service string) bool {
+	result, err := s.resolver.ResolveTCP(service, "")
+	if err != nil {
+		resp.Rcode = dns.RcodeServerFailure
+		return false
+	}
+
+	// Instances on the same node share its address, which is listed once.
+	// SRV records tell them apart by port.
+	listed := make(map[string]bool)
+	for _, endpoint := range result.Endpoints {
+		host, portStr, err := net.SplitHostPort(endpoint.Address)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+
+		switch question.Qtype {
+		case dns.TypeA, dns.TypeAAAA, dns.TypeANY:
+			if listed[host] {
+				continue
+			}
+			listed[host] = true
+			if rr := addressRecord(question.Name, ip, question.Qtype); rr != nil {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		case dns.TypeSRV:
+			port, _ := strconv.Atoi(portStr)
+			priority := uint16(remotePriority)
+			if endpoint.Local {
+				priority = localPriority
+			}
+			target := endpoint.Node + ".node." + s.domain
+			resp.Answer = append(resp.Answer, &dns.SRV{
+				Hdr:      dns.RR_Header{Name: question.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: dnsTTL},
+				Priority: priority,
+				Weight:   1,
+				Port:     uint16(port),
+				Target:   target,
+			})
+			if listed[target] {
+				continue
+			}
+			listed[target] = true
+			if rr := addressRecord(target, ip, dns.TypeANY); rr != nil {
+				resp.Extra = append(resp.Extra, rr)
+			}
+		}
+	}
+	return len(result.Endpoints) > 0
+}
+
+func (s *DNSServer) answerNode(resp *dns.Msg, question dns.Question, node string) bool {
+	for _, state := range s.resolver.cluster.State().Nodes {
+		if strings.ToLower(state.Name) != node {
+			continue
+		}
+		if rr := addressRecord(question.Name, net.ParseIP(state.Addr), question.Qtype); rr != nil {
+			resp.Answer = append(resp.Answer, rr)
+		}
+		return true
+	}
+	return false
+}
+
+// A record for IPv4 and AAAA for IPv6, nil when the address does not fit the
+// question type
+func addressRecord(name string, ip net.IP, qtype uint16) dns.RR {
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if qtype != dns.TypeA && qtype != dns.TypeANY {
+			return nil
+		}
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: dnsTTL},
+			A:   ip4,
+		}
+	}
+	if qtype != dns.TypeAAAA && qtype != dns.TypeANY {
+		return nil
+	}
+	return &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: dnsTTL},
+		AAAA: ip,
+	}
+}
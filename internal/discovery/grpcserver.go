@@ -0,0 +1,80 @@
+package discovery
+
+import (
+	"context"
+
+	"github.com/noahdw/Gonolith/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// gRPC equivalent of the HTTP discovery API
+type GRPCServer struct {
+	api.UnimplementedDiscoveryServer
+	resolver *Resolver
+}
+
+func NewGRPCServer(resolver *Resolver) *GRPCServer {
+	return &GRPCServer{
+		resolver: resolver,
+	}
+}
+
+func (s *GRPCServer) Resolve(ctx context.Context, req *api.ResolveRequest) (*api.ResolveResponse, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+
+	result, err := s.resolver.Resolve(req.Name, req.Version)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return toProto(result), nil
+}
+
+func (s *GRPCServer) Watch(req *api.ResolveRequest, stream api.Discovery_WatchServer) error {
+	if req.Name == "" {
+		return status.Error(codes.InvalidArgument, "name is required")
+	}
+
+	changes, stop := s.resolver.cluster.Watch()
+	defer stop()
+
+	var last *api.ResolveResponse
+	for {
+		result, err := s.resolver.Resolve(req.Name, req.Version)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		resp := toProto(result)
+		if last == nil || !proto.Equal(resp, last) {
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			last = resp
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-changes:
+		}
+	}
+}
+
+func toProto(result ResolveAPI) *api.ResolveResponse {
+	resp := &api.ResolveResponse{Name: result.Name}
+	for _, endpoint := range result.Endpoints {
+		resp.Endpoints = append(resp.Endpoints, &api.Endpoint{
+			Id:      endpoint.Id,
+			Node:    endpoint.Node,
+			Address: endpoint.Address,
+			Version: endpoint.Version,
+			Local:   endpoint.Local,
+			Ports:   endpoint.Ports,
+		})
+	}
+	return resp
+}
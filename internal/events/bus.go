@@ -0,0 +1,279 @@
+// Package events is the node's pub/sub bus. Services publish to topics on
+// their node, which queues every message for each local subscription of the
+// topic and forwards it to every other node for theirs. A message stays
+// queued for a subscription until the subscriber acks it, and is delivered
+// again when the ack does not come in time, so delivery is at least once.
+// Queues are kept in memory and do not survive a restart of the node.
+package events
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/noahdw/Gonolith/api"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// How long a subscriber has to ack a message before it is sent again
+	AckTimeout = 30 * time.Second
+	// Unacked messages kept per subscription, the oldest are dropped beyond
+	MaxPending = 10000
+	// How long a durable subscription without a stream is kept
+	DetachedRetention = 10 * time.Minute
+)
+
+// Bus delivers messages to the subscriptions of this node
+type Bus struct {
+	node string
+	// Unique across restarts of the node
+	idPrefix string
+	seq      atomic.Uint64
+	// Sends messages published here to the other nodes
+	forwarder *Forwarder
+
+	mu sync.Mutex
+	// By topic, then by subscriber name
+	topics map[string]map[string]*subscription
+	// Names for subscriptions that end with their stream
+	anonymous atomic.Uint64
+}
+
+type subscription struct {
+	topic string
+	name  string
+	// Kept while no stream is attached
+	durable bool
+	// Unacked messages in the order they were published
+	pending []*delivery
+	// Current stream, nil while detached
+	stream     *attachment
+	detachedAt time.Time
+}
+
+type delivery struct {
+	msg     *api.Message
+	attempt uint32
+	// Zero until sent on the current stream
+	sentAt time.Time
+}
+
+// A stream receiving the messages of a subscription
+type attachment struct {
+	wake chan struct{}
+	done chan struct{}
+}
+
+func NewBus(node string) *Bus {
+	return &Bus{
+		node:     node,
+		idPrefix: fmt.Sprintf("%s-%x", node, time.Now().UnixNano()),
+		topics:   make(map[string]map[string]*subscription),
+	}
+}
+
+// Forward messages published on this node to the other nodes
+func (b *Bus) SetForwarder(forwarder *Forwarder) {
+	b.forwarder = forwarder
+}
+
+// Take a message for the subscribers on every node and return its id
+func (b *Bus) Publish(topic string, payload []byte, headers map[string]string) string {
+	msg := &api.Message{
+		Id:                fmt.Sprintf("%s-%d", b.idPrefix, b.seq.Add(1)),
+		Topic:             topic,
+		Payload:           payload,
+		Headers:           headers,
+		Node:              b.node,
+		PublishedUnixNano: time.Now().UnixNano(),
+	}
+	b.Deliver(msg)
+	if b.forwarder != nil {
+		b.forwarder.Forward(msg)
+	}
+	return msg.Id
+}
+
+// Queue a message for the subscriptions of this node only
+func (b *Bus) Deliver(msg *api.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.topics[msg.Topic] {
+		if len(sub.pending) >= MaxPending {
+			slog.Warn("Subscription is full, dropping oldest message",
+				"topic", sub.topic, "subscriber", sub.name, "id", sub.pending[0].msg.Id)
+			sub.pending = sub.pending[1:]
+		}
+		sub.pending = append(sub.pending, &delivery{msg: msg})
+		sub.wakeUp()
+	}
+}
+
+// Attach a stream to the subscription of subscriber to topic, creating it
+// when needed. A stream already attached to it is detached.
+func (b *Bus) attach(topic, subscriber string) (*subscription, *attachment) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	durable := subscriber != ""
+	if !durable {
+		subscriber = fmt.Sprintf("~%d", b.anonymous.Add(1))
+	}
+	if b.topics[topic] == nil {
+		b.topics[topic] = make(map[string]*subscription)
+	}
+	sub := b.topics[topic][subscriber]
+	if sub == nil {
+		sub = &subscription{topic: topic, name: subscriber, durable: durable}
+		b.topics[topic][subscriber] = sub
+		slog.Info("New subscription", "topic", topic, "subscriber", subscriber)
+	}
+
+	if sub.stream != nil {
+		close(sub.stream.done)
+	}
+	stream := &attachment{wake: make(chan struct{}, 1), done: make(chan struct{})}
+	sub.stream = stream
+	// Whatever was in flight on a previous stream goes out again
+	for _, d := range sub.pending {
+		d.sentAt = time.Time{}
+	}
+	sub.wakeUp()
+	return sub, stream
+}
+
+// End a stream. Durable subscriptions keep their messages for the next one.
+func (b *Bus) detach(sub *subscription, stream *attachment) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if sub.stream != stream {
+		// Taken over by another stream
+		return
+	}
+	close(stream.done)
+	sub.stream = nil
+	sub.detachedAt = time.Now()
+	if !sub.durable {
+		b.remove(sub)
+	}
+}
+
+func (b *Bus) remove(sub *subscription) {
+	delete(b.topics[sub.topic], sub.name)
+	if len(b.topics[sub.topic]) == 0 {
+		delete(b.topics, sub.topic)
+	}
+	if len(sub.pending) > 0 {
+		slog.Warn("Dropping unacked messages of subscription",
+			"topic", sub.topic, "subscriber", sub.name, "messages", len(sub.pending))
+	}
+}
+
+// Messages of a subscription to send on stream now: the ones never sent on
+// it and the ones whose ack is overdue
+func (b *Bus) due(sub *subscription, stream *attachment) []*api.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if sub.stream != stream {
+		return nil
+	}
+
+	var msgs []*api.Message
+	now := time.Now()
+	for _, d := range sub.pending {
+		if !d.sentAt.IsZero() && now.Sub(d.sentAt) < AckTimeout {
+			continue
+		}
+		d.sentAt = now
+		d.attempt++
+		msg := proto.Clone(d.msg).(*api.Message)
+		msg.Attempt = d.attempt
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// Forget a message the subscriber is done with
+func (b *Bus) ack(sub *subscription, id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, d := range sub.pending {
+		if d.msg.Id == id {
+			sub.pending = append(sub.pending[:i], sub.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// Redeliver overdue messages and drop durable subscriptions nobody came back
+// for, until stop is closed
+func (b *Bus) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		b.mu.Lock()
+		for _, subs := range b.topics {
+			for _, sub := range subs {
+				if sub.stream != nil {
+					sub.wakeUp()
+				} else if time.Since(sub.detachedAt) > DetachedRetention {
+					slog.Info("Removing abandoned subscription", "topic", sub.topic, "subscriber", sub.name)
+					b.remove(sub)
+				}
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Status of the subscriptions on this node
+type SubscriptionAPI struct {
+	Topic      string `json:"topic"`
+	Subscriber string `json:"subscriber"`
+	Attached   bool   `json:"attached"`
+	Pending    int    `json:"pending"`
+}
+
+func (b *Bus) Subscriptions() []SubscriptionAPI {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subscriptions := []SubscriptionAPI{}
+	for _, subs := range b.topics {
+		for _, sub := range subs {
+			subscriptions = append(subscriptions, SubscriptionAPI{
+				Topic:      sub.topic,
+				Subscriber: sub.name,
+				Attached:   sub.stream != nil,
+				Pending:    len(sub.pending),
+			})
+		}
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		a, b := subscriptions[i], subscriptions[j]
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.Subscriber < b.Subscriber
+	})
+	return subscriptions
+}
+
+func (sub *subscription) wakeUp() {
+	if sub.stream == nil {
+		return
+	}
+	select {
+	case sub.stream.wake <- struct{}{}:
+	default:
+	}
+}
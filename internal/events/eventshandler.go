@@ -0,0 +1,23 @@
+package events
+
+import (
+	"net/http"
+
+	"github.com/noahdw/Gonolith/internal/httpapi"
+)
+
+type EventsHandler struct {
+	bus *Bus
+}
+
+func NewEventsHandler(bus *Bus) *EventsHandler {
+	return &EventsHandler{
+		bus: bus,
+	}
+}
+
+// GET /v1/events/subscriptions, the subscriptions on this node and how many
+// messages they have not acked
+func (h *EventsHandler) HandleGetSubscriptions(w http.ResponseWriter, r *http.Request) {
+	httpapi.WriteJSON(w, http.StatusOK, h.bus.Subscriptions())
+}
@@ -0,0 +1,230 @@
+package events
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/noahdw/Gonolith/api"
+	"github.com/noahdw/Gonolith/internal/auth"
+	"github.com/noahdw/Gonolith/internal/cluster"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// How long to wait before connecting to a node again
+const reconnectDelay = time.Second
+
+// Forwarder keeps a Forward stream to every other node and resends whatever
+// a node did not ack when its stream breaks
+type Forwarder struct {
+	cluster   *cluster.Cluster
+	nodeToken string
+
+	mu    sync.Mutex
+	peers map[string]*peer
+}
+
+// Messages on their way to one node
+type peer struct {
+	name string
+
+	mu    sync.Mutex
+	queue []*outbound
+	wake  chan struct{}
+	stop  chan struct{}
+}
+
+type outbound struct {
+	msg *api.Message
+	// Sent on the current stream
+	sent bool
+}
+
+func NewForwarder(c *cluster.Cluster) *Forwarder {
+	return &Forwarder{
+		cluster: c,
+		peers:   make(map[string]*peer),
+	}
+}
+
+// Token streams to other nodes authenticate with
+func (f *Forwarder) SetNodeToken(token string) {
+	f.nodeToken = token
+}
+
+// Queue a message for every other node in the cluster
+func (f *Forwarder) Forward(msg *api.Message) {
+	for _, node := range f.cluster.State().Nodes {
+		if node.Local {
+			continue
+		}
+		p := f.peer(node.Name)
+		p.mu.Lock()
+		if len(p.queue) >= MaxPending {
+			slog.Warn("Forward queue is full, dropping oldest message", "node", p.name, "id", p.queue[0].msg.Id)
+			p.queue = p.queue[1:]
+		}
+		p.queue = append(p.queue, &outbound{msg: msg})
+		p.mu.Unlock()
+		p.wakeUp()
+	}
+}
+
+func (f *Forwarder) peer(name string) *peer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := f.peers[name]
+	if p == nil {
+		p = &peer{
+			name: name,
+			wake: make(chan struct{}, 1),
+			stop: make(chan struct{}),
+		}
+		f.peers[name] = p
+		go f.run(p)
+	}
+	return p
+}
+
+// Drop the queues of nodes that left the cluster, until stop is closed
+func (f *Forwarder) Run(stop <-chan struct{}) {
+	changes, unwatch := f.cluster.Watch()
+	defer unwatch()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-changes:
+		}
+
+		members := make(map[string]bool)
+		for _, node := range f.cluster.State().Nodes {
+			members[node.Name] = true
+		}
+		f.mu.Lock()
+		for name, p := range f.peers {
+			if members[name] {
+				continue
+			}
+			p.mu.Lock()
+			if len(p.queue) > 0 {
+				slog.Warn("Node left, dropping messages for it", "node", name, "messages", len(p.queue))
+			}
+			p.mu.Unlock()
+			close(p.stop)
+			delete(f.peers, name)
+		}
+		f.mu.Unlock()
+	}
+}
+
+// Connect to the node and stream its queue, again and again until it leaves
+func (f *Forwarder) run(p *peer) {
+	for {
+		if err := f.stream(p); err != nil {
+			slog.Warn("Forwarding events failed, reconnecting", "node", p.name, "error", err)
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func (f *Forwarder) stream(p *peer) error {
+	addr := f.addr(p.name)
+	if addr == "" {
+		return nil
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()), auth.WithToken(f.nodeToken))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := api.NewEventsClient(conn).Forward(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Everything unacked goes out on the new stream
+	p.mu.Lock()
+	for _, out := range p.queue {
+		out.sent = false
+	}
+	p.mu.Unlock()
+	p.wakeUp()
+
+	acks := make(chan error, 1)
+	go func() {
+		for {
+			ack, err := stream.Recv()
+			if err != nil {
+				acks <- err
+				return
+			}
+			p.acked(ack.MessageId)
+		}
+	}()
+
+	for {
+		select {
+		case <-p.stop:
+			return nil
+		case err := <-acks:
+			return err
+		case <-p.wake:
+		}
+
+		for _, msg := range p.unsent() {
+			if err := stream.Send(&api.ForwardRequest{Message: msg}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (f *Forwarder) addr(name string) string {
+	for _, node := range f.cluster.State().Nodes {
+		if node.Name == name {
+			return node.GRPCAddr
+		}
+	}
+	return ""
+}
+
+func (p *peer) unsent() []*api.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var msgs []*api.Message
+	for _, out := range p.queue {
+		if !out.sent {
+			out.sent = true
+			msgs = append(msgs, out.msg)
+		}
+	}
+	return msgs
+}
+
+func (p *peer) acked(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, out := range p.queue {
+		if out.msg.Id == id {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *peer) wakeUp() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
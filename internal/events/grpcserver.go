@@ -0,0 +1,91 @@
+package events
+
+import (
+	"context"
+
+	"github.com/noahdw/Gonolith/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Serves the bus to services and to the other nodes
+type GRPCServer struct {
+	api.UnimplementedEventsServer
+	bus *Bus
+}
+
+func NewGRPCServer(bus *Bus) *GRPCServer {
+	return &GRPCServer{
+		bus: bus,
+	}
+}
+
+func (s *GRPCServer) Publish(ctx context.Context, req *api.PublishRequest) (*api.PublishResponse, error) {
+	if req.Topic == "" {
+		return nil, status.Error(codes.InvalidArgument, "topic is required")
+	}
+	id := s.bus.Publish(req.Topic, req.Payload, req.Headers)
+	return &api.PublishResponse{MessageId: id}, nil
+}
+
+func (s *GRPCServer) Subscribe(stream api.Events_SubscribeServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	subscription := first.GetSubscription()
+	if subscription == nil || subscription.Topic == "" {
+		return status.Error(codes.InvalidArgument, "the first request must be a subscription with a topic")
+	}
+
+	sub, attached := s.bus.attach(subscription.Topic, subscription.Subscriber)
+	defer s.bus.detach(sub, attached)
+
+	received := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				received <- err
+				return
+			}
+			if ack := req.GetAck(); ack != nil {
+				s.bus.ack(sub, ack.MessageId)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-received:
+			return nil
+		case <-attached.done:
+			return status.Error(codes.Aborted, "subscription was taken over by another stream")
+		case <-attached.wake:
+		}
+
+		for _, msg := range s.bus.due(sub, attached) {
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *GRPCServer) Forward(stream api.Events_ForwardServer) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+		if req.Message == nil {
+			continue
+		}
+		s.bus.Deliver(req.Message)
+		if err := stream.Send(&api.ForwardAck{MessageId: req.Message.Id}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Package httpapi holds what the HTTP handlers of a node share: JSON bodies
+// and the error format every endpoint answers with.
+package httpapi
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// Prefix of every route of the node's HTTP API
+const Version = "/v1"
+
+// Codes shared by every endpoint, packages add their own for errors only
+// they return
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeUnavailable      = "unavailable"
+	CodeInternal         = "internal"
+)
+
+// Body of every error response
+type ErrorResponseAPI struct {
+	Error ErrorAPI `json:"error"`
+}
+
+type ErrorAPI struct {
+	// Stable, machine readable, e.g. "service_not_found"
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func WriteJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Warn("Cannot write response", "error", err)
+	}
+}
+
+// For changes that have nothing to tell the caller
+func WriteNoContent(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func WriteError(w http.ResponseWriter, status int, code, message string) {
+	if status >= http.StatusInternalServerError {
+		slog.Error("Request failed", "status", status, "code", code, "message", message)
+	}
+	WriteJSON(w, status, ErrorResponseAPI{Error: ErrorAPI{Code: code, Message: message}})
+}
+
+// For routes that do not exist
+func HandleNotFound(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, http.StatusNotFound, CodeNotFound, "no route for "+r.URL.Path)
+}
+
+func HandleMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+}
@@ -0,0 +1,97 @@
+package kv
+
+import (
+	"context"
+	"errors"
+
+	"github.com/noahdw/Gonolith/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC equivalent of the HTTP key/value API
+type GRPCServer struct {
+	api.UnimplementedKVServer
+	store *Store
+}
+
+func NewGRPCServer(store *Store) *GRPCServer {
+	return &GRPCServer{
+		store: store,
+	}
+}
+
+func (s *GRPCServer) Get(ctx context.Context, req *api.GetKeyRequest) (*api.KeyValue, error) {
+	entry, err := s.store.Get(req.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProto(entry), nil
+}
+
+func (s *GRPCServer) List(ctx context.Context, req *api.ListKeysRequest) (*api.ListKeysResponse, error) {
+	resp := &api.ListKeysResponse{}
+	for _, entry := range s.store.List(req.Prefix) {
+		resp.Entries = append(resp.Entries, toProto(entry))
+	}
+	return resp, nil
+}
+
+func (s *GRPCServer) Put(ctx context.Context, req *api.PutKeyRequest) (*api.KeyValue, error) {
+	entry, err := s.store.Put(req.Key, req.Value)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProto(entry), nil
+}
+
+func (s *GRPCServer) Delete(ctx context.Context, req *api.DeleteKeyRequest) (*api.DeleteKeyResponse, error) {
+	if err := s.store.Delete(req.Key); err != nil {
+		return nil, toStatus(err)
+	}
+	return &api.DeleteKeyResponse{}, nil
+}
+
+func (s *GRPCServer) Watch(req *api.WatchKeysRequest, stream api.KV_WatchServer) error {
+	events, stop := s.store.Watch(req.Prefix)
+	defer stop()
+
+	if req.IncludeCurrent {
+		for _, entry := range s.store.List(req.Prefix) {
+			if err := stream.Send(&api.KeyEvent{Type: EventPut, Entry: toProto(entry)}); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "watcher fell behind, watch again")
+			}
+			if err := stream.Send(&api.KeyEvent{Type: event.Type, Entry: toProto(event.Entry)}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func toProto(entry Entry) *api.KeyValue {
+	return &api.KeyValue{
+		Key:             entry.Key,
+		Value:           entry.Value,
+		Version:         entry.Version,
+		Node:            entry.Node,
+		UpdatedUnixNano: entry.UpdatedAt.UnixNano(),
+	}
+}
+
+func toStatus(err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
@@ -0,0 +1,113 @@
+package kv
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/noahdw/Gonolith/internal/httpapi"
+)
+
+// Error code for keys that do not exist
+const CodeKeyNotFound = "key_not_found"
+
+type KVHandler struct {
+	store *Store
+}
+
+func NewKVHandler(store *Store) *KVHandler {
+	return &KVHandler{
+		store: store,
+	}
+}
+
+// GET /v1/kv?prefix=flags/ lists entries. With watch=true the response instead
+// streams every change under the prefix as a JSON line until the client
+// goes away.
+func (h *KVHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if r.URL.Query().Get("watch") == "true" {
+		h.watch(w, r, prefix)
+		return
+	}
+
+	httpapi.WriteJSON(w, http.StatusOK, h.store.List(prefix))
+}
+
+func (h *KVHandler) watch(w http.ResponseWriter, r *http.Request, prefix string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpapi.WriteError(w, http.StatusInternalServerError, httpapi.CodeInternal, "streaming is not supported")
+		return
+	}
+	events, stop := h.store.Watch(prefix)
+	defer stop()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if encoder.Encode(event) != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// GET /v1/kv/{key}
+func (h *KVHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	entry, err := h.store.Get(chi.URLParam(r, "*"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	httpapi.WriteJSON(w, http.StatusOK, entry)
+}
+
+// PUT /v1/kv/{key} with the value as the body
+func (h *KVHandler) HandlePut(w http.ResponseWriter, r *http.Request) {
+	raw, err := io.ReadAll(io.LimitReader(r.Body, MaxValueLength+1))
+	defer r.Body.Close()
+	if err != nil {
+		httpapi.WriteError(w, http.StatusBadRequest, httpapi.CodeInvalidRequest, "cannot read value: "+err.Error())
+		return
+	}
+
+	entry, err := h.store.Put(chi.URLParam(r, "*"), string(raw))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	httpapi.WriteJSON(w, http.StatusOK, entry)
+}
+
+// DELETE /v1/kv/{key}
+func (h *KVHandler) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	if err := h.store.Delete(chi.URLParam(r, "*")); err != nil {
+		writeError(w, err)
+		return
+	}
+	httpapi.WriteNoContent(w)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotFound) {
+		httpapi.WriteError(w, http.StatusNotFound, CodeKeyNotFound, err.Error())
+		return
+	}
+	httpapi.WriteError(w, http.StatusBadRequest, httpapi.CodeInvalidRequest, err.Error())
+}
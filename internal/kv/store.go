@@ -0,0 +1,315 @@
+// Package kv is a small key/value store for runtime config and feature
+// flags, held by every node. Writes go to any node, which applies them and
+// gossips them to the rest of the cluster. Every entry carries a logical
+// version and the newest version of a key wins everywhere, so nodes converge
+// on the same values without a leader. Reads are local and may briefly lag a
+// write made on another node.
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MaxKeyLength   = 256
+	MaxValueLength = 64 * 1024
+)
+
+var ErrNotFound = errors.New("key not found")
+
+// Deletes are dropped once they are older than this and every other node
+// synced its state with them. A node that was away for longer may bring a
+// deleted key back.
+const TombstoneTTL = time.Hour
+
+// Kinds of changes
+const (
+	EventPut    = "put"
+	EventDelete = "delete"
+)
+
+// Entry is one key with the write that set it last
+type Entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Logical clock of the write, higher wins
+	Version uint64 `json:"version"`
+	// Node the write was made on, breaks ties between equal versions
+	Node      string    `json:"node"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Deletes are kept so they replicate like any other write
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// Which write of a key a node holds, without its value
+type Version struct {
+	Version uint64 `json:"v"`
+	Node    string `json:"n,omitempty"`
+	Deleted bool   `json:"d,omitempty"`
+}
+
+// The writes a node holds by key, deletes included. Nodes exchange digests
+// and send each other only the entries the other side is missing.
+type Digest map[string]Version
+
+type EventAPI struct {
+	Type  string `json:"type"`
+	Entry Entry  `json:"entry"`
+}
+
+type Store struct {
+	node string
+
+	mu      sync.RWMutex
+	entries map[string]Entry
+	// Highest version seen, the next local write goes above it
+	clock    uint64
+	watchers map[*watcher]struct{}
+	// Deleted keys by the nodes whose state holds no older value for them
+	seenBy map[string]map[string]struct{}
+	// Called with writes made on this node so they can be replicated
+	onWrite func(Entry)
+}
+
+type watcher struct {
+	prefix string
+	events chan EventAPI
+}
+
+func NewStore(node string) *Store {
+	return &Store{
+		node:     node,
+		entries:  make(map[string]Entry),
+		watchers: make(map[*watcher]struct{}),
+		seenBy:   make(map[string]map[string]struct{}),
+	}
+}
+
+func (s *Store) SetOnWrite(onWrite func(Entry)) {
+	s.onWrite = onWrite
+}
+
+func (s *Store) Get(key string) (Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, has := s.entries[key]
+	if !has || entry.Deleted {
+		return Entry{}, ErrNotFound
+	}
+	return entry, nil
+}
+
+// Live entries whose keys start with prefix, sorted by key
+func (s *Store) List(prefix string) []Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := []Entry{}
+	for key, entry := range s.entries {
+		if strings.HasPrefix(key, prefix) && !entry.Deleted {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+func (s *Store) Put(key, value string) (Entry, error) {
+	if err := validate(key, value); err != nil {
+		return Entry{}, err
+	}
+	return s.write(Entry{Key: key, Value: value})
+}
+
+func (s *Store) Delete(key string) error {
+	_, err := s.write(Entry{Key: key, Deleted: true})
+	return err
+}
+
+// Deletes fail for keys that are not set when they get here
+func (s *Store) write(entry Entry) (Entry, error) {
+	s.mu.Lock()
+	if current, has := s.entries[entry.Key]; entry.Deleted && (!has || current.Deleted) {
+		s.mu.Unlock()
+		return Entry{}, ErrNotFound
+	}
+	s.clock++
+	entry.Version = s.clock
+	entry.Node = s.node
+	entry.UpdatedAt = time.Now().UTC()
+	s.apply(entry)
+	s.mu.Unlock()
+
+	if s.onWrite != nil {
+		s.onWrite(entry)
+	}
+	return entry, nil
+}
+
+// Take the entries of another node that are newer than ours. Returns
+// whether anything changed.
+func (s *Store) Merge(entries []Entry) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for _, entry := range entries {
+		s.clock = max(s.clock, entry.Version)
+		if current, has := s.entries[entry.Key]; has && !newer(entry, current) {
+			continue
+		}
+		s.apply(entry)
+		changed = true
+	}
+	return changed
+}
+
+// Record that node synced its whole state, summed up by digest, with this
+// node. Deletes it holds no live value for are safe to drop as far as it is
+// concerned.
+func (s *Store) Seen(node string, digest Digest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.entries {
+		if !entry.Deleted {
+			continue
+		}
+		if other, has := digest[key]; has && !other.Deleted {
+			continue
+		}
+		if s.seenBy[key] == nil {
+			s.seenBy[key] = make(map[string]struct{})
+		}
+		s.seenBy[key][node] = struct{}{}
+	}
+}
+
+// Drop deletes older than TombstoneTTL that every node in peers has seen.
+// Returns how many were dropped.
+func (s *Store) PurgeTombstones(peers []string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged := 0
+	for key, entry := range s.entries {
+		if !entry.Deleted || time.Since(entry.UpdatedAt) < TombstoneTTL {
+			continue
+		}
+		seen := true
+		for _, peer := range peers {
+			if _, has := s.seenBy[key][peer]; !has {
+				seen = false
+				break
+			}
+		}
+		if seen {
+			delete(s.entries, key)
+			delete(s.seenBy, key)
+			purged++
+		}
+	}
+	return purged
+}
+
+// What this node holds, for another node to compare with its own entries
+func (s *Store) Digest() Digest {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	digest := make(Digest, len(s.entries))
+	for key, entry := range s.entries {
+		digest[key] = Version{Version: entry.Version, Node: entry.Node, Deleted: entry.Deleted}
+	}
+	return digest
+}
+
+// Entries the node that sent digest does not have or holds an older write of
+func (s *Store) Missing(digest Digest) []Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var missing []Entry
+	for key, entry := range s.entries {
+		other, has := digest[key]
+		if !has || newer(entry, Entry{Version: other.Version, Node: other.Node}) {
+			missing = append(missing, entry)
+		}
+	}
+	return missing
+}
+
+// Every entry including deletes, for replication
+func (s *Store) Entries() []Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries := make([]Entry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Receive changes of keys starting with prefix until the returned func is
+// called
+func (s *Store) Watch(prefix string) (<-chan EventAPI, func()) {
+	w := &watcher{prefix: prefix, events: make(chan EventAPI, 64)}
+	s.mu.Lock()
+	s.watchers[w] = struct{}{}
+	s.mu.Unlock()
+
+	return w.events, func() {
+		s.mu.Lock()
+		delete(s.watchers, w)
+		s.mu.Unlock()
+	}
+}
+
+// Store an entry and tell watchers, with mu held
+func (s *Store) apply(entry Entry) {
+	previous, existed := s.entries[entry.Key]
+	s.entries[entry.Key] = entry
+	// Nodes have to see the new version again
+	delete(s.seenBy, entry.Key)
+	if entry.Deleted && (!existed || previous.Deleted) {
+		// Nothing that watchers saw went away
+		return
+	}
+
+	event := EventAPI{Type: EventPut, Entry: entry}
+	if entry.Deleted {
+		event.Type = EventDelete
+	}
+	for w := range s.watchers {
+		if !strings.HasPrefix(entry.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			// A watcher this far behind resyncs from List when it reconnects
+			close(w.events)
+			delete(s.watchers, w)
+		}
+	}
+}
+
+func newer(a, b Entry) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+	return a.Node > b.Node
+}
+
+func validate(key, value string) error {
+	switch {
+	case key == "":
+		return errors.New("key is required")
+	case len(key) > MaxKeyLength:
+		return fmt.Errorf("key is longer than %d bytes", MaxKeyLength)
+	case len(value) > MaxValueLength:
+		return fmt.Errorf("value is longer than %d bytes", MaxValueLength)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package kv
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"testing"
+)
+
+// Live keys and their values
+func contents(s *Store) map[string]string {
+	values := make(map[string]string)
+	for _, entry := range s.List("") {
+		values[entry.Key] = entry.Value
+	}
+	return values
+}
+
+func sortedEntries(s *Store) []Entry {
+	entries := s.Entries()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+func put(t *testing.T, s *Store, key, value string) {
+	t.Helper()
+	if _, err := s.Put(key, value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Bring a up to date with b the way nodes do: a gets what it is missing from b's point of
+// view
+func pull(a, b *Store) {
+	a.Merge(b.Missing(a.Digest()))
+}
+
+// Two nodes that wrote and deleted the same keys without hearing from each
+// other, so both writes of a key carry the same version
+func concurrentStores(t *testing.T) (*Store, *Store) {
+	t.Helper()
+	a, b := NewStore("a"), NewStore("b")
+	put(t, a, "shared", "from a")
+	put(t, b, "shared", "from b")
+
+	put(t, a, "deleted-on-a", "1")
+	put(t, b, "deleted-on-a", "2")
+	if err := a.Delete("deleted-on-a"); err != nil {
+		t.Fatal(err)
+	}
+	put(t, b, "only-b", "b")
+	put(t, a, "only-a", "a")
+	if err := b.Delete("only-b"); err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func TestMergeConverges(t *testing.T) {
+	want := map[string]string{"shared": "from b", "only-a": "a"}
+
+	for _, order := range []string{"a first", "b first"} {
+		t.Run(order, func(t *testing.T) {
+			a, b := concurrentStores(t)
+			if order == "a first" {
+				pull(b, a)
+				pull(a, b)
+			} else {
+				pull(a, b)
+				pull(b, a)
+			}
+
+			for name, s := range map[string]*Store{"a": a, "b": b} {
+				if got := contents(s); !maps.Equal(got, want) {
+					t.Errorf("%s holds %v, want %v", name, got, want)
+				}
+			}
+			if !slices.Equal(sortedEntries(a), sortedEntries(b)) {
+				t.Errorf("entries differ:\n%v\n%v", sortedEntries(a), sortedEntries(b))
+			}
+		})
+	}
+}
+
+func TestMergeKeepsNewerWrites(t *testing.T) {
+	a, b := NewStore("a"), NewStore("b")
+	put(t, a, "k", "old")
+	pull(b, a)
+	put(t, b, "k", "new")
+
+	// The old write arriving again does not undo the new one
+	if b.Merge(a.Entries()) {
+		t.Fatal("merging an older write changed the store")
+	}
+	pull(a, b)
+	if got := contents(a)["k"]; got != "new" {
+		t.Fatalf("a holds %q, want new", got)
+	}
+	// Writes after a merge go above everything seen
+	put(t, a, "k", "newest")
+	pull(b, a)
+	if got := contents(b)["k"]; got != "newest" {
+		t.Fatalf("b holds %q, want newest", got)
+	}
+}
+
+func TestMissing(t *testing.T) {
+	a, b := NewStore("a"), NewStore("b")
+	put(t, a, "same", "1")
+	pull(b, a)
+	put(t, a, "newer-on-a", "1")
+	pull(b, a)
+	put(t, a, "newer-on-a", "2")
+	put(t, b, "only-b", "1")
+
+	var keys []string
+	for _, entry := range a.Missing(b.Digest()) {
+		keys = append(keys, entry.Key)
+	}
+	sort.Strings(keys)
+	if want := []string{"newer-on-a"}; !slices.Equal(keys, want) {
+		t.Fatalf("b is missing %v, want %v", keys, want)
+	}
+}
+
+// Make the deletes of s old enough to be purged
+func age(s *Store) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.entries {
+		entry.UpdatedAt = entry.UpdatedAt.Add(-TombstoneTTL)
+		s.entries[key] = entry
+	}
+}
+
+func TestPurgeTombstones(t *testing.T) {
+	a, b, c := NewStore("a"), NewStore("b"), NewStore("c")
+	put(t, a, "k", "v")
+	pull(b, a)
+	pull(c, a)
+	if err := a.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	peers := []string{"b", "c"}
+
+	if purged := a.PurgeTombstones(peers); purged != 0 {
+		t.Fatal("purged a delete younger than TombstoneTTL")
+	}
+	age(a)
+
+	// c still holds the value
+	pull(b, a)
+	a.Seen("b", b.Digest())
+	a.Seen("c", c.Digest())
+	if purged := a.PurgeTombstones(peers); purged != 0 {
+		t.Fatal("purged a delete c has not seen")
+	}
+
+	pull(c, a)
+	a.Seen("c", c.Digest())
+	if purged := a.PurgeTombstones(peers); purged != 1 {
+		t.Fatalf("purged %d deletes, want 1", purged)
+	}
+	if len(a.Entries()) != 0 {
+		t.Fatalf("a still holds %v", a.Entries())
+	}
+}
+
+func TestPurgeWaitsForNewWrites(t *testing.T) {
+	a, b := NewStore("a"), NewStore("b")
+	put(t, a, "k", "v")
+	if err := a.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	age(a)
+	a.Seen("b", b.Digest())
+
+	// A newer delete of the key needs to be seen again
+	put(t, a, "k", "again")
+	if err := a.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	age(a)
+	if purged := a.PurgeTombstones([]string{"b"}); purged != 0 {
+		t.Fatal("purged a delete b has not seen")
+	}
+}
@@ -0,0 +1,194 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/noahdw/Gonolith/internal/semver"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// Manifest describes the whole distributed monolith: which services run,
+// at what version, how many copies and where.
+type Manifest struct {
+	NodeGroups []NodeGroup `toml:"node_group"`
+	Services   []Service   `toml:"service"`
+
+	// Directory of the manifest file, packages are resolved relative to it
+	dir string
+	raw []byte
+}
+
+type NodeGroup struct {
+	Name  string   `toml:"name"`
+	Nodes []string `toml:"nodes"`
+}
+
+type Service struct {
+	Name      string `toml:"name"`
+	Version   string `toml:"version"`
+	Package   string `toml:"package"`
+	Replicas  int    `toml:"replicas"`
+	NodeGroup string `toml:"node_group"`
+	// Services to start first, optionally with a version constraint, e.g.
+	// "auth>=1.2"
+	Requires []string `toml:"requires"`
+}
+
+func Load(path string) (*Manifest, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	m.dir = filepath.Dir(absPath)
+	return m, nil
+}
+
+// Parse and validate a manifest that is not tied to a file on disk, packages
+// are then resolved relative to the working directory
+func Parse(raw []byte) (*Manifest, error) {
+	var m Manifest
+	if err := toml.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+
+	for i := range m.Services {
+		if m.Services[i].Replicas == 0 {
+			m.Services[i].Replicas = 1
+		}
+	}
+
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	m.raw = raw
+	return &m, nil
+}
+
+func (m *Manifest) Validate() error {
+	groups := make(map[string]bool)
+	for _, group := range m.NodeGroups {
+		if group.Name == "" {
+			return fmt.Errorf("node group without a name")
+		}
+		if groups[group.Name] {
+			return fmt.Errorf("node group %s declared twice", group.Name)
+		}
+		groups[group.Name] = true
+	}
+
+	services := make(map[string]string)
+	for _, service := range m.Services {
+		switch {
+		case service.Name == "":
+			return fmt.Errorf("service without a name")
+		case service.Version == "":
+			return fmt.Errorf("service %s has no version", service.Name)
+		case service.Package == "":
+			return fmt.Errorf("service %s has no package", service.Name)
+		case service.Replicas < 0:
+			return fmt.Errorf("service %s has negative replicas", service.Name)
+		case service.NodeGroup != "" && !groups[service.NodeGroup]:
+			return fmt.Errorf("service %s uses unknown node group %s", service.Name, service.NodeGroup)
+		}
+		if _, has := services[service.Name]; has {
+			return fmt.Errorf("service %s declared twice", service.Name)
+		}
+		services[service.Name] = service.Version
+	}
+
+	for _, service := range m.Services {
+		for _, raw := range service.Requires {
+			req, err := semver.ParseRequirement(raw)
+			if err != nil {
+				return fmt.Errorf("service %s: %w", service.Name, err)
+			}
+			version, has := services[req.Name]
+			if !has {
+				return fmt.Errorf("service %s requires undeclared service %s", service.Name, req.Name)
+			}
+			if !req.Constraint.Matches(version) {
+				return fmt.Errorf("service %s requires %s but version %s is declared", service.Name, req, version)
+			}
+		}
+	}
+
+	_, err := m.StartOrder()
+	return err
+}
+
+// The manifest as it was written, used to hand it to the control plane
+func (m *Manifest) Raw() []byte {
+	return m.raw
+}
+
+func (m *Manifest) Group(name string) (NodeGroup, bool) {
+	for _, group := range m.NodeGroups {
+		if group.Name == name {
+			return group, true
+		}
+	}
+	return NodeGroup{}, false
+}
+
+func (m *Manifest) PackagePath(service Service) string {
+	if filepath.IsAbs(service.Package) {
+		return service.Package
+	}
+	return filepath.Join(m.dir, service.Package)
+}
+
+// Services ordered so that every service comes after the services it requires
+func (m *Manifest) StartOrder() ([]Service, error) {
+	byName := make(map[string]Service, len(m.Services))
+	for _, service := range m.Services {
+		byName[service.Name] = service
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int, len(m.Services))
+	order := make([]Service, 0, len(m.Services))
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle: %v", append(path, name))
+		}
+		state[name] = visiting
+		for _, raw := range byName[name].Requires {
+			// Validate made sure requirements parse
+			dep, _ := semver.ParseRequirement(raw)
+			if err := visit(dep.Name, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		order = append(order, byName[name])
+		return nil
+	}
+
+	for _, service := range m.Services {
+		if err := visit(service.Name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
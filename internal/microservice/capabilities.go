@@ -0,0 +1,155 @@
+package microservice
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Optional FileDescriptorSet in a service package, used when the service does
+// not serve gRPC reflection
+const descriptorSetFile = "descriptors.pb"
+
+// A gRPC service an instance exposes and its methods
+type CapabilityAPI struct {
+	Service string   `json:"service"`
+	Methods []string `json:"methods"`
+}
+
+// Health checks and reflection itself are not something to route to
+func infrastructureService(name string) bool {
+	return strings.HasPrefix(name, "grpc.health.") || strings.HasPrefix(name, "grpc.reflection.")
+}
+
+// Ask a running service what it exposes. Falls back to the bundled descriptor
+// set when the service has no reflection, and reports an error only when it is
+// worth asking again later.
+func loadCapabilities(service *Microservice) ([]CapabilityAPI, error) {
+	if service.config.Port == "" {
+		// Nothing to ask, e.g. WebAssembly services the node serves itself
+		return descriptorSetCapabilities(service.descriptors)
+	}
+
+	conn, err := grpc.NewClient("localhost:"+service.config.Port, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	capabilities, err := reflectCapabilities(ctx, conn)
+	if status.Code(err) == codes.Unimplemented {
+		return descriptorSetCapabilities(service.descriptors)
+	}
+	return capabilities, err
+}
+
+func reflectCapabilities(ctx context.Context, conn *grpc.ClientConn) ([]CapabilityAPI, error) {
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CloseSend()
+
+	resp, err := reflectionRequest(stream, &reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var capabilities []CapabilityAPI
+	for _, svc := range resp.GetListServicesResponse().GetService() {
+		if infrastructureService(svc.Name) {
+			continue
+		}
+
+		resp, err := reflectionRequest(stream, &reflectionpb.ServerReflectionRequest{
+			MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: svc.Name},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var files []*descriptorpb.FileDescriptorProto
+		for _, raw := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			file := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(raw, file); err != nil {
+				return nil, fmt.Errorf("invalid descriptor for %s: %w", svc.Name, err)
+			}
+			files = append(files, file)
+		}
+		for _, capability := range servicesIn(files) {
+			if capability.Service == svc.Name {
+				capabilities = append(capabilities, capability)
+			}
+		}
+	}
+	return sortCapabilities(capabilities), nil
+}
+
+func reflectionRequest(stream reflectionpb.ServerReflection_ServerReflectionInfoClient, req *reflectionpb.ServerReflectionRequest) (*reflectionpb.ServerReflectionResponse, error) {
+	if err := stream.Send(req); err != nil {
+		return nil, err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if errResp := resp.GetErrorResponse(); errResp != nil {
+		return nil, status.Error(codes.Code(errResp.ErrorCode), errResp.ErrorMessage)
+	}
+	return resp, nil
+}
+
+// Every service in a serialized FileDescriptorSet, none when there is no set
+func descriptorSetCapabilities(raw []byte) ([]CapabilityAPI, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(raw, set); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", descriptorSetFile, err)
+	}
+	return sortCapabilities(servicesIn(set.File)), nil
+}
+
+func servicesIn(files []*descriptorpb.FileDescriptorProto) []CapabilityAPI {
+	var capabilities []CapabilityAPI
+	for _, file := range files {
+		for _, svc := range file.Service {
+			name := svc.GetName()
+			if file.GetPackage() != "" {
+				name = file.GetPackage() + "." + name
+			}
+			if infrastructureService(name) {
+				continue
+			}
+			capability := CapabilityAPI{Service: name, Methods: []string{}}
+			for _, method := range svc.Method {
+				capability.Methods = append(capability.Methods, method.GetName())
+			}
+			capabilities = append(capabilities, capability)
+		}
+	}
+	return capabilities
+}
+
+func sortCapabilities(capabilities []CapabilityAPI) []CapabilityAPI {
+	sort.Slice(capabilities, func(i, j int) bool {
+		return capabilities[i].Service < capabilities[j].Service
+	})
+	return capabilities
+}
@@ -0,0 +1,154 @@
+package microservice
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/noahdw/Gonolith/internal/semver"
+)
+
+// Installed or started, but held back until what it requires is ready
+const StatusWaiting = "waiting-for-dependencies"
+
+var ErrDependencyCycle = errors.New("dependency cycle")
+
+// Every instance in the cluster, used to check requirements. Only this node's
+// services are known until a catalog is set.
+func (s *Microservices) catalog() []MicroserviceStatusAPI {
+	if s.catalogFn != nil {
+		return s.catalogFn()
+	}
+	return s.GetAllStatuses().Services
+}
+
+// Source of the cluster wide view of services, set before installing services
+func (s *Microservices) SetCatalog(catalog func() []MicroserviceStatusAPI) {
+	s.catalogFn = catalog
+}
+
+func parseRequires(requires []string) ([]semver.Requirement, error) {
+	reqs := make([]semver.Requirement, 0, len(requires))
+	for _, raw := range requires {
+		req, err := semver.ParseRequirement(raw)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// Reject a service whose requirements lead back to itself through the
+// requirements of services already in the cluster
+func (s *Microservices) checkCycle(name string, requires []semver.Requirement) error {
+	graph := make(map[string][]string)
+	for _, instance := range s.catalog() {
+		reqs, err := parseRequires(instance.Requires)
+		if err != nil {
+			continue
+		}
+		for _, req := range reqs {
+			if !slices.Contains(graph[instance.Name], req.Name) {
+				graph[instance.Name] = append(graph[instance.Name], req.Name)
+			}
+		}
+	}
+	for _, req := range requires {
+		graph[name] = append(graph[name], req.Name)
+	}
+
+	visited := make(map[string]bool)
+	var visit func(current string, path []string) error
+	visit = func(current string, path []string) error {
+		for _, dep := range graph[current] {
+			if dep == name {
+				return fmt.Errorf("%w: %v", ErrDependencyCycle, append(path, dep))
+			}
+			if visited[dep] {
+				continue
+			}
+			visited[dep] = true
+			if err := visit(dep, append(path, dep)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return visit(name, []string{name})
+}
+
+// Requirements that no healthy instance anywhere in the cluster satisfies
+func (s *Microservices) missingDependencies(service *Microservice) []string {
+	reqs, _ := parseRequires(service.config.Requires)
+	if len(reqs) == 0 {
+		return nil
+	}
+
+	catalog := s.catalog()
+	var missing []string
+	for _, req := range reqs {
+		ready := slices.ContainsFunc(catalog, func(instance MicroserviceStatusAPI) bool {
+			return instance.Name == req.Name && instance.Healthy() && req.Constraint.Matches(instance.Version)
+		})
+		if !ready {
+			missing = append(missing, req.String())
+		}
+	}
+	return missing
+}
+
+// Start a service, or hold it back until its dependencies are ready. With
+// the service's ops held.
+func (s *Microservices) startOrWait(service *Microservice) error {
+	missing := s.missingDependencies(service)
+	service.mu.Lock()
+	service.waitingFor = missing
+	if len(missing) > 0 {
+		service.status = StatusWaiting
+		service.mu.Unlock()
+		slog.Info("Waiting for dependencies", "id", service.id, "name", service.config.Name, "missing", missing)
+		return nil
+	}
+	service.mu.Unlock()
+	return service.start()
+}
+
+// Start the services whose dependencies became ready. Called whenever the
+// cluster state changes. A service only counts as ready once it is running and
+// healthy, so services come up in dependency order across the whole cluster.
+func (s *Microservices) StartWaiting() {
+	for _, service := range s.list() {
+		if service.currentStatus() == StatusWaiting {
+			s.startIfReady(service)
+		}
+	}
+}
+
+func (s *Microservices) startIfReady(service *Microservice) {
+	service.ops.Lock()
+	defer service.ops.Unlock()
+	// Stopped or removed in the meantime
+	if service.currentStatus() != StatusWaiting {
+		return
+	}
+
+	missing := s.missingDependencies(service)
+	service.mu.Lock()
+	changed := !slices.Equal(missing, service.waitingFor)
+	service.waitingFor = missing
+	service.mu.Unlock()
+	if len(missing) > 0 {
+		if changed {
+			s.changed()
+		}
+		return
+	}
+
+	slog.Info("Dependencies ready, starting", "id", service.id, "name", service.config.Name)
+	if err := service.start(); err != nil {
+		slog.Error("Could not start service after its dependencies", "id", service.id, "error", err)
+	}
+	s.changed()
+}
@@ -0,0 +1,46 @@
+package microservice
+
+import (
+	"github.com/noahdw/Gonolith/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Streams dependency events to the services running on this node
+type DependencyServer struct {
+	api.UnimplementedDependenciesServer
+	services *Microservices
+}
+
+func NewDependencyServer(services *Microservices) *DependencyServer {
+	return &DependencyServer{
+		services: services,
+	}
+}
+
+func (s *DependencyServer) Watch(req *api.WatchDependenciesRequest, stream api.Dependencies_WatchServer) error {
+	if _, has := s.services.get(req.ServiceId); !has {
+		return status.Errorf(codes.NotFound, "no service %q on this node", req.ServiceId)
+	}
+
+	events, stop := s.services.Subscribe(req.ServiceId)
+	defer stop()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event := <-events:
+			err := stream.Send(&api.DependencyEvent{
+				ServiceId:   event.ServiceId,
+				Dependency:  event.Dependency,
+				Requirement: event.Requirement,
+				State:       event.State,
+				InstanceIds: event.Instances,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
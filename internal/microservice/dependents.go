@@ -0,0 +1,269 @@
+package microservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/noahdw/Gonolith/internal/semver"
+)
+
+// What happens to a service when one of its dependencies changes
+const (
+	// Only events, signals and webhooks
+	PolicyNotify = "notify"
+	// Restart the service once the dependency is back or its instances changed
+	PolicyRestart = "restart"
+	// Mark the service degraded while the dependency is down
+	PolicyDegrade = "degrade"
+)
+
+// States of a dependency in events
+const (
+	DependencyDown    = "down"
+	DependencyUp      = "up"
+	DependencyChanged = "changed"
+)
+
+// How a service wants to hear about one of its dependencies, declared as
+// [dependencies.<name>] in its config
+type DependencyConfig struct {
+	// notify (default), restart or degrade
+	Policy string
+	// Sent to the process on every change, e.g. "SIGHUP"
+	Signal string
+	// Receives every change as a JSON POST
+	Webhook string
+}
+
+type DependencyEventAPI struct {
+	ServiceId   string `json:"service_id"`
+	Dependency  string `json:"dependency"`
+	Requirement string `json:"requirement"`
+	State       string `json:"state"`
+	// Healthy instances satisfying the requirement
+	Instances []string `json:"instances"`
+}
+
+// Signals that exist on every platform the node builds for
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+// Last seen state of a dependency
+type dependencySnapshot struct {
+	up        bool
+	instances []string
+	// Instance ids with their process start times, so restarts show up even
+	// when they were too quick to see the instance down
+	processes []string
+	// When up last flipped, or the dependency was first looked at
+	since time.Time
+}
+
+func validateDependencies(config MicroserviceConfig, requires []semver.Requirement) error {
+	for name, dep := range config.Dependencies {
+		if !slices.ContainsFunc(requires, func(req semver.Requirement) bool { return req.Name == name }) {
+			return fmt.Errorf("dependencies.%s is not in requires", name)
+		}
+		switch dep.Policy {
+		case "", PolicyNotify, PolicyRestart, PolicyDegrade:
+		default:
+			return fmt.Errorf("dependencies.%s: unknown policy %q", name, dep.Policy)
+		}
+		if _, known := signals[dep.Signal]; dep.Signal != "" && !known {
+			return fmt.Errorf("dependencies.%s: unsupported signal %q", name, dep.Signal)
+		}
+	}
+	return nil
+}
+
+// Receive the dependency events of a service until the returned func is called
+func (s *Microservices) Subscribe(id string) (<-chan DependencyEventAPI, func()) {
+	ch := make(chan DependencyEventAPI, 16)
+	s.subMu.Lock()
+	if s.subscribers[id] == nil {
+		s.subscribers[id] = make(map[chan DependencyEventAPI]struct{})
+	}
+	s.subscribers[id][ch] = struct{}{}
+	s.subMu.Unlock()
+
+	return ch, func() {
+		s.subMu.Lock()
+		delete(s.subscribers[id], ch)
+		s.subMu.Unlock()
+	}
+}
+
+// Compare what every local service requires with the cluster and tell
+// services about dependencies that went down, came back or changed. Called
+// whenever the cluster state changes.
+func (s *Microservices) NotifyDependents() {
+	catalog := s.catalog()
+	for _, service := range s.list() {
+		reqs, _ := parseRequires(service.config.Requires)
+		for _, req := range reqs {
+			current := snapshotDependency(catalog, req)
+			service.mu.Lock()
+			previous, seen := service.dependencies[req.Name]
+			current.since = previous.since
+			if !seen || current.up != previous.up {
+				current.since = time.Now()
+			}
+			service.dependencies[req.Name] = current
+			service.mu.Unlock()
+			if !seen {
+				// First look, nothing changed yet
+				continue
+			}
+
+			var state string
+			switch {
+			case previous.up && !current.up:
+				state = DependencyDown
+			case !previous.up && current.up:
+				state = DependencyUp
+			case current.up && !slices.Equal(previous.processes, current.processes):
+				state = DependencyChanged
+			default:
+				continue
+			}
+
+			s.dependencyChanged(service, previous, current, DependencyEventAPI{
+				ServiceId:   service.id,
+				Dependency:  req.Name,
+				Requirement: req.String(),
+				State:       state,
+				Instances:   current.instances,
+			})
+		}
+	}
+}
+
+func snapshotDependency(catalog []MicroserviceStatusAPI, req semver.Requirement) dependencySnapshot {
+	var snapshot dependencySnapshot
+	for _, instance := range catalog {
+		if instance.Name == req.Name && instance.Healthy() && req.Constraint.Matches(instance.Version) {
+			snapshot.instances = append(snapshot.instances, instance.Id)
+			snapshot.processes = append(snapshot.processes, instance.Id+"@"+instance.StartedAt)
+		}
+	}
+	sort.Strings(snapshot.instances)
+	sort.Strings(snapshot.processes)
+	snapshot.up = len(snapshot.instances) > 0
+	return snapshot
+}
+
+func (s *Microservices) dependencyChanged(service *Microservice, previous, current dependencySnapshot, event DependencyEventAPI) {
+	slog.Info("Dependency changed", "id", service.id, "dependency", event.Dependency, "state", event.State)
+	dep := service.config.Dependencies[event.Dependency]
+
+	s.subMu.Lock()
+	for ch := range s.subscribers[service.id] {
+		select {
+		case ch <- event:
+		default:
+			slog.Warn("Dropping dependency event for slow watcher", "id", service.id)
+		}
+	}
+	s.subMu.Unlock()
+
+	service.mu.Lock()
+	running, instance := service.status == "running", service.instance
+	service.mu.Unlock()
+
+	if dep.Signal != "" && running && instance != nil {
+		if err := instance.Signal(signals[dep.Signal]); err != nil {
+			slog.Warn("Cannot signal service", "id", service.id, "signal", dep.Signal, "error", err)
+		}
+	}
+	if dep.Webhook != "" {
+		go postWebhook(dep.Webhook, event)
+	}
+
+	switch dep.Policy {
+	case PolicyDegrade:
+		service.mu.Lock()
+		degraded := slices.Contains(service.degradedBy, event.Dependency)
+		changed := false
+		if event.State == DependencyDown && !degraded {
+			service.degradedBy = append(service.degradedBy, event.Dependency)
+			changed = true
+		} else if event.State != DependencyDown && degraded {
+			service.degradedBy = slices.DeleteFunc(service.degradedBy, func(name string) bool { return name == event.Dependency })
+			changed = true
+		}
+		service.mu.Unlock()
+		if changed {
+			s.changed()
+		}
+	case PolicyRestart:
+		service.mu.Lock()
+		restart := event.State != DependencyDown && service.status == "running" && stale(service, previous, current)
+		service.mu.Unlock()
+		if restart {
+			go s.restart(service)
+		}
+	}
+}
+
+// Whether a service may hold on to something of a dependency that is gone: a
+// process it could have talked to went away, or the dependency came back after
+// being down while the service was running. A service that only started once
+// the dependency was back, e.g. after waiting for it, has nothing stale. With
+// the service's mu held.
+func stale(service *Microservice, previous, current dependencySnapshot) bool {
+	if !previous.up {
+		return service.startedAt.Before(previous.since)
+	}
+	for _, process := range previous.processes {
+		if !slices.Contains(current.processes, process) {
+			return true
+		}
+	}
+	return false
+}
+
+func postWebhook(url string, event DependencyEventAPI) {
+	body, _ := json.Marshal(event)
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("Dependency webhook failed", "url", url, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("Dependency webhook failed", "url", url, "status", resp.Status)
+	}
+}
+
+// Stop the process and start it again, stop returns once it exited
+func (s *Microservices) restart(service *Microservice) {
+	slog.Info("Restarting service after dependency change", "id", service.id)
+	defer s.changed()
+
+	service.ops.Lock()
+	defer service.ops.Unlock()
+	if service.currentStatus() != "running" {
+		// Stopped by someone else in the meantime
+		return
+	}
+	if err := service.stop(); err != nil {
+		slog.Error("Cannot stop service for restart", "id", service.id, "error", err)
+		return
+	}
+	if err := s.startOrWait(service); err != nil {
+		slog.Error("Cannot start service after restart", "id", service.id, "error", err)
+	}
+}
@@ -0,0 +1,111 @@
+package microservice
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// fakeRuntime runs services in memory without any code, so the lifecycle can
+// be exercised in tests. Register it with SetRuntime under the name the test
+// packages use in their config.toml.
+type fakeRuntime struct {
+	mu sync.Mutex
+	// Returned by Prepare and Start while set
+	PrepareErr error
+	StartErr   error
+	running    map[string]*fakeInstance
+}
+
+func newFakeRuntime() *fakeRuntime {
+	return &fakeRuntime{running: make(map[string]*fakeInstance)}
+}
+
+func (r *fakeRuntime) Prepare(spec ServiceSpec) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.PrepareErr
+}
+
+func (r *fakeRuntime) Start(spec ServiceSpec) (Instance, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.StartErr != nil {
+		return nil, r.StartErr
+	}
+	instance := &fakeInstance{Spec: spec, done: make(chan struct{})}
+	r.running[spec.Id] = instance
+	return instance, nil
+}
+
+// The running instance of a service, nil when it is not running
+func (r *fakeRuntime) Instance(id string) *fakeInstance {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	instance := r.running[id]
+	if instance == nil || instance.exited() {
+		return nil
+	}
+	return instance
+}
+
+// fakeInstance is a service started by a fakeRuntime
+type fakeInstance struct {
+	Spec ServiceSpec
+
+	mu      sync.Mutex
+	signals []os.Signal
+	once    sync.Once
+	done    chan struct{}
+	err     error
+}
+
+// Make the service exit as if it crashed with err, or finished when nil
+func (i *fakeInstance) Exit(err error) {
+	i.once.Do(func() {
+		i.err = err
+		close(i.done)
+	})
+}
+
+// Signals the service received so far
+func (i *fakeInstance) Signals() []os.Signal {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return append([]os.Signal(nil), i.signals...)
+}
+
+func (i *fakeInstance) exited() bool {
+	select {
+	case <-i.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (i *fakeInstance) Stop(time.Duration) error {
+	i.Exit(nil)
+	return nil
+}
+
+func (i *fakeInstance) Wait() error {
+	<-i.done
+	return i.err
+}
+
+func (i *fakeInstance) Signal(sig os.Signal) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.signals = append(i.signals, sig)
+	return nil
+}
+
+func (i *fakeInstance) Stats() RuntimeStatsAPI {
+	return RuntimeStatsAPI{}
+}
+
+// Fake services have nothing to health check and are ready while they run
+func (i *fakeInstance) Healthy() bool {
+	return !i.exited()
+}
@@ -4,7 +4,8 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc"
@@ -37,42 +38,104 @@ func (h *HealthChecker) Start(ctx context.Context) {
 	}
 }
 
+// Services checked at once, so a few hung ones do not hold up the others
+const maxConcurrentChecks = 8
+
 func (h *HealthChecker) checkServices() {
-	grpcPort := os.Getenv("GRPC_PORT")
-	if grpcPort == "" {
-		grpcPort = "50051"
+	var changed atomic.Bool
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxConcurrentChecks)
+	for _, service := range h.services.list() {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if h.update(service) {
+				changed.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Let the rest of the cluster know right away instead of waiting for the
+	// next gossip sync
+	if changed.Load() {
+		h.services.changed()
 	}
+}
+
+// Check one service and load its capabilities once it serves, reports
+// whether anything changed
+func (h *HealthChecker) update(service *Microservice) bool {
+	changed := false
+	health := HealthUnknown
 
-	// TODO: Make concurrent
-	for _, service := range h.services.entries {
+	service.mu.Lock()
+	running, instance := service.status == "running", service.instance
+	service.mu.Unlock()
 
-		//TODO: Better way to do status, maybe enum
-		if service.status != "running" {
-			continue
+	//TODO: Better way to do status, maybe enum
+	if reporter, ok := instance.(HealthReporter); ok && running {
+		if reporter.Healthy() {
+			health = HealthServing
+		} else {
+			health = HealthNotServing
 		}
+	} else if running && service.config.Port != "" {
+		health = h.checkService(service)
+	}
+
+	service.mu.Lock()
+	if health != service.health {
+		service.health = health
+		changed = true
+	}
+	loaded := service.capabilities != nil
+	service.mu.Unlock()
 
-		// Create connection to service's gRPC server
-		conn, err := grpc.Dial(fmt.Sprintf("localhost:%s", grpcPort), grpc.WithInsecure())
+	if health == HealthServing && !loaded {
+		capabilities, err := loadCapabilities(service)
 		if err != nil {
-			slog.Error("Failed to connect to service", "name", service.exeFileName, "error", err)
-			continue
+			slog.Warn("Cannot load capabilities, retrying on next check", "service", service.id, "error", err)
+			return changed
+		}
+		if capabilities == nil {
+			capabilities = []CapabilityAPI{}
 		}
-		defer conn.Close()
+		service.mu.Lock()
+		service.capabilities = capabilities
+		service.mu.Unlock()
+		changed = true
+		slog.Info("Loaded capabilities", "id", service.id, "capabilities", capabilities)
+	}
+	return changed
+}
 
-		healthClient := healthpb.NewHealthClient(conn)
+func (h *HealthChecker) checkService(service *Microservice) string {
+	// Create connection to service's gRPC server
+	conn, err := grpc.Dial(fmt.Sprintf("localhost:%s", service.config.Port), grpc.WithInsecure())
+	if err != nil {
+		slog.Error("Failed to connect to service", "name", service.id, "error", err)
+		return HealthNotServing
+	}
+	defer conn.Close()
 
-		// Perform health check
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		resp, err := healthClient.Check(ctx, &healthpb.HealthCheckRequest{})
-		cancel()
+	healthClient := healthpb.NewHealthClient(conn)
 
-		if err != nil {
-			slog.Error("Health check failed", "service", service.exeFileName, "error", err)
-			continue
-		}
+	// Perform health check
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	resp, err := healthClient.Check(ctx, &healthpb.HealthCheckRequest{})
+	cancel()
 
-		if resp.Status != healthpb.HealthCheckResponse_SERVING {
-			slog.Warn("Service unhealthy", "service", service.exeFileName, "status", resp.Status)
-		}
+	if err != nil {
+		slog.Error("Health check failed", "service", service.id, "error", err)
+		return HealthNotServing
+	}
+
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		slog.Warn("Service unhealthy", "service", service.id, "status", resp.Status)
+		return HealthNotServing
 	}
+	return HealthServing
 }
@@ -3,23 +3,56 @@ package microservice
 import (
 	"archive/zip"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/noahdw/Gonolith/internal/wasm"
 	"github.com/pelletier/go-toml/v2"
 )
 
+var (
+	ErrNotFound       = errors.New("service not found")
+	ErrInvalidPackage = errors.New("invalid service package")
+	// The service is not in a state the operation applies to, e.g. starting
+	// one that is running
+	ErrInvalidState = errors.New("invalid service state")
+)
+
 type Microservices struct {
+	mu      sync.RWMutex
 	entries map[string]*Microservice
+	// Called after a service is installed, started, stopped, removed or its
+	// health changes
+	onChange func()
+	// Extra environment for every service, e.g. how to reach this node
+	env []string
+	// Where services get their Unix sockets, none are handed out when empty
+	socketDir string
+	// Source of the ports services declare, nil when none are handed out
+	ports *PortAllocator
+	// Ways to run services, by the runtime their config selects
+	runtimes map[string]Runtime
+	// Cluster wide view of services to check requirements against
+	catalogFn func() []MicroserviceStatusAPI
+
+	subMu sync.Mutex
+	// Dependency event watchers by service id
+	subscribers map[string]map[chan DependencyEventAPI]struct{}
 }
 
 func NewMicroservices() *Microservices {
 	return &Microservices{
-		entries: make(map[string]*Microservice),
+		entries:     make(map[string]*Microservice),
+		subscribers: make(map[string]map[chan DependencyEventAPI]struct{}),
+		runtimes:    map[string]Runtime{RuntimeNative: NewNativeRuntime()},
 	}
 }
 
@@ -34,98 +67,333 @@ func (s *Microservices) InstallMicroservice(rawzip []byte) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	// A rejected package leaves nothing behind, an installed one keeps its
+	// files until it is removed
+	installed := false
+	defer func() {
+		if !installed {
+			os.RemoveAll(tmpdir)
+		}
+	}()
 
-	err = os.Chdir(tmpdir)
-	if err != nil {
-		return "", err
-	}
-
-	file, err := os.CreateTemp(tmpdir, "microservicefile")
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	binaryReader := bytes.NewReader(rawzip)
-	_, err = io.Copy(file, binaryReader)
-	if err != nil {
-		return "", err
-	}
-
-	archive, err := zip.OpenReader(file.Name())
+	// The package is read where it already is, in memory, so no copy of it
+	// ends up among the service's files
+	archive, err := zip.NewReader(bytes.NewReader(rawzip), int64(len(rawzip)))
 	if err != nil {
-		return "", err
-	}
-	type requiredFIleCount struct {
-		config int
-		exe    int
+		return "", fmt.Errorf("%w: %w", ErrInvalidPackage, err)
 	}
 	microservice := NewMicroservice()
 	microservice.id = generateID()
-	count := requiredFIleCount{}
+	microservice.dir = tmpdir
+	microservice.pkg = rawzip
+	microservice.env = append(append([]string{}, s.env...), "GONOLITH_SERVICE_ID="+microservice.id)
+	if s.socketDir != "" {
+		microservice.socket = filepath.Join(s.socketDir, microservice.id+".sock")
+		microservice.env = append(microservice.env, "GONOLITH_SOCKET="+microservice.socket)
+	}
+	configs := 0
 	for _, f := range archive.File {
+		path, err := packagePath(tmpdir, f.Name)
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", ErrInvalidPackage, err)
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return "", err
+		}
+
 		unzippedfile, err := f.Open()
 		if err != nil {
 			return "", err
 		}
 
-		newFile, err := os.Create(f.Name)
+		// Keep modes the archive has, e.g. of scripts
+		newFile, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode().Perm()|0600)
 		if err != nil {
+			unzippedfile.Close()
 			return "", err
 		}
 
 		io.Copy(newFile, unzippedfile)
 		newFile.Close()
+		unzippedfile.Close()
+		microservice.files = append(microservice.files, f.Name)
 
-		if strings.Contains(f.Name, ".exe") {
-			microservice.exeFileName = f.Name
-			count.exe++
+		if f.Name == descriptorSetFile {
+			microservice.descriptors, err = os.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
 		} else if f.Name == "config.toml" {
-			config := parseConfig(f.Name)
+			config := parseConfig(path)
 			if config != nil {
 				microservice.config = *config
-				count.config++
+				configs++
 			}
 		}
 	}
 
-	// Simple check to try to make sure the zip contents are minimally valid
-	if count.config != 1 || count.exe != 1 {
-		return "", fmt.Errorf("invalid service package %s %d, %s %d",
-			"config", count.config,
-			"exe", count.exe)
+	// Simple check to try to make sure the zip contents are minimally valid,
+	// the runtime knows what else it needs
+	if configs != 1 {
+		return "", fmt.Errorf("%w: need one valid config.toml, found %d", ErrInvalidPackage, configs)
+	}
+	runtime, has := s.runtimes[microservice.config.Runtime]
+	if !has {
+		return "", fmt.Errorf("%w: unknown runtime %q", ErrInvalidPackage, microservice.config.Runtime)
+	}
+	if err := runtime.Prepare(microservice.spec()); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidPackage, err)
+	}
+	microservice.runtime = runtime
+
+	requires, err := parseRequires(microservice.config.Requires)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidPackage, err)
+	}
+	if err := s.checkCycle(microservice.config.Name, requires); err != nil {
+		return "", err
+	}
+	if err := validateDependencies(microservice.config, requires); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidPackage, err)
+	}
+
+	if err := s.allocatePorts(microservice); err != nil {
+		return "", err
 	}
 
 	microservice.status = "installed"
+	if microservice.config.Singleton {
+		// Runs once elected
+		microservice.candidate = true
+		microservice.status = StatusStandby
+	}
+	installed = true
 	slog.Info("Microservice install OK.")
 	// Keep track of our microservice and start it
+	microservice.ops.Lock()
+	defer microservice.ops.Unlock()
+	s.mu.Lock()
 	s.entries[microservice.id] = microservice
+	s.mu.Unlock()
 
-	return microservice.id, microservice.start()
+	if !microservice.config.Singleton {
+		err = s.startOrWait(microservice)
+	}
+	s.changed()
+	return microservice.id, err
 }
 
 func (s *Microservices) StopMicroservice(idToStop string) error {
-	service, has := s.entries[idToStop]
+	service, has := s.get(idToStop)
 	if !has {
-		return fmt.Errorf("service not available to stop")
+		return fmt.Errorf("%w: %s", ErrNotFound, idToStop)
+	}
+	service.ops.Lock()
+	defer service.ops.Unlock()
+	if status := service.currentStatus(); status == "stopped" || status == "installed" {
+		return fmt.Errorf("%w: %s is not running", ErrInvalidState, idToStop)
 	}
 
+	defer s.changed()
+	// An operator stop takes a singleton out of the election
+	service.setCandidate(false)
 	return service.stop()
 }
 
 func (s *Microservices) StartMicroservice(idToStart string) error {
-	service, has := s.entries[idToStart]
+	service, has := s.get(idToStart)
+	if !has {
+		return fmt.Errorf("%w: %s", ErrNotFound, idToStart)
+	}
+	service.ops.Lock()
+	defer service.ops.Unlock()
+	switch status := service.currentStatus(); status {
+	case "running", StatusWaiting, StatusStandby:
+		return fmt.Errorf("%w: %s is already %s", ErrInvalidState, idToStart, status)
+	}
+
+	defer s.changed()
+	if service.config.Singleton {
+		// Back into the election, it runs if elected
+		service.mu.Lock()
+		service.candidate = true
+		service.status = StatusStandby
+		service.mu.Unlock()
+		return nil
+	}
+	return s.startOrWait(service)
+}
+
+// Stop the service if it is running and forget about it
+func (s *Microservices) RemoveMicroservice(idToRemove string) error {
+	service, has := s.get(idToRemove)
 	if !has {
-		return fmt.Errorf("service not available to start")
+		return fmt.Errorf("%w: %s", ErrNotFound, idToRemove)
+	}
+	service.ops.Lock()
+	defer service.ops.Unlock()
+
+	service.setCandidate(false)
+	switch service.currentStatus() {
+	case "running", StatusWaiting, StatusStandby:
+		// Waiting and standby services would otherwise still be started
+		if err := service.stop(); err != nil {
+			return err
+		}
 	}
 
-	return service.start()
+	s.mu.Lock()
+	delete(s.entries, idToRemove)
+	s.mu.Unlock()
+	if s.ports != nil {
+		s.ports.Release(idToRemove)
+	}
+	service.removeSocket()
+	if err := os.RemoveAll(service.dir); err != nil {
+		slog.Warn("Cannot remove service files", "id", idToRemove, "dir", service.dir, "error", err)
+	}
+	s.changed()
+	slog.Info("Removed microservice", "id", idToRemove, "name", service.config.Name)
+	return nil
 }
 
-func (s *Microservices) GetAllStatuses() MicroservicesStatusAPI {
-	statuses := make([]MicroserviceStatusAPI, 0, len(s.entries))
+// Variables passed to every service started after this call, as KEY=value
+func (s *Microservices) SetEnv(env []string) {
+	s.env = env
+}
+
+// Reserve the ports a service declares and tell it about them through its
+// environment
+func (s *Microservices) allocatePorts(microservice *Microservice) error {
+	names := microservice.config.Ports
+	if len(names) == 0 {
+		return nil
+	}
+	if s.ports == nil {
+		return fmt.Errorf("service declares ports but the node has no port range")
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if name == "" || seen[name] {
+			return fmt.Errorf("invalid port name %q", name)
+		}
+		seen[name] = true
+	}
+
+	ports, err := s.ports.Allocate(microservice.id, len(names))
+	if err != nil {
+		return err
+	}
+
+	microservice.ports = make(map[string]string)
+	for i, name := range names {
+		port := strconv.Itoa(ports[i])
+		microservice.ports[name] = port
+		envName := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		microservice.env = append(microservice.env, "GONOLITH_PORT_"+envName+"="+port)
+	}
+	microservice.config.Port = strconv.Itoa(ports[0])
+	microservice.env = append(microservice.env, "GONOLITH_PORT="+microservice.config.Port)
+	slog.Info("Allocated ports", "id", microservice.id, "ports", microservice.ports)
+	return nil
+}
+
+// Make a runtime available to services whose config selects it by name, set
+// before installing services
+func (s *Microservices) SetRuntime(name string, runtime Runtime) {
+	s.runtimes[name] = runtime
+}
+
+// The loaded module of a running WebAssembly service
+func (s *Microservices) Module(id string) (*wasm.Module, bool) {
+	service, has := s.get(id)
+	if !has {
+		return nil, false
+	}
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if service.status != "running" {
+		return nil, false
+	}
+	instance, ok := service.instance.(*wasmInstance)
+	if !ok {
+		return nil, false
+	}
+	return instance.module, true
+}
+
+// Range services get their declared ports from, set before installing services
+func (s *Microservices) SetPortRange(first, last int) {
+	s.ports = NewPortAllocator(first, last)
+}
+
+// Directory for the per service Unix sockets, set before installing services
+func (s *Microservices) SetSocketDir(dir string) {
+	s.socketDir = dir
+}
+
+func (s *Microservices) SetOnChange(onChange func()) {
+	s.onChange = onChange
+}
+
+func (s *Microservices) changed() {
+	if s.onChange != nil {
+		go s.onChange()
+	}
+}
+
+func (s *Microservices) Package(id string) ([]byte, bool) {
+	service, has := s.get(id)
+	if !has {
+		return nil, false
+	}
+	return service.pkg, true
+}
 
+func (s *Microservices) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.entries)
+}
+
+func (s *Microservices) get(id string) (*Microservice, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	service, has := s.entries[id]
+	return service, has
+}
+
+// Snapshot of the current entries so callers can iterate without holding the lock
+func (s *Microservices) list() []*Microservice {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	services := make([]*Microservice, 0, len(s.entries))
 	for _, service := range s.entries {
+		services = append(services, service)
+	}
+	return services
+}
+
+func (s *Microservices) GetStatus(id string) (MicroserviceStatusAPI, error) {
+	service, has := s.get(id)
+	if !has {
+		return MicroserviceStatusAPI{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return service.GetStatus(), nil
+}
+
+func (s *Microservices) GetAllStatuses() MicroservicesStatusAPI {
+	services := s.list()
+	statuses := make([]MicroserviceStatusAPI, 0, len(services))
+
+	for _, service := range services {
 		statuses = append(statuses, service.GetStatus())
 	}
 
@@ -134,14 +402,42 @@ func (s *Microservices) GetAllStatuses() MicroservicesStatusAPI {
 	}
 }
 
-func parseConfig(fileName string) *MicroserviceConfig {
-	var config MicroserviceConfig
+// The config.toml of a package, without installing it
+func ReadPackageConfig(rawzip []byte) (MicroserviceConfig, error) {
+	archive, err := zip.NewReader(bytes.NewReader(rawzip), int64(len(rawzip)))
+	if err != nil {
+		return MicroserviceConfig{}, fmt.Errorf("%w: %w", ErrInvalidPackage, err)
+	}
+	file, err := archive.Open("config.toml")
+	if err != nil {
+		return MicroserviceConfig{}, fmt.Errorf("%w: no config.toml", ErrInvalidPackage)
+	}
+	defer file.Close()
+	raw, err := io.ReadAll(file)
+	if err != nil {
+		return MicroserviceConfig{}, err
+	}
+	config, err := decodeConfig(raw)
+	if err != nil {
+		return MicroserviceConfig{}, fmt.Errorf("%w: invalid config.toml: %w", ErrInvalidPackage, err)
+	}
+	return config, nil
+}
+
+func decodeConfig(raw []byte) (MicroserviceConfig, error) {
+	// Defaults for keys the config leaves out
+	config := MicroserviceConfig{Critical: true, Runtime: RuntimeNative}
+	err := toml.Unmarshal(raw, &config)
+	return config, err
+}
 
+func parseConfig(fileName string) *MicroserviceConfig {
 	newFile, err := os.Open(fileName)
 	if err != nil {
 		slog.Error("Cannot open config", "service", fileName)
 		return nil
 	}
+	defer newFile.Close()
 
 	raw, err := io.ReadAll(newFile)
 	if err != nil {
@@ -149,16 +445,25 @@ func parseConfig(fileName string) *MicroserviceConfig {
 		return nil
 	}
 
-	err = toml.Unmarshal(raw, &config)
+	config, err := decodeConfig(raw)
 	if err != nil {
 		slog.Error("Invalid config", "service", fileName)
 		return nil
 	}
 
-	println(config.Name, config.Version, string(raw))
+	slog.Debug("Parsed service config", "name", config.Name, "version", config.Version)
 	return &config
 }
 
+// Where a file of a package goes, names must stay inside the package
+func packagePath(dir, name string) (string, error) {
+	local := filepath.FromSlash(name)
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("invalid service package file %q", name)
+	}
+	return filepath.Join(dir, local), nil
+}
+
 func generateID() string {
 	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
 	b := make([]byte, 6)
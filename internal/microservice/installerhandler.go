@@ -1,9 +1,23 @@
 package microservice
 
 import (
+	"errors"
+	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/noahdw/Gonolith/internal/httpapi"
+)
+
+// Error codes of the service endpoints
+const (
+	CodeServiceNotFound = "service_not_found"
+	CodeInvalidPackage  = "invalid_package"
+	CodeInvalidState    = "invalid_state"
+	CodeDependencyCycle = "dependency_cycle"
+	CodePortsExhausted  = "ports_exhausted"
+	CodeStartFailed     = "start_failed"
 )
 
 type InstallerHandler struct {
@@ -16,35 +30,83 @@ func NewInstallerHandler(services *Microservices) *InstallerHandler {
 	}
 }
 
+// POST /v1/services with the service package as the body
 func (h *InstallerHandler) HandleInstallMicroservice(w http.ResponseWriter, r *http.Request) {
 	rawzip, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
-		http.Error(w, "Could not create space for microservice", http.StatusInternalServerError)
+		httpapi.WriteError(w, http.StatusBadRequest, httpapi.CodeInvalidRequest, "cannot read service package: "+err.Error())
 		return
 	}
 
 	id, err := h.services.InstallMicroservice(rawzip)
+	if err != nil && id != "" {
+		// Installed, but the first start failed. The service stays installed.
+		httpapi.WriteError(w, http.StatusInternalServerError, CodeStartFailed,
+			fmt.Sprintf("installed as %s but cannot start: %v", id, err))
+		return
+	}
 	if err != nil {
-		slog.Error("could not install microservice", "err", err.Error())
-		http.Error(w, "Error installing microservice", http.StatusInternalServerError)
+		writeServiceError(w, err)
 		return
 	}
-	io.WriteString(w, id)
+
+	w.Header().Set("Location", httpapi.Version+"/services/"+id)
+	h.writeStatus(w, http.StatusCreated, id)
 }
 
+// POST /v1/services/{id}:stop
 func (h *InstallerHandler) HandleStopMicroservice(w http.ResponseWriter, r *http.Request) {
-	serviceId := r.URL.Query().Get("id")
-	err := h.services.StopMicroservice(serviceId)
-	if err != nil {
-		http.Error(w, "Error trying to stop microservice", http.StatusBadRequest)
+	id := chi.URLParam(r, "id")
+	if err := h.services.StopMicroservice(id); err != nil {
+		writeServiceError(w, err)
+		return
 	}
+	h.writeStatus(w, http.StatusOK, id)
 }
 
+// POST /v1/services/{id}:start
 func (h *InstallerHandler) HandleStartMicroservice(w http.ResponseWriter, r *http.Request) {
-	serviceId := r.URL.Query().Get("id")
-	err := h.services.StartMicroservice(serviceId)
+	id := chi.URLParam(r, "id")
+	if err := h.services.StartMicroservice(id); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	h.writeStatus(w, http.StatusOK, id)
+}
+
+// DELETE /v1/services/{id}
+func (h *InstallerHandler) HandleRemoveMicroservice(w http.ResponseWriter, r *http.Request) {
+	if err := h.services.RemoveMicroservice(chi.URLParam(r, "id")); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	httpapi.WriteNoContent(w)
+}
+
+func (h *InstallerHandler) writeStatus(w http.ResponseWriter, code int, id string) {
+	status, err := h.services.GetStatus(id)
 	if err != nil {
-		http.Error(w, "Error trying to start microservice", http.StatusBadRequest)
+		// Removed meanwhile
+		writeServiceError(w, err)
+		return
+	}
+	httpapi.WriteJSON(w, code, status)
+}
+
+func writeServiceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		httpapi.WriteError(w, http.StatusNotFound, CodeServiceNotFound, err.Error())
+	case errors.Is(err, ErrInvalidState):
+		httpapi.WriteError(w, http.StatusConflict, CodeInvalidState, err.Error())
+	case errors.Is(err, ErrDependencyCycle):
+		httpapi.WriteError(w, http.StatusConflict, CodeDependencyCycle, err.Error())
+	case errors.Is(err, ErrInvalidPackage):
+		httpapi.WriteError(w, http.StatusBadRequest, CodeInvalidPackage, err.Error())
+	case errors.Is(err, ErrPortsExhausted):
+		httpapi.WriteError(w, http.StatusServiceUnavailable, CodePortsExhausted, err.Error())
+	default:
+		httpapi.WriteError(w, http.StatusInternalServerError, httpapi.CodeInternal, err.Error())
 	}
 }
@@ -0,0 +1,331 @@
+package microservice
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeConfig = `
+name = "fake"
+version = "1.0.0"
+runtime = "fake"
+`
+
+func newFakeServices(t *testing.T) (*Microservices, *fakeRuntime) {
+	t.Helper()
+	services := NewMicroservices()
+	runtime := newFakeRuntime()
+	services.SetRuntime("fake", runtime)
+	return services, runtime
+}
+
+// A package with config as its config.toml
+func fakePackage(t *testing.T, config string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	file, err := archive.Create("config.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func install(t *testing.T, services *Microservices, config string) string {
+	t.Helper()
+	id, err := services.InstallMicroservice(fakePackage(t, config))
+	if err != nil {
+		t.Fatalf("install failed: %v", err)
+	}
+	t.Cleanup(func() { services.RemoveMicroservice(id) })
+	return id
+}
+
+func statusOf(t *testing.T, services *Microservices, id string) MicroserviceStatusAPI {
+	t.Helper()
+	status, err := services.GetStatus(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func waitForStatus(t *testing.T, services *Microservices, id, want string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for statusOf(t, services, id).Status != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("status is %q, want %q", statusOf(t, services, id).Status, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInstallStartsService(t *testing.T) {
+	services, runtime := newFakeServices(t)
+	id := install(t, services, fakeConfig)
+
+	got := statusOf(t, services, id)
+	if got.Status != "running" || got.Health != HealthServing {
+		t.Fatalf("got %s/%s, want running/serving", got.Status, got.Health)
+	}
+	if got.Name != "fake" || got.Version != "1.0.0" || got.Runtime != "fake" {
+		t.Fatalf("unexpected status %+v", got)
+	}
+	if runtime.Instance(id) == nil {
+		t.Fatal("runtime has no instance")
+	}
+
+	// Only the package's own files are installed
+	service, _ := services.get(id)
+	entries, err := os.ReadDir(service.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "config.toml" {
+		t.Fatalf("service directory holds %v, want only config.toml", entries)
+	}
+}
+
+func TestInstallFailsToStart(t *testing.T) {
+	services, runtime := newFakeServices(t)
+	runtime.StartErr = errors.New("no luck")
+
+	id, err := services.InstallMicroservice(fakePackage(t, fakeConfig))
+	if !errors.Is(err, runtime.StartErr) {
+		t.Fatalf("got %v, want the start error", err)
+	}
+	t.Cleanup(func() { services.RemoveMicroservice(id) })
+	if got := statusOf(t, services, id).Status; got != "stopped" {
+		t.Fatalf("status is %q, want stopped", got)
+	}
+}
+
+func TestInstallRejectsUnknownRuntime(t *testing.T) {
+	services, _ := newFakeServices(t)
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	_, err := services.InstallMicroservice(fakePackage(t, `name = "fake"
+version = "1.0.0"
+runtime = "elsewhere"`))
+	if !errors.Is(err, ErrInvalidPackage) {
+		t.Fatalf("got %v, want ErrInvalidPackage", err)
+	}
+	if services.Count() != 0 {
+		t.Fatal("rejected package was installed")
+	}
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Fatalf("rejected package left %d files behind", len(left))
+	}
+}
+
+func TestStopAndStart(t *testing.T) {
+	services, runtime := newFakeServices(t)
+	id := install(t, services, fakeConfig)
+	first := runtime.Instance(id)
+
+	if err := services.StopMicroservice(id); err != nil {
+		t.Fatal(err)
+	}
+	if got := statusOf(t, services, id).Status; got != "stopped" {
+		t.Fatalf("status is %q, want stopped", got)
+	}
+	if !first.exited() {
+		t.Fatal("instance still runs after stop")
+	}
+	if err := services.StopMicroservice(id); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("second stop: got %v, want ErrInvalidState", err)
+	}
+
+	if err := services.StartMicroservice(id); err != nil {
+		t.Fatal(err)
+	}
+	if got := statusOf(t, services, id).Status; got != "running" {
+		t.Fatalf("status is %q, want running", got)
+	}
+	if second := runtime.Instance(id); second == nil || second == first {
+		t.Fatal("start did not run a new instance")
+	}
+	if err := services.StartMicroservice(id); !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("second start: got %v, want ErrInvalidState", err)
+	}
+}
+
+func TestWatchNoticesExit(t *testing.T) {
+	services, runtime := newFakeServices(t)
+	id := install(t, services, fakeConfig)
+
+	runtime.Instance(id).Exit(errors.New("crashed"))
+	waitForStatus(t, services, id, "stopped")
+
+	// A service that exited can be started again
+	if err := services.StartMicroservice(id); err != nil {
+		t.Fatal(err)
+	}
+	if got := statusOf(t, services, id).Status; got != "running" {
+		t.Fatalf("status is %q, want running", got)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	services, runtime := newFakeServices(t)
+	id := install(t, services, fakeConfig)
+	first := runtime.Instance(id)
+	startedAt := statusOf(t, services, id).StartedAt
+
+	service, _ := services.get(id)
+	services.restart(service)
+
+	second := runtime.Instance(id)
+	if !first.exited() || second == nil || second == first {
+		t.Fatal("restart did not replace the instance")
+	}
+	got := statusOf(t, services, id)
+	if got.Status != "running" || got.StartedAt == startedAt {
+		t.Fatalf("got %s started at %s, want running with a new start time", got.Status, got.StartedAt)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	services, runtime := newFakeServices(t)
+	id := install(t, services, fakeConfig)
+	instance := runtime.Instance(id)
+
+	service, _ := services.get(id)
+	if err := services.RemoveMicroservice(id); err != nil {
+		t.Fatal(err)
+	}
+	if !instance.exited() {
+		t.Fatal("instance still runs after remove")
+	}
+	if _, err := os.Stat(service.dir); !os.IsNotExist(err) {
+		t.Fatalf("package files are still at %s", service.dir)
+	}
+	if _, err := services.GetStatus(id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+	if err := services.RemoveMicroservice(id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second remove: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestRemoveWaitingService(t *testing.T) {
+	services, runtime := newFakeServices(t)
+	id := install(t, services, fakeConfig+`requires = ["auth"]`)
+	if got := statusOf(t, services, id).Status; got != StatusWaiting {
+		t.Fatalf("status is %q, want %q", got, StatusWaiting)
+	}
+
+	service, _ := services.get(id)
+	if err := services.RemoveMicroservice(id); err != nil {
+		t.Fatal(err)
+	}
+	// Even if its dependency shows up now
+	services.SetCatalog(func() []MicroserviceStatusAPI {
+		return []MicroserviceStatusAPI{{Name: "auth", Version: "1.0.0", Status: "running", Health: HealthServing}}
+	})
+	services.StartWaiting()
+	services.startIfReady(service)
+	if runtime.Instance(id) != nil {
+		t.Fatal("removed service was started")
+	}
+}
+
+func TestStartWaiting(t *testing.T) {
+	services, runtime := newFakeServices(t)
+	id := install(t, services, fakeConfig+`requires = ["auth>=1.2"]`)
+	if got := statusOf(t, services, id).WaitingFor; len(got) != 1 || got[0] != "auth>=1.2" {
+		t.Fatalf("waiting for %v", got)
+	}
+
+	services.SetCatalog(func() []MicroserviceStatusAPI {
+		return []MicroserviceStatusAPI{{Name: "auth", Version: "1.3.0", Status: "running", Health: HealthServing}}
+	})
+	services.StartWaiting()
+	if got := statusOf(t, services, id).Status; got != "running" || runtime.Instance(id) == nil {
+		t.Fatalf("status is %q, want running", got)
+	}
+}
+
+func TestSingletonLifecycle(t *testing.T) {
+	services, runtime := newFakeServices(t)
+	id := install(t, services, fakeConfig+`singleton = true`)
+	if got := statusOf(t, services, id).Status; got != StatusStandby {
+		t.Fatalf("status is %q, want %q", got, StatusStandby)
+	}
+
+	if err := services.Promote(id); err != nil {
+		t.Fatal(err)
+	}
+	if got := statusOf(t, services, id).Status; got != "running" || runtime.Instance(id) == nil {
+		t.Fatalf("status is %q after promote, want running", got)
+	}
+
+	if err := services.Demote(id); err != nil {
+		t.Fatal(err)
+	}
+	if got := statusOf(t, services, id).Status; got != StatusStandby || runtime.Instance(id) != nil {
+		t.Fatalf("status is %q after demote, want %q", got, StatusStandby)
+	}
+
+	// Stopped by an operator it is no candidate anymore
+	if err := services.StopMicroservice(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := services.Promote(id); err == nil {
+		t.Fatal("promoted a singleton that was stopped")
+	}
+}
+
+// Run with -race: status reads, health checks and lifecycle changes all touch
+// the same services
+func TestConcurrentLifecycle(t *testing.T) {
+	services, runtime := newFakeServices(t)
+	id := install(t, services, fakeConfig)
+	checker := NewHealthChecker(services)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			services.GetAllStatuses()
+			checker.checkServices()
+			services.NotifyDependents()
+			services.StartWaiting()
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		if err := services.StopMicroservice(id); err != nil {
+			t.Fatal(err)
+		}
+		if err := services.StartMicroservice(id); err != nil {
+			t.Fatal(err)
+		}
+		runtime.Instance(id).Exit(nil)
+		waitForStatus(t, services, id, "stopped")
+		if err := services.StartMicroservice(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -1,143 +1,317 @@
 package microservice
 
 import (
-	"bytes"
 	"fmt"
 	"log/slog"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"sync"
 	"time"
 )
 
 type Microservice struct {
-	config      MicroserviceConfig
-	exeFileName string
-	status      string
-	id          string
-	process     *exec.Cmd
+	// Fields up to ops are set on install and do not change after
+	config MicroserviceConfig
+	id     string
+	// Where the package was extracted to and its files, relative to dir
+	dir   string
+	files []string
+	// Runs the service, selected by the runtime in its config
+	runtime Runtime
+	// The package it was installed from, kept so it can be moved to another node
+	pkg []byte
+	env []string
+	// Unix socket the service may serve on next to its port, empty when the
+	// node hands out no sockets
+	socket string
+	// Ports allocated by the node, by the names declared in the config
+	ports map[string]string
+	// Bundled FileDescriptorSet, if the package has one
+	descriptors []byte
+
+	// Held through every start and stop together with the checks leading up
+	// to it, so operators, the elector and dependency changes do not
+	// interleave
+	ops sync.Mutex
+
+	// Guards the fields below, which the API, the health checker, the watch
+	// on the instance, the elector and dependency changes all share. Never
+	// held while waiting on the service.
+	mu       sync.Mutex
+	status   string
+	health   string
+	instance Instance
+	// What the running process exposes, nil until it is ready and was asked
+	capabilities []CapabilityAPI
+	// Requirements not met yet while waiting for dependencies
+	waitingFor []string
+	// Last seen state of each required service, by name
+	dependencies map[string]dependencySnapshot
+	// Dependencies with the degrade policy that are down
+	degradedBy []string
+	// When the current instance was started
+	startedAt time.Time
+	// Singletons only, whether it takes part in the election
+	candidate bool
 }
 
 func NewMicroservice() *Microservice {
 	return &Microservice{
-		status: "Not installed",
+		status:       "Not installed",
+		health:       HealthUnknown,
+		dependencies: make(map[string]dependencySnapshot),
 	}
 }
 
 type MicroserviceConfig struct {
 	Name    string
 	Version string
+	// Port the service serves gRPC on. Set by the node to the first allocated
+	// port when the service declares Ports.
+	Port string
+	// Names of the ports the node should allocate, e.g. ["grpc", "metrics"].
+	// Each is passed as GONOLITH_PORT_<NAME>, the first also as GONOLITH_PORT.
+	Ports []string
+	// Fully qualified gRPC services it implements, e.g. "greeting.Greeter"
+	GrpcServices []string `toml:"grpc_services"`
+	// Services that must be ready somewhere in the cluster before this one
+	// starts, optionally with a version constraint, e.g. "auth>=1.2"
+	Requires []string
+	// The system is down without it, defaults to true
+	Critical bool
+	// What to do when a required service changes, by its name
+	Dependencies map[string]DependencyConfig
+	// Program and arguments the native runtime runs instead of an .exe, e.g.
+	// ["python3", "app.py"]. A program given as a path, e.g. "./run.sh", is
+	// taken from the package, anything else from the node's PATH.
+	Command []string
+	// native (default) runs the .exe of the package as a process, wasm loads
+	// its .wasm module into the node. Nodes can register others.
+	Runtime string
+	// Values WebAssembly services read through the config host function
+	Config map[string]string
+	// Runs on only one of the nodes it is installed on, elected among them
+	Singleton bool
 }
 
+// Ways to run a service
+const (
+	RuntimeNative = "native"
+	RuntimeWasm   = "wasm"
+)
+
+// How long a service may take to exit after SIGTERM before it is killed
+const stopGracePeriod = 10 * time.Second
+
+// Result of the last gRPC health check
+const (
+	HealthUnknown    = "unknown"
+	HealthServing    = "serving"
+	HealthNotServing = "not_serving"
+)
+
 type MicroserviceStatusAPI struct {
 	Status  string `json:"status"`
+	Health  string `json:"health"`
 	Id      string `json:"id"`
 	Name    string `json:"name"`
 	Version string `json:"version"`
+	Port    string `json:"port"`
+	// gRPC services the node routes to this instance
+	GrpcServices []string `json:"grpc_services,omitempty"`
+	// Unix socket the instance is listening on, only reachable from its node
+	Socket string `json:"socket,omitempty"`
+	// Allocated ports by name
+	Ports map[string]string `json:"ports,omitempty"`
+	// gRPC services and methods the running instance exposes, null until it
+	// is ready and has been asked
+	Capabilities []CapabilityAPI `json:"capabilities"`
+	Requires     []string        `json:"requires,omitempty"`
+	Critical     bool            `json:"critical"`
+	// Requirements not met yet while waiting for dependencies
+	WaitingFor []string `json:"waiting_for,omitempty"`
+	// Down dependencies the service is degraded by
+	DegradedBy []string `json:"degraded_by,omitempty"`
+	// Start time of the current instance, changes with every restart
+	StartedAt string `json:"started_at,omitempty"`
+	Runtime   string `json:"runtime,omitempty"`
+	// Resource usage while it runs
+	Stats     *RuntimeStatsAPI `json:"stats,omitempty"`
+	Singleton bool             `json:"singleton,omitempty"`
 }
 
 func (m *Microservice) GetStatus() MicroserviceStatusAPI {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return MicroserviceStatusAPI{
 		Status:  m.status,
+		Health:  m.health,
 		Id:      m.id,
 		Name:    m.config.Name,
 		Version: m.config.Version,
+		Port:    m.config.Port,
+
+		GrpcServices: m.config.GrpcServices,
+		Socket:       m.listeningSocket(),
+		Ports:        m.ports,
+		Capabilities: m.capabilities,
+		Requires:     m.config.Requires,
+		Critical:     m.config.Critical,
+		WaitingFor:   m.waitingFor,
+		DegradedBy:   m.degradedBy,
+		StartedAt:    m.startedAtString(),
+		Runtime:      m.config.Runtime,
+		Stats:        m.stats(),
+		Singleton:    m.config.Singleton,
 	}
 }
 
-func (m *Microservice) start() error {
-	// Make it executable
-	err := os.Chmod(m.exeFileName, 0700)
-	if err != nil {
-		return err
+func (m *Microservice) currentStatus() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+func (m *Microservice) setCandidate(candidate bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.candidate = candidate
+}
+
+// With mu held
+func (m *Microservice) stats() *RuntimeStatsAPI {
+	if m.status != "running" || m.instance == nil {
+		return nil
 	}
-	absPath, err := filepath.Abs(m.exeFileName)
-	if err != nil {
-		return err
+	stats := m.instance.Stats()
+	return &stats
+}
+
+func (m *Microservice) startedAtString() string {
+	if m.startedAt.IsZero() {
+		return ""
 	}
+	return m.startedAt.Format(time.RFC3339Nano)
+}
 
-	// Execute the file
-	cmd := exec.Command(absPath)
+// The socket path once the service created it, the fast path is optional.
+// With mu held.
+func (m *Microservice) listeningSocket() string {
+	if m.socket == "" || m.status != "running" {
+		return ""
+	}
+	info, err := os.Stat(m.socket)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return ""
+	}
+	return m.socket
+}
 
-	// Add stdout/stderr capture for better diagnostics
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// Running and passing its health checks
+func (s MicroserviceStatusAPI) Healthy() bool {
+	return s.Status == "running" && s.Health == HealthServing
+}
 
-	slog.Info("Begin executing", "service", m.exeFileName)
-	err = cmd.Start()
+// With ops held
+func (m *Microservice) start() error {
+	// A socket left behind by a previous run would keep the service from binding
+	m.removeSocket()
+
+	instance, err := m.runtime.Start(m.spec())
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if err != nil {
-		slog.Error("Failed to execute service", "error", err.Error())
+		m.status = "stopped"
 		return err
 	}
 
-	m.process = cmd
+	m.instance = instance
 	m.status = "running"
+	m.health = HealthUnknown
+	if m.selfReporting() {
+		m.health = HealthServing
+	}
+	m.startedAt = time.Now()
+	// The new instance may expose something else
+	m.capabilities = nil
+
+	go m.watch(instance)
+	return nil
+}
+
+// What the runtime needs to run the service
+func (m *Microservice) spec() ServiceSpec {
+	return ServiceSpec{
+		Id:     m.id,
+		Dir:    m.dir,
+		Files:  m.files,
+		Config: m.config,
+		Env:    m.env,
+	}
+}
 
-	serviceStatus := make(chan error)
-	go func() {
-		done := make(chan error, 1)
-		go func() {
-			done <- cmd.Wait()
-			close(done)
-		}()
-
-		timer := time.NewTimer(time.Second * 2)
-		defer timer.Stop()
-
-		select {
-		case <-timer.C:
-			// Service ran for at least 2 seconds, consider it stable
-			m.status = "running"
-			serviceStatus <- nil
-		case err := <-done:
-			// Service exited quickly, that's an error
-			m.status = "stopped"
-			if err != nil {
-				if exitErr, ok := err.(*exec.ExitError); ok {
-					// Get the actual exit code
-					serviceStatus <- fmt.Errorf("bad .exe exit status %d: stdout: %s, stderr: %s",
-						exitErr.ExitCode(), stdout.String(), stderr.String())
-				} else {
-					serviceStatus <- fmt.Errorf("bad .exe: %v, stdout: %s, stderr: %s",
-						err, stdout.String(), stderr.String())
-				}
-			} else {
-				serviceStatus <- fmt.Errorf("service exited unexpectedly with success code, stdout: %s, stderr: %s",
-					stdout.String(), stderr.String())
-			}
-			return
-		}
-
-		// Wait for eventual termination
-		err := <-done
-		if err != nil {
-			slog.Error("Process exited with error", "service", m.exeFileName, "error", err)
-		} else {
-			slog.Info("Process exited", "service", m.exeFileName)
-		}
+// Wait for eventual termination
+func (m *Microservice) watch(instance Instance) {
+	err := instance.Wait()
+	if err != nil {
+		slog.Error("Service exited with error", "id", m.id, "error", err)
+	} else {
+		slog.Info("Service exited", "id", m.id)
+	}
 
+	// Unless it was started again in the meantime
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.instance == instance {
 		m.status = "stopped"
-	}()
+	}
+}
 
-	return <-serviceStatus
+// Whether the runtime reports the health of the service itself instead of
+// the node checking it over gRPC. With mu held.
+func (m *Microservice) selfReporting() bool {
+	_, ok := m.instance.(HealthReporter)
+	return ok
 }
 
+// Returns once the service exited. With ops held.
 func (m *Microservice) stop() error {
-	if m.process == nil {
-		slog.Error("No cmd for process", "service", m.exeFileName)
-		return fmt.Errorf("no cmd available to stop process")
+	m.mu.Lock()
+	if m.status == StatusWaiting || m.status == StatusStandby {
+		// Never started, just stop waiting
+		m.status = "stopped"
+		m.waitingFor = nil
+		m.mu.Unlock()
+		return nil
+	}
+	instance := m.instance
+	m.mu.Unlock()
+	if instance == nil {
+		return fmt.Errorf("service %s was never started", m.id)
 	}
 
-	err := m.process.Process.Kill()
-	if err != nil {
-		return fmt.Errorf("could not kill process %v", err)
+	if err := instance.Stop(stopGracePeriod); err != nil {
+		return err
 	}
+	m.mu.Lock()
+	m.status = "stopped"
+	m.mu.Unlock()
 
-	slog.Info("successfully stopped process", "service", m.exeFileName)
+	// Killed services cannot clean up after themselves
+	m.removeSocket()
+
+	slog.Info("Stopped service", "id", m.id)
 	return nil
 }
 
+func (m *Microservice) removeSocket() {
+	if m.socket == "" {
+		return
+	}
+	if err := os.Remove(m.socket); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Cannot remove service socket", "socket", m.socket, "error", err)
+	}
+}
+
 func (m *Microservice) GetConfig() MicroserviceConfig {
 	return m.config
 }
@@ -1,10 +1,10 @@
 package microservice
 
 import (
-	"encoding/json"
-	"io"
-	"log/slog"
 	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/noahdw/Gonolith/internal/httpapi"
 )
 
 type MonitorHandler struct {
@@ -17,13 +17,17 @@ func NewMonitorHandler(services *Microservices) *MonitorHandler {
 	}
 }
 
+// GET /v1/services
 func (h *MonitorHandler) HandleGetStatus(w http.ResponseWriter, r *http.Request) {
-	if len(h.services.entries) == 0 {
-		io.WriteString(w, "No services installed")
+	httpapi.WriteJSON(w, http.StatusOK, h.services.GetAllStatuses())
+}
+
+// GET /v1/services/{id}
+func (h *MonitorHandler) HandleGetService(w http.ResponseWriter, r *http.Request) {
+	status, err := h.services.GetStatus(chi.URLParam(r, "id"))
+	if err != nil {
+		writeServiceError(w, err)
 		return
 	}
-
-	statuses := h.services.GetAllStatuses()
-	slog.Info("Services status:", "services", statuses)
-	json.NewEncoder(w).Encode(statuses)
+	httpapi.WriteJSON(w, http.StatusOK, status)
 }
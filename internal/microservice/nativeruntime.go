@@ -0,0 +1,215 @@
+package microservice
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long a process has to keep running after it started to count as up
+const startupPeriod = 2 * time.Second
+
+type nativeRuntime struct{}
+
+// Runs a package as a process of the node, either the command its config
+// declares or its only .exe
+func NewNativeRuntime() Runtime {
+	return nativeRuntime{}
+}
+
+func (nativeRuntime) Prepare(spec ServiceSpec) error {
+	if len(spec.Config.Command) > 0 {
+		return prepareCommand(spec)
+	}
+
+	exes := spec.filesWithSuffix(".exe")
+	if len(exes) != 1 {
+		return fmt.Errorf("invalid service package %s %d", "exe", len(exes))
+	}
+	// Make it executable
+	return os.Chmod(filepath.Join(spec.Dir, exes[0]), 0700)
+}
+
+// Programs given as a path run from the package, anything else has to be
+// installed on the node, e.g. python3
+func prepareCommand(spec ServiceSpec) error {
+	program := spec.Config.Command[0]
+	if program == "" {
+		return errors.New("command has no program")
+	}
+	if !strings.ContainsRune(program, '/') {
+		if _, err := exec.LookPath(program); err != nil {
+			return fmt.Errorf("command %s is not available on this node: %w", program, err)
+		}
+		return nil
+	}
+
+	path := filepath.Clean(filepath.FromSlash(program))
+	if !filepath.IsLocal(path) {
+		return fmt.Errorf("command %s is outside of the package", program)
+	}
+	// Archives do not always keep the executable bit
+	return os.Chmod(filepath.Join(spec.Dir, path), 0700)
+}
+
+func (nativeRuntime) Start(spec ServiceSpec) (Instance, error) {
+	var cmd *exec.Cmd
+	if command := spec.Config.Command; len(command) > 0 {
+		cmd = exec.Command(command[0], command[1:]...)
+		if strings.ContainsRune(command[0], '/') {
+			cmd.Path = filepath.Join(spec.Dir, filepath.FromSlash(command[0]))
+		}
+	} else {
+		exes := spec.filesWithSuffix(".exe")
+		if len(exes) != 1 {
+			return nil, fmt.Errorf("invalid service package %s %d", "exe", len(exes))
+		}
+		cmd = exec.Command(filepath.Join(spec.Dir, exes[0]))
+	}
+
+	// Run it from the directory it was installed to so it finds its
+	// config.toml and other files
+	cmd.Dir = spec.Dir
+	cmd.Env = append(os.Environ(), spec.Env...)
+
+	// Add stdout/stderr capture for better diagnostics. Only the tail is
+	// kept, the process may write for as long as it runs.
+	stdout, stderr := newTailBuffer(outputTail), newTailBuffer(outputTail)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	slog.Info("Begin executing", "service", spec.Id, "command", cmd.Args)
+	if err := cmd.Start(); err != nil {
+		slog.Error("Failed to execute service", "error", err.Error())
+		return nil, err
+	}
+
+	process := &nativeProcess{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		process.err = cmd.Wait()
+		close(process.done)
+	}()
+
+	select {
+	case <-time.After(startupPeriod):
+		// Ran long enough, consider it stable
+		return process, nil
+	case <-process.done:
+	}
+
+	// Exited right away, that's an error
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(process.err, &exitErr):
+		return nil, fmt.Errorf("bad exit status %d: stdout: %s, stderr: %s",
+			exitErr.ExitCode(), stdout.String(), stderr.String())
+	case process.err != nil:
+		return nil, fmt.Errorf("service failed: %v, stdout: %s, stderr: %s",
+			process.err, stdout.String(), stderr.String())
+	default:
+		return nil, fmt.Errorf("service exited unexpectedly with success code, stdout: %s, stderr: %s",
+			stdout.String(), stderr.String())
+	}
+}
+
+// How much of a process's stdout and stderr each is kept for errors
+const outputTail = 64 << 10
+
+// tailBuffer keeps the last max bytes written to it
+type tailBuffer struct {
+	mu      sync.Mutex
+	max     int
+	buf     []byte
+	dropped bool
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+	// Trim once twice the limit is reached rather than on every write
+	if len(b.buf) > 2*b.max {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.max:]...)
+		b.dropped = true
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.buf) <= b.max && !b.dropped {
+		return string(b.buf)
+	}
+	return "..." + string(b.buf[len(b.buf)-b.max:])
+}
+
+type nativeProcess struct {
+	cmd *exec.Cmd
+	// Closed once the process exited, err is set by then
+	done chan struct{}
+	err  error
+}
+
+func (p *nativeProcess) Stop(grace time.Duration) error {
+	// Give the service a chance to drain, then make sure it is gone
+	if err := p.cmd.Process.Signal(syscall.SIGTERM); err == nil {
+		select {
+		case <-p.done:
+			return nil
+		case <-time.After(grace):
+		}
+	}
+	if err := p.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("could not kill process %v", err)
+	}
+	<-p.done
+	return nil
+}
+
+func (p *nativeProcess) Wait() error {
+	<-p.done
+	return p.err
+}
+
+func (p *nativeProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p *nativeProcess) Stats() RuntimeStatsAPI {
+	return RuntimeStatsAPI{
+		Pid:         p.cmd.Process.Pid,
+		MemoryBytes: residentMemory(p.cmd.Process.Pid),
+	}
+}
+
+// Resident set size from procfs, 0 where there is none
+func residentMemory(pid int) uint64 {
+	raw, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/statm")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) < 2 {
+		return 0
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return pages * uint64(os.Getpagesize())
+}
@@ -0,0 +1,38 @@
+package microservice
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTailBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{name: "empty", want: ""},
+		{name: "fits", writes: []string{"ab", "cd"}, want: "abcd"},
+		{name: "exactly full", writes: []string{"abcdefgh"}, want: "abcdefgh"},
+		{name: "over the limit", writes: []string{"abcdefgh", "ij"}, want: "...cdefghij"},
+		{name: "trimmed", writes: []string{"abcdefgh", "ijklmnop", "qr"}, want: "...klmnopqr"},
+		{name: "one large write", writes: []string{strings.Repeat("x", 100) + "abcdefgh"}, want: "...abcdefgh"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTailBuffer(8)
+			for _, w := range test.writes {
+				if n, err := b.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if got := b.String(); got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+			if len(b.buf) > 2*b.max {
+				t.Fatalf("holds %d bytes, want at most %d", len(b.buf), 2*b.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package microservice
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrPortsExhausted = errors.New("no free ports left in range")
+
+// PortAllocator hands out ports from a range to installed services. A port
+// stays reserved for its service until the service is removed.
+type PortAllocator struct {
+	mu    sync.Mutex
+	first int
+	last  int
+	// Port -> id of the service holding it
+	used map[int]string
+}
+
+func NewPortAllocator(first, last int) *PortAllocator {
+	return &PortAllocator{
+		first: first,
+		last:  last,
+		used:  make(map[int]string),
+	}
+}
+
+// Parse a range like "20000-20999"
+func ParsePortRange(raw string) (int, int, error) {
+	lo, hi, ok := strings.Cut(raw, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid port range %q, expected first-last", raw)
+	}
+	first, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", raw, err)
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(hi))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", raw, err)
+	}
+	if first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("invalid port range %q", raw)
+	}
+	return first, last, nil
+}
+
+// Reserve n ports for a service. Ports something else on the machine is
+// already listening on are skipped. Nothing is reserved when there are not
+// enough free ports.
+func (a *PortAllocator) Allocate(id string, n int) ([]int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var ports []int
+	for port := a.first; port <= a.last && len(ports) < n; port++ {
+		if _, taken := a.used[port]; taken || !portFree(port) {
+			continue
+		}
+		ports = append(ports, port)
+	}
+	if len(ports) < n {
+		return nil, fmt.Errorf("%w %d-%d: need %d, found %d", ErrPortsExhausted, a.first, a.last, n, len(ports))
+	}
+
+	for _, port := range ports {
+		a.used[port] = id
+	}
+	return ports, nil
+}
+
+// Give back every port held by a service
+func (a *PortAllocator) Release(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for port, holder := range a.used {
+		if holder == id {
+			delete(a.used, port)
+		}
+	}
+}
+
+func portFree(port int) bool {
+	lis, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return false
+	}
+	lis.Close()
+	return true
+}
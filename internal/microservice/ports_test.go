@@ -0,0 +1,110 @@
+package microservice
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		raw       string
+		wantFirst int
+		wantLast  int
+		wantErr   bool
+	}{
+		{raw: "20000-20999", wantFirst: 20000, wantLast: 20999},
+		{raw: " 20000 - 20999 ", wantFirst: 20000, wantLast: 20999},
+		{raw: "8080-8080", wantFirst: 8080, wantLast: 8080},
+		{raw: "1-65535", wantFirst: 1, wantLast: 65535},
+		{raw: "20000", wantErr: true},
+		{raw: "", wantErr: true},
+		{raw: "a-20999", wantErr: true},
+		{raw: "20000-b", wantErr: true},
+		{raw: "20999-20000", wantErr: true},
+		{raw: "0-100", wantErr: true},
+		{raw: "65000-65536", wantErr: true},
+		{raw: "-5-10", wantErr: true},
+	}
+
+	for _, test := range tests {
+		first, last, err := ParsePortRange(test.raw)
+		switch {
+		case test.wantErr && err == nil:
+			t.Errorf("ParsePortRange(%q) = %d-%d, want an error", test.raw, first, last)
+		case !test.wantErr && err != nil:
+			t.Errorf("ParsePortRange(%q): %v", test.raw, err)
+		case !test.wantErr && (first != test.wantFirst || last != test.wantLast):
+			t.Errorf("ParsePortRange(%q) = %d-%d, want %d-%d", test.raw, first, last, test.wantFirst, test.wantLast)
+		}
+	}
+}
+
+// A range of n ports nothing on the machine listens on
+func freePortRange(t *testing.T, n int) (int, int) {
+	t.Helper()
+	for first := 40000; first+n <= 60000; first += n {
+		free := true
+		for port := first; port < first+n && free; port++ {
+			free = portFree(port)
+		}
+		if free {
+			return first, first + n - 1
+		}
+	}
+	t.Skip("no free port range")
+	return 0, 0
+}
+
+func TestAllocatePorts(t *testing.T) {
+	first, last := freePortRange(t, 4)
+	ports := NewPortAllocator(first, last)
+
+	// Something else on the machine holds the first port
+	lis, err := net.Listen("tcp", ":"+strconv.Itoa(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	a, err := ports.Allocate("a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{first + 1, first + 2}; !slices.Equal(a, want) {
+		t.Fatalf("a got %v, want %v", a, want)
+	}
+
+	// One port is left, a service that needs two gets none
+	if _, err := ports.Allocate("b", 2); !errors.Is(err, ErrPortsExhausted) {
+		t.Fatalf("got %v, want ErrPortsExhausted", err)
+	}
+	b, err := ports.Allocate("b", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{last}; !slices.Equal(b, want) {
+		t.Fatalf("b got %v, want %v", b, want)
+	}
+	if _, err := ports.Allocate("c", 1); !errors.Is(err, ErrPortsExhausted) {
+		t.Fatalf("got %v, want ErrPortsExhausted", err)
+	}
+
+	// Ports a gave back go to the next service
+	ports.Release("a")
+	c, err := ports.Allocate("c", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(c, a) {
+		t.Fatalf("c got %v, want a's old ports %v", c, a)
+	}
+
+	// Releasing a service without ports changes nothing
+	ports.Release("unknown")
+	if _, err := ports.Allocate("d", 1); !errors.Is(err, ErrPortsExhausted) {
+		t.Fatalf("got %v, want ErrPortsExhausted", err)
+	}
+}
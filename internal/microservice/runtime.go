@@ -0,0 +1,65 @@
+package microservice
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// Runtime runs the code of a service. It is selected by runtime in the
+// service's config.toml, the lifecycle around it is the same for all of them.
+type Runtime interface {
+	// Check an extracted package has what the runtime needs, once on install
+	Prepare(spec ServiceSpec) error
+	// Run the service. Returns once it is up, or with why it did not come up.
+	Start(spec ServiceSpec) (Instance, error)
+}
+
+// Instance is a started service
+type Instance interface {
+	// Ask the service to exit and force it once the grace period is over.
+	// Returns when it is gone.
+	Stop(grace time.Duration) error
+	// Block until the service exits, with why when it failed
+	Wait() error
+	// Deliver a signal, for runtimes that run processes
+	Signal(sig os.Signal) error
+	Stats() RuntimeStatsAPI
+}
+
+// Implemented by instances the node cannot health check over gRPC, e.g.
+// because it serves them itself
+type HealthReporter interface {
+	Healthy() bool
+}
+
+// What a runtime gets to run a service
+type ServiceSpec struct {
+	Id string
+	// Where the package was extracted to, services run from here
+	Dir string
+	// Files of the package, relative to Dir
+	Files  []string
+	Config MicroserviceConfig
+	// Variables on top of the node's own environment, as KEY=value
+	Env []string
+}
+
+// Resource usage of a running service, zero where a runtime cannot tell
+type RuntimeStatsAPI struct {
+	Pid         int    `json:"pid,omitempty"`
+	MemoryBytes uint64 `json:"memory_bytes,omitempty"`
+	// Concurrent copies of the service, e.g. module instances
+	Instances int `json:"instances,omitempty"`
+}
+
+// Files of the package whose names end in suffix
+func (s ServiceSpec) filesWithSuffix(suffix string) []string {
+	var files []string
+	for _, name := range s.Files {
+		if strings.HasSuffix(name, suffix) {
+			files = append(files, name)
+		}
+	}
+	return files
+}
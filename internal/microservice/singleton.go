@@ -0,0 +1,84 @@
+package microservice
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// Installed singleton that is ready to run but is not the elected instance
+const StatusStandby = "standby"
+
+// A local instance of a singleton service as the election sees it
+type SingletonAPI struct {
+	Id   string
+	Name string
+	// Installed and not stopped by an operator, so it may run when elected
+	Candidate bool
+	Status    string
+}
+
+func (s *Microservices) Singletons() []SingletonAPI {
+	var singletons []SingletonAPI
+	for _, service := range s.list() {
+		if !service.config.Singleton {
+			continue
+		}
+		service.mu.Lock()
+		singletons = append(singletons, SingletonAPI{
+			Id:        service.id,
+			Name:      service.config.Name,
+			Candidate: service.candidate,
+			Status:    service.status,
+		})
+		service.mu.Unlock()
+	}
+	return singletons
+}
+
+// Run the elected instance of a singleton
+func (s *Microservices) Promote(id string) error {
+	service, has := s.get(id)
+	if !has {
+		return fmt.Errorf("service %s is not a singleton candidate", id)
+	}
+	service.ops.Lock()
+	defer service.ops.Unlock()
+	service.mu.Lock()
+	candidate, status := service.candidate, service.status
+	service.mu.Unlock()
+	if !candidate {
+		return fmt.Errorf("service %s is not a singleton candidate", id)
+	}
+	if status == "running" || status == StatusWaiting {
+		return nil
+	}
+
+	slog.Info("Elected, starting singleton", "id", id, "name", service.config.Name)
+	defer s.changed()
+	return s.startOrWait(service)
+}
+
+// Put an instance of a singleton that lost the election back into standby
+func (s *Microservices) Demote(id string) error {
+	service, has := s.get(id)
+	if !has {
+		return fmt.Errorf("service %s does not exist", id)
+	}
+	service.ops.Lock()
+	defer service.ops.Unlock()
+	if status := service.currentStatus(); status != "running" && status != StatusWaiting {
+		return nil
+	}
+
+	slog.Info("Not elected, stopping singleton", "id", id, "name", service.config.Name)
+	defer s.changed()
+	if err := service.stop(); err != nil {
+		return err
+	}
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if service.candidate {
+		service.status = StatusStandby
+	}
+	return nil
+}
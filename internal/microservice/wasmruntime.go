@@ -0,0 +1,96 @@
+package microservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/noahdw/Gonolith/internal/wasm"
+)
+
+type wasmRuntime struct {
+	runtime *wasm.Runtime
+}
+
+// Loads the .wasm module of a package into the node, calls reach it through
+// the router
+func NewWasmRuntime(runtime *wasm.Runtime) Runtime {
+	return &wasmRuntime{runtime: runtime}
+}
+
+func (r *wasmRuntime) Prepare(spec ServiceSpec) error {
+	modules := spec.filesWithSuffix(".wasm")
+	if len(modules) != 1 {
+		return fmt.Errorf("invalid service package %s %d", "wasm", len(modules))
+	}
+	if len(spec.Config.Ports) > 0 {
+		return errors.New("WebAssembly services are reached through the node and cannot declare ports")
+	}
+	return nil
+}
+
+func (r *wasmRuntime) Start(spec ServiceSpec) (Instance, error) {
+	modules := spec.filesWithSuffix(".wasm")
+	if len(modules) != 1 {
+		return nil, fmt.Errorf("invalid service package %s %d", "wasm", len(modules))
+	}
+	path := filepath.Join(spec.Dir, modules[0])
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Loading module", "service", path)
+	module, err := r.runtime.Load(context.Background(), spec.Id, code, spec.Config.Config, spec.Env)
+	if err != nil {
+		return nil, err
+	}
+	return &wasmInstance{module: module, path: path, done: make(chan struct{})}, nil
+}
+
+type wasmInstance struct {
+	module *wasm.Module
+	path   string
+
+	once sync.Once
+	done chan struct{}
+}
+
+func (i *wasmInstance) Stop(time.Duration) error {
+	var err error
+	i.once.Do(func() {
+		err = i.module.Close(context.Background())
+		close(i.done)
+		slog.Info("Unloaded module", "service", i.path)
+	})
+	return err
+}
+
+func (i *wasmInstance) Wait() error {
+	<-i.done
+	return nil
+}
+
+func (i *wasmInstance) Signal(os.Signal) error {
+	return errors.New("WebAssembly services cannot receive signals")
+}
+
+func (i *wasmInstance) Stats() RuntimeStatsAPI {
+	instances, memory := i.module.Stats()
+	return RuntimeStatsAPI{Instances: instances, MemoryBytes: memory}
+}
+
+// Loaded modules are always ready to take calls
+func (i *wasmInstance) Healthy() bool {
+	select {
+	case <-i.done:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,44 @@
+package router
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// frame carries a message through the router without decoding it
+type frame struct {
+	payload []byte
+}
+
+// codec passes frames through untouched and handles everything else as
+// protobuf, so the node's own gRPC services keep working on the same server
+type codec struct{}
+
+func (codec) Marshal(v any) ([]byte, error) {
+	switch msg := v.(type) {
+	case *frame:
+		return msg.payload, nil
+	case proto.Message:
+		return proto.Marshal(msg)
+	default:
+		return nil, fmt.Errorf("router codec cannot marshal %T", v)
+	}
+}
+
+func (codec) Unmarshal(data []byte, v any) error {
+	switch msg := v.(type) {
+	case *frame:
+		msg.payload = append([]byte(nil), data...)
+		return nil
+	case proto.Message:
+		return proto.Unmarshal(data, msg)
+	default:
+		return fmt.Errorf("router codec cannot unmarshal into %T", v)
+	}
+}
+
+// Registered under the proto name so peers see ordinary application/grpc
+func (codec) Name() string {
+	return "proto"
+}
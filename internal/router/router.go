@@ -0,0 +1,339 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/noahdw/Gonolith/internal/auth"
+	"github.com/noahdw/Gonolith/internal/cluster"
+	"github.com/noahdw/Gonolith/internal/microservice"
+	"github.com/noahdw/Gonolith/internal/wasm"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Set on calls a router forwards to another node, so that node only routes
+// to its own instances and calls never bounce between nodes
+const forwardedHeader = "x-gonolith-forwarded-by"
+
+// Router is a transparent gRPC proxy. Calls for services the node does not
+// serve itself are routed by full method name to an instance on this node
+// when there is one, and to a node that has one otherwise. WebAssembly
+// instances on this node are called in-process.
+type Router struct {
+	cluster  *cluster.Cluster
+	services *microservice.Microservices
+	// Calls forwarded to other nodes authenticate with it. Services on this
+	// node never see it.
+	nodeToken string
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+	next  atomic.Uint32
+}
+
+func NewRouter(c *cluster.Cluster, services *microservice.Microservices) *Router {
+	return &Router{
+		cluster:  c,
+		services: services,
+		conns:    make(map[string]*grpc.ClientConn),
+	}
+}
+
+func (r *Router) SetNodeToken(token string) {
+	r.nodeToken = token
+}
+
+// Options to install the router on the node's gRPC server
+func (r *Router) ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ForceServerCodec(codec{}),
+		grpc.UnknownServiceHandler(r.handle),
+	}
+}
+
+type target struct {
+	addr string
+	// Another node's router rather than an instance
+	remote bool
+	node   string
+	// WebAssembly instance on this node, called without any network
+	module string
+}
+
+func (r *Router) handle(srv any, serverStream grpc.ServerStream) error {
+	method, ok := grpc.MethodFromServerStream(serverStream)
+	if !ok {
+		return status.Error(codes.Internal, "no method in stream")
+	}
+
+	md, _ := metadata.FromIncomingContext(serverStream.Context())
+	forwarded := len(md.Get(forwardedHeader)) > 0
+
+	dest, err := r.route(method, forwarded)
+	if err != nil {
+		return err
+	}
+	if dest.module != "" {
+		return r.handleInProcess(serverStream, dest, method)
+	}
+
+	// Neither the caller's token nor the node token of the node that
+	// passed the call on goes any further
+	outMD := md.Copy()
+	outMD.Delete(auth.MetadataKey)
+	if dest.remote {
+		outMD.Set(forwardedHeader, r.cluster.LocalName())
+		r.authenticate(outMD)
+	}
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(serverStream.Context(), outMD))
+	defer cancel()
+
+	conn, err := r.conn(dest.addr)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "cannot connect to %s: %v", dest.addr, err)
+	}
+
+	clientStream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, method, grpc.ForceCodec(codec{}))
+	if err != nil {
+		return err
+	}
+
+	return proxy(serverStream, clientStream, cancel)
+}
+
+// Pump messages both ways until the backend finishes the call
+func proxy(serverStream grpc.ServerStream, clientStream grpc.ClientStream, cancel context.CancelFunc) error {
+	toBackend := make(chan error, 1)
+	go func() {
+		for {
+			msg := &frame{}
+			if err := serverStream.RecvMsg(msg); err != nil {
+				if err == io.EOF {
+					toBackend <- clientStream.CloseSend()
+				} else {
+					toBackend <- err
+				}
+				return
+			}
+			if err := clientStream.SendMsg(msg); err != nil {
+				toBackend <- err
+				return
+			}
+		}
+	}()
+
+	fromBackend := make(chan error, 1)
+	go func() {
+		headerSent := false
+		for {
+			msg := &frame{}
+			err := clientStream.RecvMsg(msg)
+			if !headerSent {
+				// Headers are available once the first message or the end of
+				// the stream arrived
+				if header, herr := clientStream.Header(); herr == nil {
+					serverStream.SendHeader(header)
+				}
+				headerSent = true
+			}
+			if err != nil {
+				serverStream.SetTrailer(clientStream.Trailer())
+				fromBackend <- err
+				return
+			}
+			if err := serverStream.SendMsg(msg); err != nil {
+				fromBackend <- err
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case err := <-toBackend:
+			if err != nil {
+				// The caller went away, abandon the backend call
+				cancel()
+				return status.Errorf(codes.Internal, "forwarding request failed: %v", err)
+			}
+		case err := <-fromBackend:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Pick where a call goes. Local instances win, otherwise any node that has a
+// healthy instance. Calls forwarded by another node stay local.
+func (r *Router) route(method string, forwarded bool) (target, error) {
+	service, methodName := splitMethod(method)
+	if service == "" {
+		return target{}, status.Errorf(codes.Unimplemented, "malformed method %q", method)
+	}
+
+	var local, remote []target
+	for _, node := range r.cluster.State().Nodes {
+		for _, instance := range node.Services {
+			wasm := instance.Runtime == microservice.RuntimeWasm
+			if !instance.Healthy() || (instance.Port == "" && !wasm) || !serves(instance, service, methodName) {
+				continue
+			}
+			if node.Local && wasm {
+				local = append(local, target{module: instance.Id, node: node.Name})
+			} else if node.Local {
+				// Instances listening on their socket skip TCP
+				addr := net.JoinHostPort("localhost", instance.Port)
+				if instance.Socket != "" {
+					addr = "unix://" + instance.Socket
+				}
+				local = append(local, target{addr: addr, node: node.Name})
+			} else if node.GRPCAddr != "" {
+				remote = append(remote, target{addr: node.GRPCAddr, remote: true, node: node.Name})
+			}
+		}
+	}
+
+	candidates := local
+	if len(candidates) == 0 && !forwarded {
+		candidates = remote
+	}
+	if len(candidates) == 0 {
+		return target{}, status.Errorf(codes.Unavailable, "no healthy instance serves %s", method)
+	}
+
+	dest := candidates[int(r.next.Add(1))%len(candidates)]
+	slog.Debug("Routing call", "method", method, "node", dest.node, "addr", dest.addr)
+	return dest, nil
+}
+
+// "/greeting.Greeter/SayHello" -> "greeting.Greeter", "SayHello"
+func splitMethod(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	service, method, ok := strings.Cut(fullMethod, "/")
+	if !ok {
+		return "", ""
+	}
+	return service, method
+}
+
+// Whether an instance handles a method. What the instance reported through
+// reflection wins, then the services declared in its config, then a match of
+// its name with the proto package ("greeting" for "greeting.Greeter").
+func serves(instance microservice.MicroserviceStatusAPI, service, method string) bool {
+	if len(instance.Capabilities) > 0 {
+		for _, capability := range instance.Capabilities {
+			if capability.Service == service {
+				return slices.Contains(capability.Methods, method)
+			}
+		}
+		return false
+	}
+
+	if len(instance.GrpcServices) > 0 {
+		return slices.Contains(instance.GrpcServices, service)
+	}
+
+	pkg := service
+	if i := strings.LastIndex(service, "."); i >= 0 {
+		pkg = service[:i]
+	}
+	return pkg == instance.Name
+}
+
+// Unary call to a module, streaming is not supported by the module ABI
+func (r *Router) handleInProcess(serverStream grpc.ServerStream, dest target, method string) error {
+	req := &frame{}
+	if err := serverStream.RecvMsg(req); err != nil {
+		return err
+	}
+	md, _ := metadata.FromIncomingContext(serverStream.Context())
+	md = md.Copy()
+	md.Delete(auth.MetadataKey)
+	ctx := metadata.NewIncomingContext(serverStream.Context(), md)
+	resp, err := r.invokeModule(ctx, dest, method, req.payload)
+	if err != nil {
+		return err
+	}
+	return serverStream.SendMsg(&frame{payload: resp})
+}
+
+func (r *Router) invokeModule(ctx context.Context, dest target, method string, req []byte) ([]byte, error) {
+	module, has := r.services.Module(dest.module)
+	if !has {
+		return nil, status.Errorf(codes.Unavailable, "module %s is not running", dest.module)
+	}
+	resp, err := module.Handle(ctx, method, req)
+	var moduleErr *wasm.ModuleError
+	if errors.As(err, &moduleErr) {
+		return nil, status.Error(codes.Unknown, moduleErr.Message)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "module %s failed: %v", dest.module, err)
+	}
+	return resp, nil
+}
+
+// Unary call on behalf of a WebAssembly module. Modules on this node are
+// called directly, anything else goes over gRPC like any routed call.
+func (r *Router) Invoke(ctx context.Context, method string, req []byte) ([]byte, error) {
+	dest, err := r.route(method, false)
+	if err != nil {
+		return nil, err
+	}
+	if dest.module != "" {
+		return r.invokeModule(ctx, dest, method, req)
+	}
+
+	conn, err := r.conn(dest.addr)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "cannot connect to %s: %v", dest.addr, err)
+	}
+	outMD, _ := metadata.FromOutgoingContext(ctx)
+	outMD = outMD.Copy()
+	outMD.Delete(auth.MetadataKey)
+	if dest.remote {
+		outMD.Set(forwardedHeader, r.cluster.LocalName())
+		r.authenticate(outMD)
+	}
+	ctx = metadata.NewOutgoingContext(ctx, outMD)
+	resp := &frame{}
+	if err := conn.Invoke(ctx, method, &frame{payload: req}, resp, grpc.ForceCodec(codec{})); err != nil {
+		return nil, err
+	}
+	return resp.payload, nil
+}
+
+// The other node checks the node token, not whatever token the caller sent
+func (r *Router) authenticate(md metadata.MD) {
+	if r.nodeToken != "" {
+		md.Set(auth.MetadataKey, "Bearer "+r.nodeToken)
+	}
+}
+
+func (r *Router) conn(addr string) (*grpc.ClientConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if conn, has := r.conns[addr]; has {
+		return conn, nil
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	r.conns[addr] = conn
+	return conn, nil
+}
@@ -0,0 +1,136 @@
+package router
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/noahdw/Gonolith/api"
+	"github.com/noahdw/Gonolith/internal/auth"
+	"github.com/noahdw/Gonolith/internal/cluster"
+	"github.com/noahdw/Gonolith/internal/discovery"
+	"github.com/noahdw/Gonolith/internal/microservice"
+	"github.com/noahdw/Gonolith/resolver"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const testNodeToken = "node-token-for-tests"
+
+func listen(t *testing.T, network, addr string) net.Listener {
+	t.Helper()
+	lis, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lis
+}
+
+func serve(t *testing.T, server *grpc.Server, lis net.Listener) {
+	t.Helper()
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+}
+
+func newCluster(t *testing.T, name, grpcPort string, services func() []microservice.MicroserviceStatusAPI) *cluster.Cluster {
+	t.Helper()
+	c, err := cluster.NewCluster(cluster.Config{
+		NodeName:   name,
+		GRPCPort:   grpcPort,
+		LocalState: services,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// A service on one node calls a WebAssembly service on another node that
+// requires authentication. The call goes through its own node, which passes
+// it on with the node token.
+func TestRemoteWasmCallWithAuth(t *testing.T) {
+	// The node running the module. What it serves stands in for its router
+	// calling the module, the authentication in front of it is the real one.
+	authenticator := auth.NewAuthenticator()
+	if err := authenticator.AddToken("node", auth.RoleNode, testNodeToken); err != nil {
+		t.Fatal(err)
+	}
+	remoteLis := listen(t, "tcp", "0.0.0.0:0")
+	remote := grpc.NewServer(
+		grpc.ForceServerCodec(codec{}),
+		grpc.UnaryInterceptor(authenticator.UnaryInterceptor()),
+		grpc.StreamInterceptor(authenticator.StreamInterceptor()),
+		grpc.UnknownServiceHandler(func(srv any, stream grpc.ServerStream) error {
+			req := &frame{}
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return stream.SendMsg(&frame{payload: append([]byte("echo: "), req.payload...)})
+		}),
+	)
+	serve(t, remote, remoteLis)
+	remotePort := strconv.Itoa(remoteLis.Addr().(*net.TCPAddr).Port)
+	remoteNode := newCluster(t, "remote", remotePort, func() []microservice.MicroserviceStatusAPI {
+		return []microservice.MicroserviceStatusAPI{{
+			Id:           "svc-echo",
+			Name:         "echo",
+			Version:      "1.0.0",
+			Runtime:      microservice.RuntimeWasm,
+			Status:       "running",
+			Health:       microservice.HealthServing,
+			GrpcServices: []string{"echo.Echo"},
+		}}
+	})
+	defer remoteNode.Shutdown()
+
+	// The caller's node, serving services on its Unix socket like the node does
+	dir, err := os.MkdirTemp("", "gonolith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "node.sock")
+	localNode := newCluster(t, "local", "", func() []microservice.MicroserviceStatusAPI { return nil })
+	defer localNode.Shutdown()
+	if _, err := localNode.Join([]string{remoteNode.Addr()}); err != nil {
+		t.Fatal(err)
+	}
+
+	router := NewRouter(localNode, microservice.NewMicroservices())
+	router.SetNodeToken(testNodeToken)
+	discoveryResolver := discovery.NewResolver(localNode)
+	discoveryResolver.SetNodeSocket(socket)
+	local := grpc.NewServer(router.ServerOptions()...)
+	api.RegisterDiscoveryServer(local, discovery.NewGRPCServer(discoveryResolver))
+	serve(t, local, listen(t, "unix", socket))
+
+	// The calling service, as the SDK dials
+	t.Setenv("GONOLITH_NODE_SOCKET", socket)
+	conn, err := grpc.NewClient(resolver.Scheme+":///echo", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp := &frame{}
+		err := conn.Invoke(ctx, "/echo.Echo/Say", &frame{payload: []byte("hi")}, resp, grpc.ForceCodec(codec{}), grpc.WaitForReady(true))
+		cancel()
+		if err == nil {
+			if got := string(resp.payload); got != "echo: hi" {
+				t.Fatalf("got %q, want %q", got, "echo: hi")
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("call failed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,209 @@
+package semver
+
+import (
+	"cmp"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+	Pre   string
+}
+
+// Parse "1", "1.2", "1.2.3" and "v1.2.3-rc1", missing parts are zero. Build
+// metadata ("+build.5") is dropped, it plays no part in ordering
+func Parse(raw string) (Version, error) {
+	var v Version
+	s := strings.TrimPrefix(strings.TrimSpace(raw), "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, v.Pre, _ = strings.Cut(s, "-")
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 || parts[0] == "" {
+		return v, fmt.Errorf("invalid version %q", raw)
+	}
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q", raw)
+		}
+		*nums[i] = n
+	}
+	return v, nil
+}
+
+func (v Version) Compare(o Version) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+	// A pre-release sorts before the release itself
+	switch {
+	case v.Pre == o.Pre:
+		return 0
+	case v.Pre == "":
+		return 1
+	case o.Pre == "":
+		return -1
+	default:
+		return comparePre(v.Pre, o.Pre)
+	}
+}
+
+// Compare dot separated pre-release identifiers one by one: numeric ones
+// numerically, others lexically, numeric before alphanumeric, and a shorter
+// list before a longer one it is a prefix of (SemVer §11)
+func comparePre(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.ParseUint(as[i], 10, 64)
+		bn, bErr := strconv.ParseUint(bs[i], 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if c := cmp.Compare(an, bn); c != 0 {
+				return c
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return cmp.Compare(len(as), len(bs))
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+func sign(n int) int {
+	if n < 0 {
+		return -1
+	}
+	return 1
+}
+
+type clause struct {
+	op      string
+	version Version
+}
+
+// Constraint is a comma separated list of clauses that must all match, e.g.
+// ">=1.2, <2". Supported operators are =, !=, >, >=, <, <=, ^ (same major)
+// and ~ (same minor). An empty constraint matches everything.
+type Constraint struct {
+	raw     string
+	clauses []clause
+}
+
+var operators = []string{">=", "<=", "!=", ">", "<", "=", "^", "~"}
+
+func ParseConstraint(raw string) (Constraint, error) {
+	c := Constraint{raw: strings.TrimSpace(raw)}
+	if c.raw == "" {
+		return c, nil
+	}
+
+	for _, part := range strings.Split(c.raw, ",") {
+		part = strings.TrimSpace(part)
+		op := "="
+		for _, candidate := range operators {
+			if strings.HasPrefix(part, candidate) {
+				op = candidate
+				part = strings.TrimSpace(strings.TrimPrefix(part, candidate))
+				break
+			}
+		}
+		v, err := Parse(part)
+		if err != nil {
+			return c, fmt.Errorf("invalid constraint %q: %w", raw, err)
+		}
+		c.clauses = append(c.clauses, clause{op: op, version: v})
+	}
+	return c, nil
+}
+
+func (c Constraint) String() string {
+	return c.raw
+}
+
+func (c Constraint) Matches(raw string) bool {
+	if len(c.clauses) == 0 {
+		return true
+	}
+	v, err := Parse(raw)
+	if err != nil {
+		return false
+	}
+
+	for _, cl := range c.clauses {
+		cmp := v.Compare(cl.version)
+		var ok bool
+		switch cl.op {
+		case "=":
+			ok = cmp == 0
+		case "!=":
+			ok = cmp != 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		case "^":
+			ok = cmp >= 0 && v.Major == cl.version.Major
+		case "~":
+			ok = cmp >= 0 && v.Major == cl.version.Major && v.Minor == cl.version.Minor
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Requirement is a service name with an optional version constraint, e.g.
+// "auth>=1.2" or "auth ^1, !=1.3.0"
+type Requirement struct {
+	Name       string
+	Constraint Constraint
+}
+
+func ParseRequirement(raw string) (Requirement, error) {
+	s := strings.TrimSpace(raw)
+	end := strings.IndexAny(s, "<>=!^~ ")
+	if end < 0 {
+		end = len(s)
+	}
+
+	r := Requirement{Name: s[:end]}
+	if r.Name == "" {
+		return r, fmt.Errorf("invalid requirement %q: no service name", raw)
+	}
+	var err error
+	r.Constraint, err = ParseConstraint(s[end:])
+	if err != nil {
+		return r, fmt.Errorf("invalid requirement %q: %w", raw, err)
+	}
+	return r, nil
+}
+
+func (r Requirement) String() string {
+	return r.Name + r.Constraint.String()
+}
@@ -0,0 +1,142 @@
+package semver
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want Version
+		// Whether Parse rejects raw
+		wantErr bool
+	}{
+		{raw: "1", want: Version{Major: 1}},
+		{raw: "1.2", want: Version{Major: 1, Minor: 2}},
+		{raw: "v1.2.3", want: Version{Major: 1, Minor: 2, Patch: 3}},
+		{raw: "1.2.3-rc.1", want: Version{Major: 1, Minor: 2, Patch: 3, Pre: "rc.1"}},
+		{raw: "1.2.3+build.5", want: Version{Major: 1, Minor: 2, Patch: 3}},
+		{raw: "1.2.3-rc.1+build-5", want: Version{Major: 1, Minor: 2, Patch: 3, Pre: "rc.1"}},
+		{raw: "", wantErr: true},
+		{raw: "1.2.3.4", wantErr: true},
+		{raw: "1.x", wantErr: true},
+		{raw: "1.-2", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := Parse(test.raw)
+		switch {
+		case test.wantErr && err == nil:
+			t.Errorf("Parse(%q) = %v, want an error", test.raw, got)
+		case !test.wantErr && err != nil:
+			t.Errorf("Parse(%q): %v", test.raw, err)
+		case !test.wantErr && got != test.want:
+			t.Errorf("Parse(%q) = %+v, want %+v", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	// Each version sorts before the next, the SemVer §11 example plus a few
+	ordered := []string{
+		"0.9.9",
+		"1.0.0-0",
+		"1.0.0-2",
+		"1.0.0-10",
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.2",
+		"1.0.0-alpha.10",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.1",
+		"1.1.0",
+		"2.0.0",
+	}
+
+	for i, a := range ordered {
+		for j, b := range ordered {
+			va, _ := Parse(a)
+			vb, _ := Parse(b)
+			want := 0
+			switch {
+			case i < j:
+				want = -1
+			case i > j:
+				want = 1
+			}
+			if got := va.Compare(vb); got != want {
+				t.Errorf("%s.Compare(%s) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestCompareIgnoresBuild(t *testing.T) {
+	a, _ := Parse("1.2.3+linux")
+	b, _ := Parse("1.2.3+darwin.7")
+	if got := a.Compare(b); got != 0 {
+		t.Errorf("got %d, want build metadata to be ignored", got)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{constraint: "", version: "0.1.0", want: true},
+		{constraint: ">=1.2", version: "1.2.0", want: true},
+		{constraint: ">=1.2", version: "1.1.9", want: false},
+		{constraint: ">=1.2, <2", version: "1.9.0", want: true},
+		{constraint: ">=1.2, <2", version: "2.0.0", want: false},
+		{constraint: "<2", version: "2.0.0-rc.1", want: true},
+		{constraint: ">1.0.0-alpha.2", version: "1.0.0-alpha.10", want: true},
+		{constraint: "=1.2.3", version: "1.2.3+build.1", want: true},
+		{constraint: "!=1.3.0", version: "1.3.0", want: false},
+		{constraint: "^1.2", version: "1.9.0", want: true},
+		{constraint: "^1.2", version: "2.0.0", want: false},
+		{constraint: "~1.2", version: "1.2.7", want: true},
+		{constraint: "~1.2", version: "1.3.0", want: false},
+		{constraint: ">=1", version: "not a version", want: false},
+	}
+
+	for _, test := range tests {
+		c, err := ParseConstraint(test.constraint)
+		if err != nil {
+			t.Fatalf("ParseConstraint(%q): %v", test.constraint, err)
+		}
+		if got := c.Matches(test.version); got != test.want {
+			t.Errorf("%q matches %q = %v, want %v", test.constraint, test.version, got, test.want)
+		}
+	}
+}
+
+func TestParseRequirement(t *testing.T) {
+	tests := []struct {
+		raw     string
+		name    string
+		wantErr bool
+	}{
+		{raw: "auth", name: "auth"},
+		{raw: "auth>=1.2", name: "auth"},
+		{raw: "auth ^1, !=1.3.0", name: "auth"},
+		{raw: ">=1.2", wantErr: true},
+		{raw: "auth>=one", wantErr: true},
+	}
+
+	for _, test := range tests {
+		r, err := ParseRequirement(test.raw)
+		switch {
+		case test.wantErr && err == nil:
+			t.Errorf("ParseRequirement(%q) = %v, want an error", test.raw, r)
+		case !test.wantErr && err != nil:
+			t.Errorf("ParseRequirement(%q): %v", test.raw, err)
+		case !test.wantErr && r.Name != test.name:
+			t.Errorf("ParseRequirement(%q) names %q, want %q", test.raw, r.Name, test.name)
+		}
+	}
+}
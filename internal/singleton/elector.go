@@ -0,0 +1,256 @@
+// Package singleton runs services marked singleton = true on only one of
+// the nodes they are installed on. Candidates compete for a lock kept by the
+// raft control plane. The holder renews it, and once the lock expired, e.g.
+// because the holder's node left the cluster, another candidate takes it over
+// and starts its instance.
+//
+// The control plane hands a lock to one holder at a time. A holder that cannot
+// renew its lock stops its instance before the lock can expire, so a new
+// holder never runs next to the old one. Without a control plane no singleton
+// is elected.
+package singleton
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/noahdw/Gonolith/api"
+	"github.com/noahdw/Gonolith/internal/microservice"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Name of the lock of a singleton is this followed by its name
+	LockPrefix = "singleton."
+	// How long a lease holds without renewals
+	LeaseTTL = 10 * time.Second
+	// How often the holder renews its lease
+	RenewInterval = 3 * time.Second
+	// How long the holder keeps its instance running without a confirmed
+	// renewal. Shorter than LeaseTTL so it is stopped before anyone else can
+	// get the lock.
+	RenewDeadline = LeaseTTL - RenewInterval
+)
+
+// The node's services as the election sees them, e.g. *microservice.Microservices
+type Candidates interface {
+	Singletons() []microservice.SingletonAPI
+	Promote(id string) error
+	Demote(id string) error
+}
+
+// The control plane's locks, e.g. *controlplane.GRPCServer which passes calls
+// on to the leader
+type Locks interface {
+	Acquire(context.Context, *api.AcquireLockRequest) (*api.Lock, error)
+	Renew(context.Context, *api.RenewLockRequest) (*api.Lock, error)
+	Release(context.Context, *api.ReleaseLockRequest) (*api.ReleaseLockResponse, error)
+	Get(context.Context, *api.GetLockRequest) (*api.Lock, error)
+}
+
+// A lock held for a local instance
+type lease struct {
+	id    string
+	token uint64
+	// When the last renewal the control plane confirmed was sent
+	renewed time.Time
+}
+
+type Elector struct {
+	services Candidates
+	locks    Locks
+
+	// Elections and releases take turns, and guard leases
+	mu sync.Mutex
+	// Locks held for local instances, by singleton name
+	leases map[string]lease
+}
+
+func NewElector(services Candidates, locks Locks) *Elector {
+	return &Elector{
+		services: services,
+		locks:    locks,
+		leases:   make(map[string]lease),
+	}
+}
+
+// Take part in the elections of the local singletons until ctx is done
+func (e *Elector) Start(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.elect()
+		}
+	}
+}
+
+func (e *Elector) elect() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Instances that hold their lock go first, only one local instance per
+	// singleton competes at a time
+	singletons := e.services.Singletons()
+	competing := make(map[string]bool)
+	for _, instance := range singletons {
+		held, has := e.leases[instance.Name]
+		if !has || held.id != instance.Id {
+			continue
+		}
+		if !instance.Candidate {
+			e.release(instance.Name, held)
+			continue
+		}
+		competing[instance.Name] = true
+		if e.renew(instance.Name, held) {
+			e.promote(instance)
+		} else {
+			e.demote(instance)
+		}
+	}
+
+	for _, instance := range singletons {
+		if held, has := e.leases[instance.Name]; has && held.id == instance.Id {
+			continue
+		}
+		switch {
+		case !instance.Candidate:
+		case competing[instance.Name]:
+			e.demote(instance)
+		default:
+			competing[instance.Name] = true
+			if e.acquire(instance) {
+				e.promote(instance)
+			} else {
+				e.demote(instance)
+			}
+		}
+	}
+}
+
+// Give up the lock a local instance holds right away, so a candidate on
+// another node takes over without waiting for it to expire. The instance must
+// be out of the election already or it claims the lock again.
+func (e *Elector) Release(name, id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if held, has := e.leases[name]; has && held.id == id {
+		e.release(name, held)
+	}
+}
+
+func callContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 2*time.Second)
+}
+
+// Take the lock of a singleton for instance, reports whether it holds it
+func (e *Elector) acquire(instance microservice.SingletonAPI) bool {
+	ctx, cancel := callContext()
+	defer cancel()
+
+	name := LockPrefix + instance.Name
+	sent := time.Now()
+	lock, err := e.locks.Acquire(ctx, &api.AcquireLockRequest{
+		Name:       name,
+		Holder:     instance.Id,
+		TtlSeconds: uint32(LeaseTTL / time.Second),
+	})
+	switch status.Code(err) {
+	case codes.OK:
+		slog.Info("Won singleton lease", "name", instance.Name, "id", instance.Id, "token", lock.Token)
+		e.leases[instance.Name] = lease{id: instance.Id, token: lock.Token, renewed: sent}
+		return true
+	case codes.FailedPrecondition:
+	default:
+		slog.Debug("Cannot claim singleton lease", "name", instance.Name, "error", err)
+		return false
+	}
+
+	// The instance may hold it already when the answer to an earlier claim
+	// got lost. Its id is its own, so its token is too.
+	lock, err = e.locks.Get(ctx, &api.GetLockRequest{Name: name})
+	if err != nil || lock.Holder != instance.Id {
+		return false
+	}
+	held := lease{id: instance.Id, token: lock.Token}
+	e.leases[instance.Name] = held
+	return e.renew(instance.Name, held)
+}
+
+// Keep the lock of a singleton, reports whether its instance may keep running
+func (e *Elector) renew(name string, held lease) bool {
+	if time.Since(held.renewed) < RenewInterval {
+		return true
+	}
+	ctx, cancel := callContext()
+	defer cancel()
+
+	sent := time.Now()
+	lock, err := e.locks.Renew(ctx, &api.RenewLockRequest{
+		Name:       LockPrefix + name,
+		Token:      held.token,
+		TtlSeconds: uint32(LeaseTTL / time.Second),
+	})
+	switch {
+	case err == nil && lock.Token == held.token:
+		held.renewed = sent
+		e.leases[name] = held
+		return true
+	case status.Code(err) == codes.NotFound:
+		slog.Warn("Lost singleton lease", "name", name, "id", held.id)
+		delete(e.leases, name)
+		return false
+	case time.Since(held.renewed) >= RenewDeadline:
+		// It may expire any moment and go to another candidate
+		slog.Warn("Cannot renew singleton lease in time, giving it up", "name", name, "id", held.id, "error", err)
+		delete(e.leases, name)
+		return false
+	default:
+		slog.Debug("Cannot renew singleton lease, retrying", "name", name, "error", err)
+		return true
+	}
+}
+
+// Give up a lock so a candidate on another node can take over right away
+func (e *Elector) release(name string, held lease) {
+	slog.Info("Releasing singleton lease", "name", name, "id", held.id)
+	delete(e.leases, name)
+
+	ctx, cancel := callContext()
+	defer cancel()
+	_, err := e.locks.Release(ctx, &api.ReleaseLockRequest{Name: LockPrefix + name, Token: held.token})
+	if err != nil && status.Code(err) != codes.NotFound {
+		// It expires on its own
+		slog.Error("Cannot release singleton lease", "name", name, "error", err)
+	}
+}
+
+func (e *Elector) promote(instance microservice.SingletonAPI) {
+	if instance.Status == "running" || instance.Status == microservice.StatusWaiting {
+		return
+	}
+	if err := e.services.Promote(instance.Id); err != nil {
+		// Let another candidate try
+		slog.Error("Cannot start elected singleton", "id", instance.Id, "error", err)
+		if held, has := e.leases[instance.Name]; has {
+			e.release(instance.Name, held)
+		}
+	}
+}
+
+func (e *Elector) demote(instance microservice.SingletonAPI) {
+	if instance.Status != "running" && instance.Status != microservice.StatusWaiting {
+		return
+	}
+	if err := e.services.Demote(instance.Id); err != nil {
+		slog.Error("Cannot stop singleton that lost its lease", "id", instance.Id, "error", err)
+	}
+}
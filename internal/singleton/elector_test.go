@@ -0,0 +1,311 @@
+package singleton
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/noahdw/Gonolith/api"
+	"github.com/noahdw/Gonolith/internal/microservice"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Locks as the control plane leader keeps them. Locks only expire when a
+// test says so.
+type fakeLocks struct {
+	mu    sync.Mutex
+	locks map[string]*api.Lock
+	next  uint64
+}
+
+func newFakeLocks() *fakeLocks {
+	return &fakeLocks{locks: make(map[string]*api.Lock)}
+}
+
+func (f *fakeLocks) expire(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.locks, name)
+}
+
+func (f *fakeLocks) holder(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if lock, has := f.locks[name]; has {
+		return lock.Holder
+	}
+	return ""
+}
+
+func (f *fakeLocks) Acquire(ctx context.Context, req *api.AcquireLockRequest) (*api.Lock, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, held := f.locks[req.Name]; held {
+		return nil, status.Error(codes.FailedPrecondition, "held")
+	}
+	f.next++
+	lock := &api.Lock{Name: req.Name, Holder: req.Holder, Token: f.next}
+	f.locks[req.Name] = lock
+	return lock, nil
+}
+
+func (f *fakeLocks) Renew(ctx context.Context, req *api.RenewLockRequest) (*api.Lock, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lock, held := f.locks[req.Name]
+	if !held || lock.Token != req.Token {
+		return nil, status.Error(codes.NotFound, "lost")
+	}
+	return lock, nil
+}
+
+func (f *fakeLocks) Release(ctx context.Context, req *api.ReleaseLockRequest) (*api.ReleaseLockResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lock, held := f.locks[req.Name]
+	if !held || lock.Token != req.Token {
+		return nil, status.Error(codes.NotFound, "lost")
+	}
+	delete(f.locks, req.Name)
+	return &api.ReleaseLockResponse{}, nil
+}
+
+func (f *fakeLocks) Get(ctx context.Context, req *api.GetLockRequest) (*api.Lock, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lock, held := f.locks[req.Name]
+	if !held {
+		return nil, status.Error(codes.NotFound, "free")
+	}
+	return lock, nil
+}
+
+// The control plane as one node reaches it
+type link struct {
+	*fakeLocks
+	// The node cannot reach the leader
+	down bool
+	// The leader commits the next acquisition but its answer gets lost
+	loseAnswer bool
+}
+
+func (l *link) Acquire(ctx context.Context, req *api.AcquireLockRequest) (*api.Lock, error) {
+	if l.down {
+		return nil, status.Error(codes.Unavailable, "down")
+	}
+	lock, err := l.fakeLocks.Acquire(ctx, req)
+	if err == nil && l.loseAnswer {
+		l.loseAnswer = false
+		return nil, status.Error(codes.Unavailable, "answer lost")
+	}
+	return lock, err
+}
+
+func (l *link) Renew(ctx context.Context, req *api.RenewLockRequest) (*api.Lock, error) {
+	if l.down {
+		return nil, status.Error(codes.Unavailable, "down")
+	}
+	return l.fakeLocks.Renew(ctx, req)
+}
+
+// The singletons of one node
+type fakeCandidates struct {
+	instances map[string]*microservice.SingletonAPI
+}
+
+func (f *fakeCandidates) Singletons() []microservice.SingletonAPI {
+	var singletons []microservice.SingletonAPI
+	for _, instance := range f.instances {
+		singletons = append(singletons, *instance)
+	}
+	return singletons
+}
+
+func (f *fakeCandidates) Promote(id string) error {
+	f.instances[id].Status = "running"
+	return nil
+}
+
+func (f *fakeCandidates) Demote(id string) error {
+	f.instances[id].Status = microservice.StatusStandby
+	return nil
+}
+
+type node struct {
+	elector  *Elector
+	link     *link
+	services *fakeCandidates
+	id       string
+}
+
+func newNode(locks *fakeLocks, id string) *node {
+	services := &fakeCandidates{instances: map[string]*microservice.SingletonAPI{
+		id: {Id: id, Name: "billing", Candidate: true, Status: microservice.StatusStandby},
+	}}
+	l := &link{fakeLocks: locks}
+	return &node{elector: NewElector(services, l), link: l, services: services, id: id}
+}
+
+func (n *node) status() string {
+	return n.services.instances[n.id].Status
+}
+
+// What an operator stop does to the instance
+func (n *node) stop() {
+	instance := n.services.instances[n.id]
+	instance.Candidate = false
+	instance.Status = "stopped"
+}
+
+func running(nodes ...*node) int {
+	count := 0
+	for _, n := range nodes {
+		if n.status() == "running" {
+			count++
+		}
+	}
+	return count
+}
+
+const lockName = LockPrefix + "billing"
+
+func TestOneCandidateRuns(t *testing.T) {
+	locks := newFakeLocks()
+	a, b := newNode(locks, "svc-a"), newNode(locks, "svc-b")
+
+	for range 3 {
+		a.elector.elect()
+		b.elector.elect()
+	}
+	if a.status() != "running" || b.status() != microservice.StatusStandby {
+		t.Fatalf("a is %s and b is %s, want a running and b standby", a.status(), b.status())
+	}
+	if holder := locks.holder(lockName); holder != "svc-a" {
+		t.Fatalf("lock is held by %q, want svc-a", holder)
+	}
+}
+
+func TestTakeoverOnExpiry(t *testing.T) {
+	locks := newFakeLocks()
+	a, b := newNode(locks, "svc-a"), newNode(locks, "svc-b")
+	a.elector.elect()
+	b.elector.elect()
+
+	// Cut off from the leader, a cannot renew and stops its instance before
+	// the lock may expire
+	a.link.down = true
+	a.elector.elect()
+	if a.status() != "running" {
+		t.Fatal("a stopped before its renewal deadline")
+	}
+	held := a.elector.leases["billing"]
+	held.renewed = time.Now().Add(-RenewDeadline)
+	a.elector.leases["billing"] = held
+	a.elector.elect()
+	if a.status() != microservice.StatusStandby {
+		t.Fatalf("a is %s after its renewal deadline, want standby", a.status())
+	}
+
+	b.elector.elect()
+	if b.status() != microservice.StatusStandby {
+		t.Fatal("b took over before the lock expired")
+	}
+	locks.expire(lockName)
+	b.elector.elect()
+	if b.status() != "running" {
+		t.Fatalf("b is %s after the lock expired, want running", b.status())
+	}
+
+	// Back in touch, a stays out
+	a.link.down = false
+	a.elector.elect()
+	if running(a, b) != 1 || a.status() == "running" {
+		t.Fatalf("a is %s and b is %s after a came back", a.status(), b.status())
+	}
+}
+
+func TestTakeoverOnRelease(t *testing.T) {
+	locks := newFakeLocks()
+	a, b := newNode(locks, "svc-a"), newNode(locks, "svc-b")
+	a.elector.elect()
+	b.elector.elect()
+
+	// What a drain does: stop the instance, then release its lock
+	a.stop()
+	a.elector.Release("billing", "svc-a")
+	if holder := locks.holder(lockName); holder != "" {
+		t.Fatalf("lock is still held by %q", holder)
+	}
+	b.elector.elect()
+	if b.status() != "running" {
+		t.Fatalf("b is %s after a released the lock, want running", b.status())
+	}
+
+	// A stopped instance stays out of the election
+	a.elector.elect()
+	if a.status() != "stopped" {
+		t.Fatalf("a is %s, want stopped", a.status())
+	}
+}
+
+func TestTakeoverOnNodeDeparture(t *testing.T) {
+	locks := newFakeLocks()
+	a, b := newNode(locks, "svc-a"), newNode(locks, "svc-b")
+	a.elector.elect()
+	b.elector.elect()
+
+	// a's node is gone and renews nothing, its lock runs out
+	for range 3 {
+		b.elector.elect()
+	}
+	if b.status() != microservice.StatusStandby {
+		t.Fatal("b took over a lock that has not expired")
+	}
+	locks.expire(lockName)
+	b.elector.elect()
+	if b.status() != "running" {
+		t.Fatalf("b is %s after a's lock expired, want running", b.status())
+	}
+	if holder := locks.holder(lockName); holder != "svc-b" {
+		t.Fatalf("lock is held by %q, want svc-b", holder)
+	}
+}
+
+func TestLostAnswerKeepsLock(t *testing.T) {
+	locks := newFakeLocks()
+	a := newNode(locks, "svc-a")
+	a.link.loseAnswer = true
+
+	a.elector.elect()
+	if a.status() == "running" {
+		t.Fatal("a runs without knowing it holds the lock")
+	}
+	a.elector.elect()
+	if a.status() != "running" {
+		t.Fatalf("a is %s, want running with the lock it already holds", a.status())
+	}
+	if token := a.elector.leases["billing"].token; token != 1 {
+		t.Fatalf("token is %d, want 1", token)
+	}
+}
+
+func TestStaleTokenStops(t *testing.T) {
+	locks := newFakeLocks()
+	a := newNode(locks, "svc-a")
+	a.elector.elect()
+
+	// Expired and taken by someone else meanwhile
+	locks.expire(lockName)
+	if _, err := locks.Acquire(context.Background(), &api.AcquireLockRequest{Name: lockName, Holder: "svc-x"}); err != nil {
+		t.Fatal(err)
+	}
+	held := a.elector.leases["billing"]
+	held.renewed = time.Now().Add(-RenewInterval)
+	a.elector.leases["billing"] = held
+	a.elector.elect()
+	if a.status() != microservice.StatusStandby {
+		t.Fatalf("a is %s with a stale token, want standby", a.status())
+	}
+}
@@ -0,0 +1,220 @@
+package system
+
+import (
+	"slices"
+	"sort"
+
+	"github.com/noahdw/Gonolith/internal/cluster"
+	"github.com/noahdw/Gonolith/internal/semver"
+)
+
+// Overall state of the system
+const (
+	// Every service is up and so is everything it requires
+	StatusReady = "ready"
+	// Only non-critical services are affected
+	StatusDegraded = "degraded"
+	// A critical service is down or requires something that is
+	StatusDown = "down"
+)
+
+// State of one service across the cluster
+const (
+	// At least one healthy instance
+	ServiceUp = "up"
+	// Installed, but no instance is healthy
+	ServiceDown = "down"
+	// Required by another service but not installed anywhere
+	ServiceMissing = "missing"
+)
+
+type ServiceHealthAPI struct {
+	Name     string `json:"name"`
+	Critical bool   `json:"critical"`
+	State    string `json:"state"`
+	Healthy  int    `json:"healthy"`
+	// Instances across the cluster, whatever their state
+	Instances int      `json:"instances"`
+	Requires  []string `json:"requires"`
+	// Down or requires, directly or not, a service that is
+	Affected bool `json:"affected"`
+	// The services that explain why this one is affected
+	RootCauses []string `json:"root_causes,omitempty"`
+}
+
+type SystemHealthAPI struct {
+	Status     string             `json:"status"`
+	RootCauses []string           `json:"root_causes"`
+	Services   []ServiceHealthAPI `json:"services"`
+}
+
+// Evaluate the dependency graph of every service in the cluster. A service is
+// a root cause when it is down or missing while everything it requires is
+// fine, so services that fail only because of their dependencies point at
+// those dependencies instead.
+func Evaluate(state cluster.ClusterStateAPI) SystemHealthAPI {
+	services := make(map[string]*ServiceHealthAPI)
+	get := func(name string) *ServiceHealthAPI {
+		service, has := services[name]
+		if !has {
+			service = &ServiceHealthAPI{Name: name, State: ServiceMissing, Requires: []string{}}
+			services[name] = service
+		}
+		return service
+	}
+
+	for _, node := range state.Nodes {
+		for _, instance := range node.Services {
+			service := get(instance.Name)
+			service.Instances++
+			if instance.Critical {
+				service.Critical = true
+			}
+			if instance.Healthy() {
+				service.Healthy++
+			}
+			for _, raw := range instance.Requires {
+				req, err := semver.ParseRequirement(raw)
+				if err != nil {
+					continue
+				}
+				if !slices.Contains(service.Requires, req.Name) {
+					service.Requires = append(service.Requires, req.Name)
+				}
+			}
+		}
+	}
+
+	// Requirements nobody installed show up as missing services
+	for _, name := range sortedNames(services) {
+		for _, dep := range services[name].Requires {
+			get(dep)
+		}
+	}
+	for _, service := range services {
+		switch {
+		case service.Healthy > 0:
+			service.State = ServiceUp
+		case service.Instances > 0:
+			service.State = ServiceDown
+		}
+	}
+
+	causes := rootCauses(services)
+
+	result := SystemHealthAPI{
+		Status:     StatusReady,
+		RootCauses: []string{},
+		Services:   make([]ServiceHealthAPI, 0, len(services)),
+	}
+	for _, name := range sortedNames(services) {
+		service := services[name]
+		service.RootCauses = causes[name]
+		service.Affected = len(service.RootCauses) > 0
+		sort.Strings(service.Requires)
+		result.Services = append(result.Services, *service)
+
+		if !service.Affected {
+			continue
+		}
+		for _, cause := range service.RootCauses {
+			if !slices.Contains(result.RootCauses, cause) {
+				result.RootCauses = append(result.RootCauses, cause)
+			}
+		}
+		// Missing services were never declared critical, what requires them is
+		// what decides
+		if service.Critical {
+			result.Status = StatusDown
+		} else if result.Status == StatusReady {
+			result.Status = StatusDegraded
+		}
+	}
+	sort.Strings(result.RootCauses)
+	return result
+}
+
+// Root causes per service. Gossiped requirements may form cycles, and every
+// service on a cycle requires all the others, so the services of a strongly
+// connected component share their root causes: those of the services they
+// require outside of it, or else their own members that are down.
+func rootCauses(services map[string]*ServiceHealthAPI) map[string][]string {
+	causes := make(map[string][]string)
+	// Tarjan's algorithm, which finishes a component only after every
+	// component it requires
+	index := make(map[string]int)
+	lowlink := make(map[string]int)
+	onStack := make(map[string]bool)
+	var stack []string
+	var visit func(name string)
+	visit = func(name string) {
+		index[name] = len(index)
+		lowlink[name] = index[name]
+		stack = append(stack, name)
+		onStack[name] = true
+
+		for _, dep := range services[name].Requires {
+			if _, seen := index[dep]; !seen {
+				visit(dep)
+				lowlink[name] = min(lowlink[name], lowlink[dep])
+			} else if onStack[dep] {
+				lowlink[name] = min(lowlink[name], index[dep])
+			}
+		}
+		if lowlink[name] != index[name] {
+			return
+		}
+
+		var component []string
+		for {
+			member := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[member] = false
+			component = append(component, member)
+			if member == name {
+				break
+			}
+		}
+
+		var found []string
+		for _, member := range component {
+			for _, dep := range services[member].Requires {
+				if slices.Contains(component, dep) {
+					continue
+				}
+				for _, cause := range causes[dep] {
+					if !slices.Contains(found, cause) {
+						found = append(found, cause)
+					}
+				}
+			}
+		}
+		if len(found) == 0 {
+			for _, member := range component {
+				if services[member].State != ServiceUp {
+					found = append(found, member)
+				}
+			}
+		}
+		sort.Strings(found)
+		for _, member := range component {
+			causes[member] = found
+		}
+	}
+
+	for _, name := range sortedNames(services) {
+		if _, seen := index[name]; !seen {
+			visit(name)
+		}
+	}
+	return causes
+}
+
+func sortedNames(services map[string]*ServiceHealthAPI) []string {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,143 @@
+package system
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/noahdw/Gonolith/internal/cluster"
+	"github.com/noahdw/Gonolith/internal/microservice"
+)
+
+// An instance that is healthy when up
+func instance(name string, up bool, requires ...string) microservice.MicroserviceStatusAPI {
+	status := microservice.MicroserviceStatusAPI{Name: name, Status: "stopped", Critical: true, Requires: requires}
+	if up {
+		status.Status = "running"
+		status.Health = microservice.HealthServing
+	}
+	return status
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name      string
+		instances []microservice.MicroserviceStatusAPI
+		status    string
+		causes    []string
+		// Services that are affected, every other one is not
+		affected []string
+	}{
+		{
+			name:      "nothing installed",
+			instances: nil,
+			status:    StatusReady,
+			causes:    []string{},
+		},
+		{
+			name:      "all up",
+			instances: []microservice.MicroserviceStatusAPI{instance("api", true, "auth"), instance("auth", true)},
+			status:    StatusReady,
+			causes:    []string{},
+		},
+		{
+			name:      "dependency down",
+			instances: []microservice.MicroserviceStatusAPI{instance("api", true, "auth >= 1.0.0"), instance("auth", false)},
+			status:    StatusDown,
+			causes:    []string{"auth"},
+			affected:  []string{"api", "auth"},
+		},
+		{
+			name:      "dependency missing",
+			instances: []microservice.MicroserviceStatusAPI{instance("api", true, "auth")},
+			status:    StatusDown,
+			causes:    []string{"auth"},
+			affected:  []string{"api", "auth"},
+		},
+		{
+			name:      "down because of a dependency",
+			instances: []microservice.MicroserviceStatusAPI{instance("api", false, "auth"), instance("auth", false)},
+			status:    StatusDown,
+			causes:    []string{"auth"},
+			affected:  []string{"api", "auth"},
+		},
+		{
+			name: "one healthy instance is enough",
+			instances: []microservice.MicroserviceStatusAPI{
+				instance("auth", false), instance("auth", true), instance("api", true, "auth"),
+			},
+			status: StatusReady,
+			causes: []string{},
+		},
+		{
+			name: "non-critical service down",
+			instances: []microservice.MicroserviceStatusAPI{
+				{Name: "report", Status: "stopped"}, instance("api", true),
+			},
+			status:   StatusDegraded,
+			causes:   []string{"report"},
+			affected: []string{"report"},
+		},
+		{
+			name:      "cycle with the first service down",
+			instances: []microservice.MicroserviceStatusAPI{instance("a", false, "b"), instance("b", true, "a")},
+			status:    StatusDown,
+			causes:    []string{"a"},
+			affected:  []string{"a", "b"},
+		},
+		{
+			name:      "cycle with the last service down",
+			instances: []microservice.MicroserviceStatusAPI{instance("a", true, "b"), instance("b", false, "a")},
+			status:    StatusDown,
+			causes:    []string{"b"},
+			affected:  []string{"a", "b"},
+		},
+		{
+			name:      "cycle all up",
+			instances: []microservice.MicroserviceStatusAPI{instance("a", true, "b"), instance("b", true, "a")},
+			status:    StatusReady,
+			causes:    []string{},
+		},
+		{
+			name: "cycle down because of a dependency",
+			instances: []microservice.MicroserviceStatusAPI{
+				instance("a", false, "b"), instance("b", true, "a", "c"), instance("c", false),
+			},
+			status:   StatusDown,
+			causes:   []string{"c"},
+			affected: []string{"a", "b", "c"},
+		},
+		{
+			name: "requires a cycle",
+			instances: []microservice.MicroserviceStatusAPI{
+				instance("api", true, "b"), instance("b", true, "c"), instance("c", false, "b"),
+			},
+			status:   StatusDown,
+			causes:   []string{"c"},
+			affected: []string{"api", "b", "c"},
+		},
+		{
+			name:      "requires itself",
+			instances: []microservice.MicroserviceStatusAPI{instance("a", false, "a")},
+			status:    StatusDown,
+			causes:    []string{"a"},
+			affected:  []string{"a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			health := Evaluate(cluster.ClusterStateAPI{Nodes: []cluster.NodeState{{Name: "node", Services: test.instances}}})
+			if health.Status != test.status {
+				t.Errorf("status is %q, want %q", health.Status, test.status)
+			}
+			if !slices.Equal(health.RootCauses, test.causes) {
+				t.Errorf("root causes are %v, want %v", health.RootCauses, test.causes)
+			}
+			for _, service := range health.Services {
+				if want := slices.Contains(test.affected, service.Name); service.Affected != want {
+					t.Errorf("%s: affected is %v, want %v", service.Name, service.Affected, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package system
+
+import (
+	"net/http"
+
+	"github.com/noahdw/Gonolith/internal/cluster"
+	"github.com/noahdw/Gonolith/internal/httpapi"
+)
+
+type SystemHandler struct {
+	cluster *cluster.Cluster
+}
+
+func NewSystemHandler(c *cluster.Cluster) *SystemHandler {
+	return &SystemHandler{
+		cluster: c,
+	}
+}
+
+// GET /v1/system/health, 503 when the system is down so it can be used as a
+// readiness probe
+func (h *SystemHandler) HandleGetHealth(w http.ResponseWriter, r *http.Request) {
+	result := Evaluate(h.cluster.State())
+
+	status := http.StatusOK
+	if result.Status == StatusDown {
+		status = http.StatusServiceUnavailable
+	}
+	httpapi.WriteJSON(w, status, result)
+}
@@ -0,0 +1,391 @@
+// Package wasm runs services compiled to WebAssembly inside the node process.
+//
+// A module serves calls through two exports:
+//
+//	gonolith_alloc(size i32) i32
+//	    memory for the host to write a call into, owned by the module
+//	gonolith_handle(method_ptr, method_len, req_ptr, req_len i32) i64
+//	    handles "/pkg.Service/Method" with a serialized request and returns
+//	    ptr<<32 | len of the serialized response, or of an error message with
+//	    the length negated
+//
+// and can import from the "gonolith" host module:
+//
+//	log(level, msg_ptr, msg_len i32)
+//	    level is 0 debug, 1 info, 2 warn, 3 error
+//	config(key_ptr, key_len i32) i32
+//	    length of a [config] value from config.toml, -1 when it is not set
+//	call(method_ptr, method_len, req_ptr, req_len i32) i32
+//	    calls another service, in-process when it runs as WebAssembly on the
+//	    same node. Returns the length of the response, or the negated length of
+//	    an error message.
+//	take_result(ptr i32)
+//	    copies the value of the last config or call into module memory
+//
+// Modules may also use WASI, e.g. Go built with GOOS=wasip1 and
+// -buildmode=c-shared.
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Host carries calls modules make to other services
+type Host interface {
+	Invoke(ctx context.Context, method string, req []byte) ([]byte, error)
+}
+
+// Limits of every module
+const (
+	// Linear memory of one instance, in 64 KiB pages: 64 MiB
+	MaxMemoryPages = 1024
+	// Instances of one module, which is how many calls it serves at once.
+	// More calls wait for one of them to be free.
+	MaxInstances = 16
+)
+
+// Runtime compiles and runs every WebAssembly service of the node
+type Runtime struct {
+	runtime wazero.Runtime
+	host    Host
+}
+
+func NewRuntime(ctx context.Context, host Host) (*Runtime, error) {
+	r := &Runtime{
+		// A call whose context ends, e.g. a client that gave up, is
+		// interrupted instead of running on
+		runtime: wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+			WithCloseOnContextDone(true).
+			WithMemoryLimitPages(MaxMemoryPages)),
+		host: host,
+	}
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r.runtime); err != nil {
+		return nil, err
+	}
+
+	_, err := r.runtime.NewHostModuleBuilder("gonolith").
+		NewFunctionBuilder().WithFunc(hostLog).Export("log").
+		NewFunctionBuilder().WithFunc(hostConfig).Export("config").
+		NewFunctionBuilder().WithFunc(r.hostCall).Export("call").
+		NewFunctionBuilder().WithFunc(hostTakeResult).Export("take_result").
+		Instantiate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Module is a loaded service. Instances are created on demand so calls run
+// concurrently and a module can be called again while it is calling out.
+type Module struct {
+	id       string
+	runtime  *Runtime
+	compiled wazero.CompiledModule
+	config   map[string]string
+	env      []string
+
+	// Holds a value for every instance serving a call
+	busy chan struct{}
+
+	mu     sync.Mutex
+	idle   []*instance
+	live   map[*instance]struct{}
+	next   int
+	closed bool
+}
+
+type instance struct {
+	module *Module
+	mod    api.Module
+	// Value for the next take_result
+	result []byte
+}
+
+// Compile a module and instantiate it once to make sure it starts
+func (r *Runtime) Load(ctx context.Context, id string, code []byte, config map[string]string, env []string) (*Module, error) {
+	compiled, err := r.runtime.CompileModule(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("invalid module: %w", err)
+	}
+	for _, export := range []string{"gonolith_alloc", "gonolith_handle"} {
+		if _, has := compiled.ExportedFunctions()[export]; !has {
+			compiled.Close(ctx)
+			return nil, fmt.Errorf("module does not export %s", export)
+		}
+	}
+
+	m := &Module{
+		id:       id,
+		runtime:  r,
+		compiled: compiled,
+		config:   config,
+		env:      env,
+		live:     make(map[*instance]struct{}),
+		busy:     make(chan struct{}, MaxInstances),
+	}
+	inst, err := m.instantiate(ctx)
+	if err != nil {
+		compiled.Close(ctx)
+		return nil, err
+	}
+	m.idle = append(m.idle, inst)
+	return m, nil
+}
+
+func (m *Module) instantiate(ctx context.Context) (*instance, error) {
+	m.mu.Lock()
+	m.next++
+	name := fmt.Sprintf("%s-%d", m.id, m.next)
+	m.mu.Unlock()
+
+	cfg := wazero.NewModuleConfig().
+		WithName(name).
+		WithStartFunctions().
+		WithStdout(os.Stdout).
+		WithStderr(os.Stderr).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithArgs(m.id)
+	for _, env := range m.env {
+		key, value, _ := strings.Cut(env, "=")
+		cfg = cfg.WithEnv(key, value)
+	}
+
+	mod, err := m.runtime.runtime.InstantiateModule(ctx, m.compiled, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot instantiate module: %w", err)
+	}
+	inst := &instance{module: m, mod: mod}
+
+	// Reactor modules, e.g. Go with -buildmode=c-shared, initialize here
+	if init := mod.ExportedFunction("_initialize"); init != nil {
+		if _, err := init.Call(withInstance(ctx, inst)); err != nil {
+			mod.Close(ctx)
+			return nil, fmt.Errorf("module failed to initialize: %w", err)
+		}
+	}
+	m.mu.Lock()
+	m.live[inst] = struct{}{}
+	m.mu.Unlock()
+	return inst, nil
+}
+
+// An idle instance, or a new one while there are fewer than MaxInstances.
+// Waits for one to be released otherwise.
+func (m *Module) acquire(ctx context.Context) (*instance, error) {
+	select {
+	case m.busy <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("all %d instances are busy: %w", MaxInstances, ctx.Err())
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		<-m.busy
+		return nil, errors.New("module is stopped")
+	}
+	if n := len(m.idle); n > 0 {
+		inst := m.idle[n-1]
+		m.idle = m.idle[:n-1]
+		m.mu.Unlock()
+		return inst, nil
+	}
+	m.mu.Unlock()
+
+	inst, err := m.instantiate(ctx)
+	if err != nil {
+		<-m.busy
+		return nil, err
+	}
+	return inst, nil
+}
+
+func (m *Module) release(ctx context.Context, inst *instance) {
+	defer func() { <-m.busy }()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed || inst.mod.IsClosed() {
+		delete(m.live, inst)
+		inst.mod.Close(ctx)
+		return
+	}
+	inst.result = nil
+	m.idle = append(m.idle, inst)
+}
+
+// Handle a unary call, e.g. "/greeting.Greeter/SayHello", with a serialized
+// request
+func (m *Module) Handle(ctx context.Context, method string, req []byte) ([]byte, error) {
+	inst, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.release(ctx, inst)
+	ctx = withInstance(ctx, inst)
+
+	methodPtr, err := inst.write(ctx, []byte(method))
+	if err != nil {
+		return nil, err
+	}
+	reqPtr, err := inst.write(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := inst.mod.ExportedFunction("gonolith_handle").Call(ctx,
+		uint64(methodPtr), uint64(len(method)), uint64(reqPtr), uint64(len(req)))
+	if err != nil {
+		return nil, fmt.Errorf("module trapped: %w", err)
+	}
+
+	ptr, length := uint32(results[0]>>32), int32(uint32(results[0]))
+	failed := length < 0
+	if failed {
+		length = -length
+	}
+	out, ok := inst.mod.Memory().Read(ptr, uint32(length))
+	if !ok {
+		return nil, errors.New("module returned a result outside its memory")
+	}
+	// Memory may be reused by the next call
+	out = append([]byte(nil), out...)
+	if failed {
+		return nil, &ModuleError{Message: string(out)}
+	}
+	return out, nil
+}
+
+// Copy data into memory the module allocated for it
+func (inst *instance) write(ctx context.Context, data []byte) (uint32, error) {
+	results, err := inst.mod.ExportedFunction("gonolith_alloc").Call(ctx, uint64(len(data)))
+	if err != nil {
+		return 0, fmt.Errorf("gonolith_alloc failed: %w", err)
+	}
+	ptr := uint32(results[0])
+	if !inst.mod.Memory().Write(ptr, data) {
+		return 0, errors.New("gonolith_alloc returned memory outside the module")
+	}
+	return ptr, nil
+}
+
+// Close every instance, calls in progress fail
+func (m *Module) Close(ctx context.Context) error {
+	m.mu.Lock()
+	m.closed = true
+	idle := m.idle
+	m.idle = nil
+	m.mu.Unlock()
+
+	for _, inst := range idle {
+		m.mu.Lock()
+		delete(m.live, inst)
+		m.mu.Unlock()
+		inst.mod.Close(ctx)
+	}
+	return m.compiled.Close(ctx)
+}
+
+// Number of instances and the memory they use in bytes
+func (m *Module) Stats() (instances int, memory uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for inst := range m.live {
+		if mem := inst.mod.Memory(); mem != nil {
+			memory += uint64(mem.Size())
+		}
+	}
+	return len(m.live), memory
+}
+
+// Error a module returned for a call
+type ModuleError struct {
+	Message string
+}
+
+func (e *ModuleError) Error() string {
+	return e.Message
+}
+
+type instanceKey struct{}
+
+func withInstance(ctx context.Context, inst *instance) context.Context {
+	return context.WithValue(ctx, instanceKey{}, inst)
+}
+
+func instanceFrom(ctx context.Context) *instance {
+	inst, _ := ctx.Value(instanceKey{}).(*instance)
+	return inst
+}
+
+func readString(mod api.Module, ptr, length uint32) string {
+	data, _ := mod.Memory().Read(ptr, length)
+	return string(data)
+}
+
+func hostLog(ctx context.Context, mod api.Module, level, ptr, length uint32) {
+	id := ""
+	if inst := instanceFrom(ctx); inst != nil {
+		id = inst.module.id
+	}
+	msg := readString(mod, ptr, length)
+	switch level {
+	case 0:
+		slog.Debug(msg, "service", id)
+	case 1:
+		slog.Info(msg, "service", id)
+	case 2:
+		slog.Warn(msg, "service", id)
+	default:
+		slog.Error(msg, "service", id)
+	}
+}
+
+func hostConfig(ctx context.Context, mod api.Module, ptr, length uint32) int32 {
+	inst := instanceFrom(ctx)
+	if inst == nil {
+		return -1
+	}
+	value, has := inst.module.config[readString(mod, ptr, length)]
+	if !has {
+		return -1
+	}
+	inst.result = []byte(value)
+	return int32(len(value))
+}
+
+func (r *Runtime) hostCall(ctx context.Context, mod api.Module, methodPtr, methodLen, reqPtr, reqLen uint32) int32 {
+	inst := instanceFrom(ctx)
+	if inst == nil {
+		return 0
+	}
+	method := readString(mod, methodPtr, methodLen)
+	req, _ := mod.Memory().Read(reqPtr, reqLen)
+
+	resp, err := r.host.Invoke(ctx, method, append([]byte(nil), req...))
+	if err != nil {
+		inst.result = []byte(err.Error())
+		return -int32(len(inst.result))
+	}
+	inst.result = resp
+	return int32(len(resp))
+}
+
+func hostTakeResult(ctx context.Context, mod api.Module, ptr uint32) {
+	if inst := instanceFrom(ctx); inst != nil {
+		mod.Memory().Write(ptr, inst.result)
+		inst.result = nil
+	}
+}
@@ -0,0 +1,51 @@
+package resolver
+
+import (
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/grpclog"
+)
+
+// BalancerName is selected automatically for gonolith:/// targets
+const BalancerName = "gonolith_local_first"
+
+var grpcLogger = grpclog.Component("gonolith")
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(BalancerName, &pickerBuilder{}, base.Config{}))
+}
+
+type pickerBuilder struct{}
+
+// Round robin over the ready instances on our own node, or over every ready
+// instance when none of them is local
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	var local, all []balancer.SubConn
+	for sc, scInfo := range info.ReadySCs {
+		all = append(all, sc)
+		if IsLocal(scInfo.Address) {
+			local = append(local, sc)
+		}
+	}
+
+	if len(local) > 0 {
+		return &picker{subConns: local}
+	}
+	return &picker{subConns: all}
+}
+
+type picker struct {
+	subConns []balancer.SubConn
+	next     atomic.Uint32
+}
+
+func (p *picker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	n := p.next.Add(1)
+	return balancer.PickResult{SubConn: p.subConns[int(n)%len(p.subConns)]}, nil
+}
@@ -0,0 +1,171 @@
+// Package resolver lets grpc-go clients dial Gonolith services by name.
+//
+// Importing the package registers the "gonolith" scheme:
+//
+//	import _ "github.com/noahdw/Gonolith/resolver"
+//
+//	conn, err := grpc.NewClient("gonolith:///greeting",
+//		grpc.WithTransportCredentials(insecure.NewCredentials()))
+//
+// The resolver watches the local node's discovery API, so the connection
+// follows instances as they come and go. A version constraint can be added as
+// a query, e.g. "gonolith:///greeting?version=>=1.2". Calls go to instances on
+// the same node when there are any, over their Unix socket when they serve on
+// one. Calls to WebAssembly services go through the local node, which
+// authenticates them when it passes them on to other nodes.
+package resolver
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/noahdw/Gonolith/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcresolver "google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+const Scheme = "gonolith"
+
+// Used when the service was not started by a node, e.g. during development
+const defaultNodeAddr = "localhost:50051"
+
+func init() {
+	grpcresolver.Register(&builder{})
+}
+
+// Address of the local node's gRPC API, passed to every service by the node.
+// The node's Unix socket is preferred over TCP.
+func NodeAddr() string {
+	if socket := os.Getenv("GONOLITH_NODE_SOCKET"); socket != "" {
+		return "unix://" + socket
+	}
+	if addr := os.Getenv("GONOLITH_NODE_ADDR"); addr != "" {
+		return addr
+	}
+	return defaultNodeAddr
+}
+
+type localKey struct{}
+
+// Whether an address was marked as running on the caller's node
+func IsLocal(addr grpcresolver.Address) bool {
+	local, _ := addr.BalancerAttributes.Value(localKey{}).(bool)
+	return local
+}
+
+type builder struct{}
+
+func (b *builder) Scheme() string {
+	return Scheme
+}
+
+func (b *builder) Build(target grpcresolver.Target, cc grpcresolver.ClientConn, opts grpcresolver.BuildOptions) (grpcresolver.Resolver, error) {
+	conn, err := grpc.NewClient(NodeAddr(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &resolver{
+		cc:     cc,
+		conn:   conn,
+		client: api.NewDiscoveryClient(conn),
+		req: &api.ResolveRequest{
+			Name:    target.Endpoint(),
+			Version: target.URL.Query().Get("version"),
+		},
+		serviceConfig: cc.ParseServiceConfig(`{"loadBalancingConfig": [{"` + BalancerName + `": {}}]}`),
+		cancel:        cancel,
+		resolveNow:    make(chan struct{}, 1),
+	}
+
+	r.wg.Add(1)
+	go r.watch(ctx)
+	return r, nil
+}
+
+type resolver struct {
+	cc            grpcresolver.ClientConn
+	conn          *grpc.ClientConn
+	client        api.DiscoveryClient
+	req           *api.ResolveRequest
+	serviceConfig *serviceconfig.ParseResult
+
+	cancel     context.CancelFunc
+	resolveNow chan struct{}
+	wg         sync.WaitGroup
+}
+
+// Keep a watch open on the node, reconnecting with backoff when it breaks
+func (r *resolver) watch(ctx context.Context) {
+	defer r.wg.Done()
+
+	const minBackoff = 100 * time.Millisecond
+	backoff := minBackoff
+	for {
+		received, err := r.watchOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		r.cc.ReportError(err)
+		if received {
+			backoff = minBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.resolveNow:
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 10*time.Second)
+	}
+}
+
+// Reports whether any update arrived before the stream broke
+func (r *resolver) watchOnce(ctx context.Context) (bool, error) {
+	stream, err := r.client.Watch(ctx, r.req)
+	if err != nil {
+		return false, err
+	}
+
+	received := false
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return received, err
+		}
+		received = true
+
+		state := grpcresolver.State{ServiceConfig: r.serviceConfig}
+		for _, endpoint := range resp.Endpoints {
+			state.Addresses = append(state.Addresses, grpcresolver.Address{
+				Addr:               endpoint.Address,
+				ServerName:         resp.Name,
+				BalancerAttributes: attributes.New(localKey{}, endpoint.Local),
+			})
+		}
+		if err := r.cc.UpdateState(state); err != nil {
+			grpcLogger.Warningf("gonolith resolver: %s has no usable endpoints: %v", resp.Name, err)
+		}
+	}
+}
+
+// The watch already pushes every change, this only cuts a reconnect backoff short
+func (r *resolver) ResolveNow(grpcresolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+func (r *resolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+	r.conn.Close()
+}
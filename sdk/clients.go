@@ -0,0 +1,288 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/noahdw/Gonolith/api"
+	"github.com/noahdw/Gonolith/resolver"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func insecureCredentials() grpc.DialOption {
+	return grpc.WithTransportCredentials(insecure.NewCredentials())
+}
+
+// Client for the node's discovery API
+func (s *Service) Discovery() (api.DiscoveryClient, error) {
+	conn, err := s.node()
+	if err != nil {
+		return nil, err
+	}
+	return api.NewDiscoveryClient(conn), nil
+}
+
+// Connect to another service by name, e.g. "auth" or "auth?version=>=1.2".
+// The connection follows its instances and prefers the ones on this node.
+func (s *Service) Dial(name string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append([]grpc.DialOption{insecureCredentials()}, opts...)
+	return grpc.NewClient(resolver.Scheme+":///"+name, opts...)
+}
+
+// Call handle for every change of a service this one requires, until ctx is
+// done. Reconnects when the node goes away.
+func (s *Service) WatchDependencies(ctx context.Context, handle func(*api.DependencyEvent)) error {
+	if !s.Managed() {
+		return errors.New("not started by a Gonolith node")
+	}
+	conn, err := s.node()
+	if err != nil {
+		return err
+	}
+	client := api.NewDependenciesClient(conn)
+
+	const minBackoff = 100 * time.Millisecond
+	backoff := minBackoff
+	for {
+		stream, err := client.Watch(ctx, &api.WatchDependenciesRequest{ServiceId: s.ID})
+		for err == nil {
+			var event *api.DependencyEvent
+			event, err = stream.Recv()
+			if err == nil {
+				handle(event)
+				backoff = minBackoff
+			}
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 10*time.Second)
+	}
+}
+
+// Client for the node's event bus
+func (s *Service) Events() (api.EventsClient, error) {
+	conn, err := s.node()
+	if err != nil {
+		return nil, err
+	}
+	return api.NewEventsClient(conn), nil
+}
+
+// Publish to the subscribers of topic on every node, returns the message id
+func (s *Service) Publish(ctx context.Context, topic string, payload []byte) (string, error) {
+	client, err := s.Events()
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Publish(ctx, &api.PublishRequest{Topic: topic, Payload: payload})
+	if err != nil {
+		return "", err
+	}
+	return resp.MessageId, nil
+}
+
+// Call handle for every message of topic until ctx is done. Messages are
+// acked once handle returns nil and delivered again later otherwise. With a
+// subscriber name, e.g. the service name, messages wait on the node while
+// the service restarts. Reconnects when the node goes away.
+func (s *Service) Subscribe(ctx context.Context, topic, subscriber string, handle func(*api.Message) error) error {
+	client, err := s.Events()
+	if err != nil {
+		return err
+	}
+
+	const minBackoff = 100 * time.Millisecond
+	backoff := minBackoff
+	for {
+		err := subscribeOnce(ctx, client, topic, subscriber, handle, func() { backoff = minBackoff })
+		if ctx.Err() != nil {
+			return nil
+		}
+		if status.Code(err) == codes.InvalidArgument {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 10*time.Second)
+	}
+}
+
+func subscribeOnce(ctx context.Context, client api.EventsClient, topic, subscriber string, handle func(*api.Message) error, received func()) error {
+	stream, err := client.Subscribe(ctx)
+	if err != nil {
+		return err
+	}
+	err = stream.Send(&api.SubscribeRequest{Request: &api.SubscribeRequest_Subscription{
+		Subscription: &api.Subscription{Topic: topic, Subscriber: subscriber},
+	}})
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		received()
+		if handle(msg) != nil {
+			continue
+		}
+		err = stream.Send(&api.SubscribeRequest{Request: &api.SubscribeRequest_Ack{
+			Ack: &api.Ack{MessageId: msg.Id},
+		}})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Client for the cluster's key/value store
+func (s *Service) KV() (api.KVClient, error) {
+	conn, err := s.node()
+	if err != nil {
+		return nil, err
+	}
+	return api.NewKVClient(conn), nil
+}
+
+// Call handle with every key under prefix and then with every change, e.g.
+// to follow feature flags, until ctx is done. After reconnecting to the node
+// every key is delivered again, keys deleted meanwhile are not.
+func (s *Service) WatchKV(ctx context.Context, prefix string, handle func(*api.KeyEvent)) error {
+	client, err := s.KV()
+	if err != nil {
+		return err
+	}
+
+	const minBackoff = 100 * time.Millisecond
+	backoff := minBackoff
+	for {
+		stream, err := client.Watch(ctx, &api.WatchKeysRequest{Prefix: prefix, IncludeCurrent: true})
+		for err == nil {
+			var event *api.KeyEvent
+			event, err = stream.Recv()
+			if err == nil {
+				handle(event)
+				backoff = minBackoff
+			}
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 10*time.Second)
+	}
+}
+
+// Client for the cluster's locks, which need the raft control plane
+func (s *Service) Locks() (api.LocksClient, error) {
+	conn, err := s.node()
+	if err != nil {
+		return nil, err
+	}
+	return api.NewLocksClient(conn), nil
+}
+
+// Wait until holder gets the lock name for ttl, or ctx is done. An empty
+// holder stands for this service instance. Pass the returned token along to
+// the resources the lock guards so they can turn away older holders.
+func (s *Service) AcquireLock(ctx context.Context, name, holder string, ttl time.Duration) (*api.Lock, error) {
+	client, err := s.Locks()
+	if err != nil {
+		return nil, err
+	}
+	if holder == "" {
+		holder = s.ID
+	}
+
+	for {
+		lock, err := client.Acquire(ctx, &api.AcquireLockRequest{
+			Name:       name,
+			Holder:     holder,
+			TtlSeconds: uint32(ttl / time.Second),
+		})
+		switch status.Code(err) {
+		case codes.OK:
+			return lock, nil
+		case codes.FailedPrecondition, codes.Unavailable:
+		default:
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Renew a lock every third of ttl until ctx is done, then release it.
+// Returns an error once the lock was lost, after which its holder must stop
+// doing what the lock guards.
+func (s *Service) KeepLock(ctx context.Context, lock *api.Lock, ttl time.Duration) error {
+	client, err := s.Locks()
+	if err != nil {
+		return err
+	}
+	if ttl < time.Second {
+		// What the node uses for a TTL of zero seconds
+		ttl = 30 * time.Second
+	}
+
+	// The lock expires ttl after its last renewal the node confirmed
+	renewed := time.Now()
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			release, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			client.Release(release, &api.ReleaseLockRequest{Name: lock.Name, Token: lock.Token})
+			return nil
+		case <-ticker.C:
+		}
+
+		renew, cancel := context.WithTimeout(ctx, ttl/3)
+		_, err := client.Renew(renew, &api.RenewLockRequest{
+			Name:       lock.Name,
+			Token:      lock.Token,
+			TtlSeconds: uint32(ttl / time.Second),
+		})
+		cancel()
+		switch status.Code(err) {
+		case codes.OK:
+			renewed = time.Now()
+		case codes.Unavailable, codes.Canceled, codes.DeadlineExceeded:
+			// Tried again on the next tick while the lock has not expired
+			if time.Since(renewed) >= ttl {
+				return fmt.Errorf("lock %s expired, not renewed for %s: %w", lock.Name, ttl, err)
+			}
+		default:
+			return err
+		}
+	}
+}
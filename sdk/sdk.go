@@ -0,0 +1,109 @@
+// Package sdk wires a Go service into Gonolith with a few lines:
+//
+//	svc := sdk.New()
+//	server := svc.NewServer()
+//	pb.RegisterGreeterServer(server, &greeter{})
+//	if err := svc.Serve(server); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// New reads what the node passes to every service through the environment.
+// NewServer returns a gRPC server with health checks and reflection already
+// registered, and Serve listens on the allocated port and Unix socket, reports
+// the service as serving and drains it on SIGTERM.
+//
+// Discovery, Dial and WatchDependencies talk to the local node.
+package sdk
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/noahdw/Gonolith/resolver"
+	"github.com/pelletier/go-toml/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+)
+
+// Service is a service as the node started it
+type Service struct {
+	// GONOLITH_SERVICE_ID, empty outside of Gonolith
+	ID string
+	// Name of the node running the service
+	Node string
+	// Where Serve listens for TCP. The first port the service declared, set it
+	// before calling Serve to have a default outside of Gonolith.
+	Port string
+	// Unix socket Serve also listens on for callers on the same node
+	Socket string
+	// How long Serve lets in-flight calls finish after SIGTERM
+	DrainTimeout time.Duration
+
+	ports  map[string]string
+	health *health.Server
+
+	connOnce sync.Once
+	nodeConn *grpc.ClientConn
+	nodeErr  error
+}
+
+func New() *Service {
+	s := &Service{
+		ID:           os.Getenv("GONOLITH_SERVICE_ID"),
+		Node:         os.Getenv("GONOLITH_NODE"),
+		Port:         os.Getenv("GONOLITH_PORT"),
+		Socket:       os.Getenv("GONOLITH_SOCKET"),
+		DrainTimeout: 10 * time.Second,
+		ports:        make(map[string]string),
+		health:       health.NewServer(),
+	}
+
+	const prefix = "GONOLITH_PORT_"
+	for _, env := range os.Environ() {
+		key, value, _ := strings.Cut(env, "=")
+		if name, ok := strings.CutPrefix(key, prefix); ok {
+			s.ports[strings.ToLower(name)] = value
+		}
+	}
+	return s
+}
+
+// Port the node allocated under a name declared in config.toml, e.g.
+// "metrics" for ports = ["grpc", "metrics"]. Empty when there is none.
+func (s *Service) PortFor(name string) string {
+	return s.ports[strings.ToLower(strings.ReplaceAll(name, "-", "_"))]
+}
+
+// Whether the service was started by a Gonolith node
+func (s *Service) Managed() bool {
+	return s.ID != ""
+}
+
+// Decode the service's config.toml, which the node puts in the working
+// directory of the service, into v
+func (s *Service) LoadConfig(v any) error {
+	raw, err := os.ReadFile("config.toml")
+	if err != nil {
+		return err
+	}
+	return toml.Unmarshal(raw, v)
+}
+
+// Connection to the local node's gRPC API, over its Unix socket when there is
+// one
+func (s *Service) node() (*grpc.ClientConn, error) {
+	s.connOnce.Do(func() {
+		s.nodeConn, s.nodeErr = grpc.NewClient(resolver.NodeAddr(), insecureCredentials())
+	})
+	return s.nodeConn, s.nodeErr
+}
+
+// Close the connection to the node, if one was opened
+func (s *Service) Close() error {
+	if s.nodeConn != nil {
+		return s.nodeConn.Close()
+	}
+	return nil
+}
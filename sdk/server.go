@@ -0,0 +1,96 @@
+package sdk
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+// A gRPC server with health checks and reflection registered, so the node can
+// tell when the service is ready and what it exposes
+func (s *Service) NewServer(opts ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(opts...)
+	healthpb.RegisterHealthServer(server, s.health)
+	reflection.Register(server)
+	return server
+}
+
+// Serve on Port and Socket until SIGTERM or SIGINT. The service then reports
+// itself as not serving so the node stops routing to it, and in-flight calls
+// get DrainTimeout to finish. Returns nil after a drain.
+func (s *Service) Serve(server *grpc.Server) error {
+	if s.Port == "" {
+		return errors.New("no port to serve on, declare ports in config.toml or set Port")
+	}
+
+	var listeners []net.Listener
+	lis, err := net.Listen("tcp", ":"+s.Port)
+	if err != nil {
+		return fmt.Errorf("cannot listen on port %s: %w", s.Port, err)
+	}
+	listeners = append(listeners, lis)
+
+	if s.Socket != "" {
+		// A socket left behind by a previous run would make Listen fail
+		os.Remove(s.Socket)
+		lis, err := net.Listen("unix", s.Socket)
+		if err != nil {
+			listeners[0].Close()
+			return fmt.Errorf("cannot listen on socket %s: %w", s.Socket, err)
+		}
+		listeners = append(listeners, lis)
+	}
+
+	for name := range server.GetServiceInfo() {
+		s.health.SetServingStatus(name, healthpb.HealthCheckResponse_SERVING)
+	}
+	s.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+
+	errs := make(chan error, len(listeners))
+	for _, lis := range listeners {
+		go func(lis net.Listener) {
+			errs <- server.Serve(lis)
+		}(lis)
+	}
+	slog.Info("Serving", "service", s.ID, "port", s.Port, "socket", s.Socket)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(stop)
+
+	select {
+	case err := <-errs:
+		server.Stop()
+		return err
+	case sig := <-stop:
+		slog.Info("Draining", "service", s.ID, "signal", sig)
+		s.drain(server)
+		return nil
+	}
+}
+
+func (s *Service) drain(server *grpc.Server) {
+	s.health.Shutdown()
+
+	done := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(s.DrainTimeout):
+		slog.Warn("Drain timed out, stopping", "service", s.ID, "timeout", s.DrainTimeout)
+		server.Stop()
+	}
+}
@@ -7,6 +7,11 @@ import requests
 import zipfile
 from pathlib import Path
 
+def auth_headers():
+    """API token for nodes that require authentication."""
+    token = os.environ.get("GONOLITH_TOKEN")
+    return {"Authorization": f"Bearer {token}"} if token else {}
+
 def get_project_root():
     """Get the absolute path to the project root."""
     return Path(__file__).parent.parent.parent.absolute()
@@ -176,7 +181,7 @@ class GonolithCluster:
         
         # Verify node is still running
         try:
-            check_response = requests.get(f"http://localhost:{http_port}/get-status", timeout=2)
+            check_response = requests.get(f"http://localhost:{http_port}/v1/services", headers=auth_headers(), timeout=2)
             if check_response.status_code != 200:
                 print(f"Node {node_name} is not responding correctly")
                 return False
@@ -185,17 +190,18 @@ class GonolithCluster:
             return False
             
         # Install service
-        print(f"Installing service to http://localhost:{http_port}/install-service...")
+        print(f"Installing service to http://localhost:{http_port}/v1/services...")
         try:
             with open(zip_path, "rb") as f:
                 response = requests.post(
-                    f"http://localhost:{http_port}/install-service", 
+                    f"http://localhost:{http_port}/v1/services", 
                     data=f,
+                    headers=auth_headers(),
                     timeout=10  # Longer timeout for installation
                 )
             
-            if response.status_code == 200:
-                print(f"Service installed successfully. Service ID: {response.text}")
+            if response.status_code == 201:
+                print(f"Service installed successfully. Service ID: {response.json()['id']}")
                 # Clean up zip file
                 os.remove(zip_path)
                 return True
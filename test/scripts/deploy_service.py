@@ -4,6 +4,11 @@ import subprocess
 import requests
 from pathlib import Path
 
+def auth_headers():
+    """API token for nodes that require authentication."""
+    token = os.environ.get("GONOLITH_TOKEN")
+    return {"Authorization": f"Bearer {token}"} if token else {}
+
 def get_project_root():
     """Get the project root directory."""
     return Path(__file__).parent.parent.parent
@@ -53,10 +58,10 @@ def install_service(zip_path):
     """Install the service to Gonolith."""
     print("Installing service to Gonolith...")
     with open(zip_path, "rb") as f:
-        response = requests.post("http://localhost:8080/install-service", data=f)
+        response = requests.post("http://localhost:8080/v1/services", data=f, headers=auth_headers())
     
-    if response.status_code == 200:
-        print(f"Service installed successfully. Service ID: {response.text}")
+    if response.status_code == 201:
+        print(f"Service installed successfully. Service ID: {response.json()['id']}")
         return True
     else:
         print(f"Installation failed with status {response.status_code}: {response.text}")
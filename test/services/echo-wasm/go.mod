@@ -0,0 +1,3 @@
+module github.com/noahdw/Gonolith/test/echo-wasm
+
+go 1.24
@@ -0,0 +1,119 @@
+// An echo service that runs inside the node as WebAssembly. Build with
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o echo.wasm .
+//
+// and zip echo.wasm with config.toml.
+package main
+
+import (
+	"unsafe"
+)
+
+//go:wasmimport gonolith log
+func hostLog(level, ptr, length uint32)
+
+//go:wasmimport gonolith config
+func hostConfig(ptr, length uint32) int32
+
+//go:wasmimport gonolith call
+func hostCall(methodPtr, methodLen, reqPtr, reqLen uint32) int32
+
+//go:wasmimport gonolith take_result
+func hostTakeResult(ptr uint32)
+
+// Buffers handed to the host stay referenced until the next call
+var buffers = map[uint32][]byte{}
+
+//go:wasmexport gonolith_alloc
+func alloc(size uint32) uint32 {
+	buf := make([]byte, size+1)
+	ptr := uint32(uintptr(unsafe.Pointer(&buf[0])))
+	buffers[ptr] = buf
+	return ptr
+}
+
+//go:wasmexport gonolith_handle
+func handle(methodPtr, methodLen, reqPtr, reqLen uint32) uint64 {
+	method := string(take(methodPtr, methodLen))
+	req := take(reqPtr, reqLen)
+
+	switch method {
+	case "/echo.Echo/Echo":
+		// Echo has the same request and response message
+		return result(req, false)
+	case "/echo.Echo/Greet":
+		// Greet takes a greeting.HelloRequest and answers with the greeting
+		// service's reply, in-process when it runs as WebAssembly too
+		greeter, ok := config("greeting_method")
+		if !ok {
+			return result([]byte("greeting_method is not configured"), true)
+		}
+		resp, err := call(greeter, req)
+		if err != nil {
+			return result([]byte(err.Error()), true)
+		}
+		return result(resp, false)
+	default:
+		return result([]byte("unknown method "+method), true)
+	}
+}
+
+func take(ptr, length uint32) []byte {
+	buf := buffers[ptr]
+	delete(buffers, ptr)
+	return buf[:length]
+}
+
+func pointer(data []byte) uint32 {
+	if len(data) == 0 {
+		return 0
+	}
+	return uint32(uintptr(unsafe.Pointer(&data[0])))
+}
+
+// Pack a response or error message the way the host reads it
+var last []byte
+
+func result(data []byte, failed bool) uint64 {
+	last = data
+	length := int32(len(data))
+	if failed {
+		length = -length
+	}
+	return uint64(pointer(data))<<32 | uint64(uint32(length))
+}
+
+func logInfo(msg string) {
+	hostLog(1, pointer([]byte(msg)), uint32(len(msg)))
+}
+
+func config(key string) (string, bool) {
+	n := hostConfig(pointer([]byte(key)), uint32(len(key)))
+	if n < 0 {
+		return "", false
+	}
+	value := make([]byte, n+1)
+	hostTakeResult(pointer(value))
+	return string(value[:n]), true
+}
+
+func call(method string, req []byte) ([]byte, error) {
+	logInfo("Calling " + method)
+	n := hostCall(pointer([]byte(method)), uint32(len(method)), pointer(req), uint32(len(req)))
+	failed := n < 0
+	if failed {
+		n = -n
+	}
+	out := make([]byte, n+1)
+	hostTakeResult(pointer(out))
+	if failed {
+		return nil, callError(out[:n])
+	}
+	return out[:n], nil
+}
+
+type callError string
+
+func (e callError) Error() string { return string(e) }
+
+func main() {}
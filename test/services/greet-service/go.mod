@@ -3,10 +3,18 @@ module github.com/noahdw/Gonolith/test/greet-service
 go 1.22.4
 
 require (
-	golang.org/x/net v0.32.0 // indirect
-	golang.org/x/sys v0.28.0 // indirect
+	github.com/noahdw/Gonolith v0.0.0
+	google.golang.org/grpc v1.70.0
+	google.golang.org/protobuf v1.35.2
+)
+
+require (
+	github.com/pelletier/go-toml/v2 v2.2.3 // indirect
+	golang.org/x/net v0.34.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20241202173237-19429a94021a // indirect
-	google.golang.org/grpc v1.70.0 // indirect
-	google.golang.org/protobuf v1.35.2 // indirect
 )
+
+// The SDK comes from this repository
+replace github.com/noahdw/Gonolith => ../../..
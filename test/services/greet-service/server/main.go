@@ -3,12 +3,9 @@ package main
 import (
 	"context"
 	"log"
-	"net"
 
+	"github.com/noahdw/Gonolith/sdk"
 	pb "github.com/noahdw/Gonolith/test/greet-service"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/health"
-	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 type server struct {
@@ -22,20 +19,17 @@ func (s *server) SayHello(ctx context.Context, req *pb.HelloRequest) (*pb.HelloR
 }
 
 func main() {
-	lis, err := net.Listen("tcp", "0.0.0.0:8088")
-	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+	// Ports, socket and health checks come from the node
+	svc := sdk.New()
+	if svc.Port == "" {
+		svc.Port = "8088"
 	}
 
-	s := grpc.NewServer()
-
-	healthServer := health.NewServer()
-	healthpb.RegisterHealthServer(s, healthServer)
-
+	s := svc.NewServer()
 	pb.RegisterGreeterServer(s, &server{})
 
-	log.Println("Server starting on :50051")
-	if err := s.Serve(lis); err != nil {
+	log.Println("Server starting on :" + svc.Port)
+	if err := svc.Serve(s); err != nil {
 		log.Fatalf("failed to serve: %v", err)
 	}
 }